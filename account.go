@@ -0,0 +1,392 @@
+package aurora
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gernest/nutz"
+)
+
+const (
+	// the default number of seconds before a deleted account is purged.
+	defaultDeletionGrace = 14 * 24 * 3600
+
+	// audit events of account deletion
+	auditDeletion         = "deletion"
+	auditDeletionCanceled = "deletion_canceled"
+	auditPurge            = "purge"
+)
+
+var (
+	// MsgWrongPassword is the error message shown when the current password is wrong
+	MsgWrongPassword = "namba ya siri sio sahihi"
+
+	// MsgDeletionScheduled is shown after asking for the account to be deleted
+	MsgDeletionScheduled = "akaunti yako itafutwa tarehe %s, ingia kabla ya hapo kama umebadili mawazo"
+
+	// MsgDeletionCanceled is shown when logging in cancels the deletion
+	MsgDeletionCanceled = "karibu tena, akaunti yako haitafutwa"
+)
+
+// ChangePassword changes the password of the current user. The current password is
+// required, and all the other sessions of the user are signed out.
+func (rx *Remix) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		data     = rx.setSessionData(r)
+		passPath = "auth/password"
+		adb      = setDB(rx.db, rx.cfg.AccountsDB)
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Redirect(w, r, "/auth/login", http.StatusFound)
+		return
+	}
+	if r.Method == "GET" {
+		rx.rendr.HTML(w, http.StatusOK, passPath, data)
+		return
+	}
+	form := ComposePasswordForm()(r)
+	if !form.IsValid() {
+		data.Add("errors", form.Errors())
+		rx.rendr.HTML(w, http.StatusOK, passPath, data)
+		return
+	}
+	f := form.GetModel().(passwordForm)
+	user, _, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	if status, err := rx.checkCurrentPassword(r, user, f.Password); err != nil {
+		data.Add("error", err.Error())
+		rx.rendr.HTML(w, status, passPath, data)
+		return
+	}
+	user.Pass, err = hashPassword(f.Pass)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	user.UpdatedAt = time.Now()
+	if err = UpdateUser(adb, user, rx.cfg.AccountsBucket); err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	if _, err = rx.sess.RevokeAll(user.EmailAddress, ss.ID); err != nil {
+		log.Println(err)
+	}
+	flash := NewFlash()
+	flash.Success("namba ya siri imebadilishwa")
+	flash.Save(ss)
+	ss.Save(r, w)
+	http.Redirect(w, r, "/auth/password", http.StatusFound)
+}
+
+// ChangeEmail changes the email address of the current user. The current password is
+// required. Since accounts are keyed by email, the account is moved to the new
+// address, which has to be verified again.
+func (rx *Remix) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var (
+		data      = rx.setSessionData(r)
+		emailPath = "auth/email"
+		adb       = setDB(rx.db, rx.cfg.AccountsDB)
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Redirect(w, r, "/auth/login", http.StatusFound)
+		return
+	}
+	if r.Method == "GET" {
+		rx.rendr.HTML(w, http.StatusOK, emailPath, data)
+		return
+	}
+	form := ComposeEmailForm()(r)
+	if !form.IsValid() {
+		data.Add("errors", form.Errors())
+		rx.rendr.HTML(w, http.StatusOK, emailPath, data)
+		return
+	}
+	f := form.GetModel().(emailForm)
+	user, _, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	if status, err := rx.checkCurrentPassword(r, user, f.Password); err != nil {
+		data.Add("error", err.Error())
+		rx.rendr.HTML(w, status, emailPath, data)
+		return
+	}
+	old := user.EmailAddress
+	if f.Email == old {
+		http.Redirect(w, r, "/auth/email", http.StatusFound)
+		return
+	}
+	user.EmailAddress = f.Email
+	user.EmailVerified = false
+	user.VerifiedAt = time.Time{}
+	user.UpdatedAt = time.Now()
+	err = RenameUser(adb, user, rx.cfg.AccountsBucket, old)
+	if err != nil {
+		if err == errEmailTaken {
+			data.Add("error", err.Error())
+			rx.rendr.HTML(w, http.StatusOK, emailPath, data)
+			return
+		}
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+
+	// the other sessions belong to the old address, saving the current one moves
+	// it to the new address.
+	if _, err = rx.sess.RevokeAll(old, ss.ID); err != nil {
+		log.Println(err)
+	}
+	ss.Values["user"] = user.EmailAddress
+	if err = rx.sendVerification(user); err != nil {
+		log.Println(err)
+	}
+	flash := NewFlash()
+	flash.Success("email imebadilishwa, tafadhali thibitisha email yako mpya")
+	flash.Save(ss)
+	if err = ss.Save(r, w); err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	http.Redirect(w, r, "/auth/email", http.StatusFound)
+}
+
+// checks the current password of the user before changing the account. Wrong
+// passwords count as failed logins, otherwise anyone with a stolen session could use
+// this to guess the password.
+func (rx *Remix) checkCurrentPassword(r *http.Request, user *User, pass string) (int, error) {
+	ip := clientIP(r)
+	if until := rx.lockedUntil(user.EmailAddress, ip); !until.IsZero() {
+		return http.StatusTooManyRequests, errors.New(lockedMsg(until))
+	}
+	if err := verifyPass(user.Pass, pass); err != nil {
+		rx.loginFailed(user.EmailAddress, ip)
+		return http.StatusOK, errors.New(MsgWrongPassword)
+	}
+	return http.StatusOK, nil
+}
+
+// DeleteAccount schedules the account of the current user for deletion. The current
+// password is required. The account stays around for the grace period, during which
+// logging in cancels the deletion, after that it is purged by PurgeDeletedAccounts.
+//
+// All the sessions of the user are signed out.
+func (rx *Remix) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var (
+		data       = rx.setSessionData(r)
+		deletePath = "account/delete"
+		loginPath  = "/auth/login"
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	grace := secondsOr(rx.cfg.DeletionGracePeriod, defaultDeletionGrace)
+	if r.Method == "GET" {
+		data.Add("graceDays", int(grace.Hours()/24))
+		rx.rendr.HTML(w, http.StatusOK, deletePath, data)
+		return
+	}
+	user, _, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	if status, err := rx.checkCurrentPassword(r, user, r.FormValue("password")); err != nil {
+		data.Add("error", err.Error())
+		data.Add("graceDays", int(grace.Hours()/24))
+		rx.rendr.HTML(w, status, deletePath, data)
+		return
+	}
+	user.DeleteAt = time.Now().Add(grace)
+	if err = UpdateUser(setDB(rx.db, rx.cfg.AccountsDB), user, rx.cfg.AccountsBucket); err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	if _, err = rx.sess.RevokeAll(user.EmailAddress, ""); err != nil {
+		log.Println(err)
+	}
+	rx.audit(&AuditEvent{
+		Kind:    auditDeletion,
+		Subject: user.EmailAddress,
+		Actor:   user.EmailAddress,
+		IP:      clientIP(r),
+		Detail:  "delete at " + user.DeleteAt.Format(time.RFC3339),
+	})
+	ss = rx.freshSession(r)
+	flash := NewFlash()
+	flash.Success(fmt.Sprintf(MsgDeletionScheduled, user.DeleteAt.Format("2006-01-02")))
+	flash.Save(ss)
+	ss.Save(r, w)
+	http.Redirect(w, r, loginPath, http.StatusFound)
+}
+
+// ExportAccount streams a zip archive with the data of the current user, that is the
+// profile, the uploaded photos and all the messages.
+func (rx *Remix) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Redirect(w, r, "/auth/login", http.StatusFound)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", rx.setSessionData(r))
+		return
+	}
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, p.ID, rx.cfg.DBExtension))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"aurora-%s.zip\"", p.ID))
+
+	// the headers are gone by the time anything fails, so all we can do is log.
+	if err = writeExport(w, pdb, p, rx.cfg.MessagesBucket); err != nil {
+		log.Println(err)
+	}
+}
+
+// writes a zip archive of the data in the profile database to w. The archive looks
+// like this
+//
+//	profile.json
+//	photos/<id>.<type>
+//	attachments/<id>/<name>
+//	messages/{inbox,outbox,drafts,read}.json
+func writeExport(w io.Writer, db nutz.Storage, p *Profile, msgBucket string) error {
+	z := zip.NewWriter(w)
+	add := func(name string, data []byte) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	prof, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = add("profile.json", prof); err != nil {
+		return err
+	}
+	photos := db.GetAll(photoBucket, dataBucket)
+	for _, id := range sortedKeys(photos.DataList) {
+		pic := &Photo{}
+		if err = getAndUnmarshall(db, photoBucket, id, pic, metaBucket); err != nil {
+			continue
+		}
+		if err = add(path.Join("photos", id+"."+pic.Type), photos.DataList[id]); err != nil {
+			return err
+		}
+	}
+	files := db.GetAll(attachmentBucket, dataBucket)
+	for _, id := range sortedKeys(files.DataList) {
+		a := &Attachment{}
+		if err = getAndUnmarshall(db, attachmentBucket, id, a, metaBucket); err != nil {
+			continue
+		}
+		if err = add(path.Join("attachments", id, path.Base(a.Name)), files.DataList[id]); err != nil {
+			return err
+		}
+	}
+	for _, b := range []string{inboxBucket, outboxBucket, draftBucket, readBucket} {
+		msgs := []json.RawMessage{}
+		all := db.GetAll(b, msgBucket)
+		for _, k := range sortedKeys(all.DataList) {
+			msgs = append(msgs, json.RawMessage(all.DataList[k]))
+		}
+		d, err := json.MarshalIndent(msgs, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err = add(path.Join("messages", b+".json"), d); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cancels the scheduled deletion of the account, if there is one. It returns true if
+// the deletion was canceled.
+func (rx *Remix) cancelDeletion(user *User) bool {
+	if user.DeleteAt.IsZero() {
+		return false
+	}
+	user.DeleteAt = time.Time{}
+	if err := UpdateUser(setDB(rx.db, rx.cfg.AccountsDB), user, rx.cfg.AccountsBucket); err != nil {
+		log.Println(err)
+		return false
+	}
+	rx.audit(&AuditEvent{Kind: auditDeletionCanceled, Subject: user.EmailAddress, Actor: user.EmailAddress})
+	return true
+}
+
+// PurgeDeletedAccounts deletes the accounts whose grace period is over, it returns
+// the number of accounts deleted.
+func (rx *Remix) PurgeDeletedAccounts() (int, error) {
+	var n int
+	all := setDB(rx.db, rx.cfg.AccountsDB).GetAll(rx.cfg.AccountsBucket)
+	if all.Error != nil {
+		return 0, all.Error
+	}
+	for _, v := range all.DataList {
+		user := &User{}
+		if err := json.Unmarshal(v, user); err != nil || !user.deleted() {
+			continue
+		}
+		if err := rx.purgeAccount(user); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// deletes everything about the user for good. Photos and messages live in the
+// profile database, so removing the database file takes care of them. Messages sent
+// to groups stay with the groups.
+func (rx *Remix) purgeAccount(user *User) error {
+	if _, err := rx.sess.RevokeAll(user.EmailAddress, ""); err != nil {
+		log.Println(err)
+	}
+	groups, _ := rx.msg.userGroups(user.UUID)
+	for _, g := range groups {
+		if _, err := rx.msg.leaveGroup(user.UUID, g.ID); err != nil {
+			log.Println(err)
+		}
+	}
+	pdb := getProfileDatabase(rx.cfg.DBDir, user.UUID, rx.cfg.DBExtension)
+	if err := os.Remove(pdb); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rx.deleteAttempts(accountAttempts, user.EmailAddress)
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	if err := adb.Delete(rx.cfg.AccountsBucket, user.EmailAddress).Error; err != nil {
+		return err
+	}
+	rx.audit(&AuditEvent{Kind: auditPurge, Subject: user.EmailAddress, Detail: "uuid " + user.UUID})
+	return nil
+}
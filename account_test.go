@@ -0,0 +1,370 @@
+package aurora
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gernest/nutz"
+)
+
+// registers a new user with the given email and password, the client is logged in.
+func testRegister(t *testing.T, ts string, client *http.Client, email, pass string) {
+	vars := url.Values{
+		"first_name":    {"account"},
+		"last_name":     {"aurora"},
+		"email_address": {email},
+		"pass":          {pass},
+		"confirm_pass":  {pass},
+	}
+	res, err := client.PostForm(ts+"/auth/register", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// returns a new client logged in as the given user.
+func testLogin(t *testing.T, ts string, email, pass string) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	res, err := client.PostForm(ts+"/auth/login", url.Values{"email": {email}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "search")
+	if err != nil {
+		t.Error(err)
+	}
+	return client
+}
+
+func TestRemix_ChangePassword(t *testing.T) {
+	var (
+		email    = "password@aurora.com"
+		pass     = "mamamia"
+		newPass  = "mamamia2"
+		passPath = "/auth/password"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+	testRegister(t, ts.URL, client, email, pass)
+	other := testLogin(t, ts.URL, email, pass)
+
+	res, err := client.PostForm(ts.URL+passPath, url.Values{
+		"password": {"wrongpass"}, "pass": {newPass}, "confirm_pass": {newPass},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, MsgWrongPassword)
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+passPath, url.Values{
+		"password": {pass}, "pass": {newPass}, "confirm_pass": {newPass},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "password-form")
+	if err != nil {
+		t.Error(err)
+	}
+	user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyPass(user.Pass, newPass); err != nil {
+		t.Error(err)
+	}
+
+	// the other session is signed out
+	res, err = other.Get(ts.URL + passPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "login-form")
+	if err != nil {
+		t.Error(err)
+	}
+	testLogin(t, ts.URL, email, newPass)
+}
+
+func TestRemix_ChangeEmail(t *testing.T) {
+	var (
+		email     = "email@aurora.com"
+		newEmail  = "email2@aurora.com"
+		taken     = "email3@aurora.com"
+		pass      = "mamamia"
+		emailPath = "/auth/email"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	ps, err := hashPassword(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CreateAccount(adb, &User{UUID: getUUID(), EmailAddress: taken, Pass: ps}, rx.cfg.AccountsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRegister(t, ts.URL, client, email, pass)
+	before, err := GetUser(adb, rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testLogin(t, ts.URL, email, pass)
+
+	res, err := client.PostForm(ts.URL+emailPath, url.Values{"email": {taken}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, errEmailTaken.Error())
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+emailPath, url.Values{"email": {newEmail}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, newEmail)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = GetUser(adb, rx.cfg.AccountsBucket, email); err == nil {
+		t.Errorf("Expected %s to be gone", email)
+	}
+	user, err := GetUser(adb, rx.cfg.AccountsBucket, newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UUID != before.UUID {
+		t.Errorf("Expected %s got %s", before.UUID, user.UUID)
+	}
+	if user.EmailVerified {
+		t.Error("Expected the new email not to be verified")
+	}
+	if rx.mail.(*MemMailer).Last(newEmail) == nil {
+		t.Error("Expected a verification email to the new address")
+	}
+	ids, err := GetAllUsers(adb, rx.cfg.AccountsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, v := range ids {
+		if v == user.UUID {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("Expected the account once got %d", n)
+	}
+
+	// the current session moved to the new address, the other one is signed out
+	list, err := rx.sess.UserSessions(newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("Expected 1 session got %d", len(list))
+	}
+	res, err = other.Get(ts.URL + emailPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "login-form")
+	if err != nil {
+		t.Error(err)
+	}
+	testLogin(t, ts.URL, newEmail, pass)
+}
+
+func TestRemix_DeleteAccount(t *testing.T) {
+	var (
+		email      = "delete@aurora.com"
+		pass       = "mamamia"
+		deletePath = "/account/delete"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	testRegister(t, ts.URL, client, email, pass)
+
+	res, err := client.PostForm(ts.URL+deletePath, url.Values{"password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "login-form")
+	if err != nil {
+		t.Error(err)
+	}
+	user, err := GetUser(adb, rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DeleteAt.IsZero() {
+		t.Fatal("Expected the account to be scheduled for deletion")
+	}
+	if n, _ := rx.PurgeDeletedAccounts(); n != 0 {
+		t.Errorf("Expected nothing to be purged during the grace period got %d", n)
+	}
+
+	// logging in cancels the deletion
+	client = testLogin(t, ts.URL, email, pass)
+	user, err = GetUser(adb, rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.DeleteAt.IsZero() {
+		t.Error("Expected the deletion to be canceled")
+	}
+
+	res, err = client.PostForm(ts.URL+deletePath, url.Values{"password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	user, err = GetUser(adb, rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.DeleteAt = time.Now().Add(-time.Minute)
+	if err = UpdateUser(adb, user, rx.cfg.AccountsBucket); err != nil {
+		t.Fatal(err)
+	}
+	n, err := rx.PurgeDeletedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 got %d", n)
+	}
+	if _, err = GetUser(adb, rx.cfg.AccountsBucket, email); err == nil {
+		t.Error("Expected the account to be gone")
+	}
+	pdb := getProfileDatabase(rx.cfg.DBDir, user.UUID, rx.cfg.DBExtension)
+	if _, err = os.Stat(pdb); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be gone", pdb)
+	}
+}
+
+func TestRemix_ExportAccount(t *testing.T) {
+	var (
+		email = "export@aurora.com"
+		pass  = "mamamia"
+	)
+	ts, client, _ := testServer(t)
+	defer ts.Close()
+	testRegister(t, ts.URL, client, email, pass)
+
+	content, contentType := testUpData("me.jpg", "single", t)
+	res, err := client.Post(ts.URL+"/uploads", contentType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = client.Get(ts.URL + "/account/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Expected application/zip got %s", ct)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var photos int
+	for _, f := range z.File {
+		if len(f.Name) > 7 && f.Name[:7] == "photos/" {
+			photos++
+		}
+	}
+	if photos != 1 {
+		t.Errorf("Expected 1 photo got %d", photos)
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	var (
+		msgBucket = "messages"
+		p         = &Profile{ID: getUUID(), FirstName: "export"}
+	)
+	edb := nutz.NewStorage("_export.ddb", 0600, nil)
+	defer edb.DeleteDatabase()
+
+	pic := &Photo{ID: getUUID(), Type: "jpg"}
+	if err := marshalAndCreate(edb, pic, "photos", pic.ID, "meta"); err != nil {
+		t.Fatal(err)
+	}
+	if s := edb.Create("photos", pic.ID, []byte("picture"), "data"); s.Error != nil {
+		t.Fatal(s.Error)
+	}
+	a := &Attachment{ID: getUUID(), Name: "notes.txt"}
+	if err := saveUpload(edb, attachmentBucket, a.ID, a, []byte("notes")); err != nil {
+		t.Fatal(err)
+	}
+	msg := &MSG{ID: getUUID(), Text: "hello"}
+	if err := marshalAndCreate(edb, msg, inboxBucket, msg.ID, msgBucket); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeExport(buf, edb, p, msgBucket); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	for _, name := range []string{
+		"profile.json", "photos/" + pic.ID + ".jpg", "attachments/" + a.ID + "/notes.txt",
+		"messages/inbox.json", "messages/outbox.json", "messages/drafts.json", "messages/read.json",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in the archive", name)
+		}
+	}
+	if string(files["photos/"+pic.ID+".jpg"]) != "picture" {
+		t.Errorf("Expected picture got %s", files["photos/"+pic.ID+".jpg"])
+	}
+	var inbox []*MSG
+	if err = json.Unmarshal(files["messages/inbox.json"], &inbox); err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 1 || inbox[0].Text != "hello" {
+		t.Errorf("Expected the message in the inbox got %v", inbox)
+	}
+}
@@ -0,0 +1,500 @@
+package aurora
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// all api endpoints are mounted under this path.
+	apiPrefix = "/api/v1"
+
+	jsonContentType = "application/json"
+)
+
+var errNotAcceptable = errors.New("aurora: the api only speaks application/json")
+
+// apiError is the envelope used for all error responses of the json api. It looks
+// like this
+//
+//	{"error":{"status":404,"message":"..."}}
+type apiError struct {
+	Error *apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// apiPhotos is the response of a successful photo upload.
+type apiPhotos struct {
+	ProfilePic *Photo   `json:"profile_photo,omitempty"`
+	Photos     []*Photo `json:"photos,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// registers the json api routes on the given router. The router is expected to be
+// mounted at apiPrefix.
+func (rx *Remix) apiRoutes(h *mux.Router) {
+	h.HandleFunc("/me", rx.apiJSON(rx.APIMe)).Methods("GET", "PUT", "POST")
+	h.HandleFunc("/me/sessions", rx.apiJSON(rx.APISessions)).Methods("GET", "DELETE")
+	h.HandleFunc("/me/sessions/{id}", rx.apiJSON(rx.APIRevokeSession)).Methods("DELETE")
+	h.HandleFunc("/profiles", rx.apiJSON(rx.APIProfiles)).Methods("GET")
+	h.HandleFunc("/profiles/{id}", rx.apiJSON(rx.APIProfile)).Methods("GET")
+	h.HandleFunc("/photos", rx.apiJSON(rx.APIUploadPhotos)).Methods("POST")
+	h.HandleFunc("/photos/{id}", rx.apiJSON(rx.APIPhoto)).Methods("GET")
+	h.HandleFunc("/attachments", rx.apiJSON(rx.APIUploadAttachment)).Methods("POST")
+	h.HandleFunc("/conversations", rx.apiJSON(rx.APIConversations)).Methods("GET")
+	h.HandleFunc("/conversations/{id}", rx.apiJSON(rx.APIConversation)).Methods("GET")
+	h.HandleFunc("/requests", rx.apiJSON(rx.APIRequests)).Methods("GET")
+	h.HandleFunc("/requests/{id}", rx.apiJSON(rx.APIRequest)).Methods("POST", "DELETE")
+	h.HandleFunc("/blocks", rx.apiJSON(rx.APIBlocks)).Methods("GET")
+	h.HandleFunc("/blocks/{id}", rx.apiJSON(rx.APIBlock)).Methods("PUT", "DELETE")
+	h.HandleFunc("/groups", rx.apiJSON(rx.APIGroups)).Methods("GET")
+	h.HandleFunc("/groups/{id}/messages", rx.apiJSON(rx.APIGroupMessages)).Methods("GET")
+	h.HandleFunc("/search", rx.apiJSON(rx.APISearch)).Methods("GET")
+	h.HandleFunc("/keys", rx.apiJSON(rx.APIKeys)).Methods("GET", "PUT", "DELETE")
+	h.HandleFunc("/keys/{id}", rx.apiJSON(rx.APIClaimKeys)).Methods("GET")
+	h.HandleFunc("/push/key", rx.apiJSON(rx.APIPushKey)).Methods("GET")
+	h.HandleFunc("/push/subscriptions", rx.apiJSON(rx.APIPushSubscriptions)).Methods("GET", "POST")
+	h.HandleFunc("/push/subscriptions/{id}", rx.apiJSON(rx.APIPushUnsubscribe)).Methods("DELETE")
+	h.HandleFunc("/notifications", rx.apiJSON(rx.APINotifications)).Methods("GET", "PUT")
+	h.HandleFunc("/admin/unlock", rx.apiJSON(rx.APIUnlock)).Methods("POST")
+	h.HandleFunc("/admin/audit", rx.apiJSON(rx.APIAudit)).Methods("GET")
+	h.NotFoundHandler = rx.apiJSON(func(w http.ResponseWriter, r *http.Request) {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+	})
+}
+
+// APIMe returns the profile of the current user. PUT and POST requests update the
+// profile, the body can either be a json encoded Profile or a form.
+func (rx *Remix) APIMe(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if r.Method == "GET" {
+		rx.rendr.JSON(w, http.StatusOK, p)
+		return
+	}
+	var prof Profile
+	if isJSONBody(r) {
+		err = json.NewDecoder(r.Body).Decode(&prof)
+		if err != nil {
+			rx.apiErr(w, http.StatusBadRequest, errBadForm)
+			return
+		}
+	} else {
+		form := ComposeProfileForm()(r)
+		if !form.IsValid() {
+			rx.apiErr(w, http.StatusBadRequest, errBadForm)
+			return
+		}
+		prof = form.GetModel().(Profile)
+	}
+	p = makeProfUptodate(p, prof)
+	pdb := getProfileDatabase(rx.cfg.DBDir, p.ID, rx.cfg.DBExtension)
+	err = UpdateProfile(setDB(rx.db, pdb), p, rx.cfg.ProfilesBucket)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, p)
+}
+
+// APISessions lists the sessions of the current user. A DELETE request signs out all
+// the sessions except the current one.
+func (rx *Remix) APISessions(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	if r.Method == "DELETE" {
+		n, err := rx.sess.RevokeAll(ss.Values["user"].(string), ss.ID)
+		if err != nil {
+			rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+			return
+		}
+		rx.rendr.JSON(w, http.StatusOK, map[string]int{"revoked": n})
+		return
+	}
+	list, err := rx.userSessions(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, list)
+}
+
+// APIRevokeSession signs out the session with the id given in the url.
+func (rx *Remix) APIRevokeSession(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	err := rx.sess.Revoke(ss.Values["user"].(string), mux.Vars(r)["id"])
+	if err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIProfiles lists all profiles.
+func (rx *Remix) APIProfiles(w http.ResponseWriter, r *http.Request) {
+	p, err := rx.getAllProfiles()
+	if err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, p)
+}
+
+// APIProfile returns the profile with the id given in the url.
+func (rx *Remix) APIProfile(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	pdb := getProfileDatabase(rx.cfg.DBDir, id, rx.cfg.DBExtension)
+	p, err := GetProfile(setDB(rx.db, pdb), rx.cfg.ProfilesBucket, id)
+	if err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, p)
+}
+
+// APIPhoto returns the metadata of a photo. Photos are stored in the database of
+// the profile which uploaded them, the owner is taken from the profile query
+// parameter and defaults to the current user.
+//
+// The actual image is served by ServeImages.
+func (rx *Remix) APIPhoto(w http.ResponseWriter, r *http.Request) {
+	var (
+		id        = mux.Vars(r)["id"]
+		profileID = r.URL.Query().Get("profile")
+		pic       = &Photo{}
+	)
+	if profileID == "" {
+		ss, ok := rx.isInSession(r)
+		if !ok {
+			rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+			return
+		}
+		_, p, err := rx.getCurrentUserAndProfile(ss)
+		if err != nil {
+			rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+			return
+		}
+		profileID = p.ID
+	}
+	pdb := getProfileDatabase(rx.cfg.DBDir, profileID, rx.cfg.DBExtension)
+	err := getAndUnmarshall(setDB(rx.db, pdb), photoBucket, id, pic, metaBucket)
+	if err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, pic)
+}
+
+// APIUploadPhotos uploads photos for the current user. A file in the profile picture
+// field becomes the profile picture, files in the photos field are added to the
+// profile photos.
+func (rx *Remix) APIUploadPhotos(w http.ResponseWriter, r *http.Request) {
+	var (
+		rst  = &apiPhotos{}
+		errs listErr
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	user, profile, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if !rx.isVerified(user) {
+		rx.apiErr(w, http.StatusForbidden, errUnverified)
+		return
+	}
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, profile.ID, rx.cfg.DBExtension))
+
+	if f, err := GetFileUpload(r, rx.cfg.ProfilePicField); err == nil {
+		pic, err := SaveUploadFile(pdb, f, profile)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			profile.Picture = pic
+			rst.ProfilePic = pic
+		}
+	}
+	files, ferr := GetMultipleFileUpload(r, rx.cfg.PhotosField)
+	if ferr != nil && ferr != http.ErrMissingFile {
+		errs = append(errs, ferr)
+	}
+	for _, v := range files {
+		pic, err := SaveUploadFile(pdb, v, profile)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rst.Photos = append(rst.Photos, pic)
+	}
+	if rst.ProfilePic == nil && len(rst.Photos) == 0 {
+		if len(errs) > 0 {
+			rx.apiErr(w, http.StatusBadRequest, errs)
+			return
+		}
+		rx.apiErr(w, http.StatusBadRequest, http.ErrMissingFile)
+		return
+	}
+	profile.Photos = append(profile.Photos, rst.Photos...)
+	err = UpdateProfile(pdb, profile, rx.cfg.ProfilesBucket)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	for _, e := range errs {
+		rst.Errors = append(rst.Errors, e.Error())
+	}
+	rx.rendr.JSON(w, http.StatusCreated, rst)
+}
+
+// APIConversations returns the conversations of the current user, the most recently
+// active first. Message requests are listed by APIRequests instead.
+func (rx *Remix) APIConversations(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	list, err := rx.msg.folder(p.ID, false)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, list)
+}
+
+// APIConversation returns a page of the conversation between the current user and
+// the profile with the id given in the url, that is the With field of the
+// Conversation. The newest messages come first, older ones are fetched by passing
+// the next cursor of the previous page as the before query parameter. The limit
+// query parameter sets the page size.
+func (rx *Remix) APIConversation(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	h, err := rx.msg.conversation(p.ID, mux.Vars(r)["id"], q.Get("before"), limit)
+	rx.apiHistory(w, h, err)
+}
+
+// APIGroups lists the groups of the current user.
+func (rx *Remix) APIGroups(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	list, err := rx.msg.userGroups(p.ID)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, list)
+}
+
+// APIGroupMessages returns a page of the history of the group with the id given in
+// the url, paging works like APIConversation.
+func (rx *Remix) APIGroupMessages(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	h, err := rx.msg.groupHistory(p.ID, mux.Vars(r)["id"], q.Get("before"), limit)
+	rx.apiHistory(w, h, err)
+}
+
+// APISearch searches the messages of the current user. The q parameter has the words
+// to look for, and phrases in double quotes. The results can be limited to the
+// messages sent by the profile in the from parameter.
+func (rx *Remix) APISearch(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	rst, err := rx.msg.search(p.ID, &SearchQuery{Text: q.Get("q"), From: q.Get("from"), Limit: limit})
+	switch err {
+	case nil:
+		rx.rendr.JSON(w, http.StatusOK, rst)
+	case errEmptyQuery:
+		rx.apiErr(w, http.StatusBadRequest, err)
+	default:
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+	}
+}
+
+// writes a page of history, or the error which prevented getting it.
+func (rx *Remix) apiHistory(w http.ResponseWriter, h *History, err error) {
+	switch err {
+	case nil:
+		rx.rendr.JSON(w, http.StatusOK, h)
+	case errNotFound:
+		rx.apiErr(w, http.StatusNotFound, err)
+	case errNotMember:
+		rx.apiErr(w, http.StatusForbidden, err)
+	case errBadCursor:
+		rx.apiErr(w, http.StatusBadRequest, err)
+	default:
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+	}
+}
+
+// APIUnlock removes the login lockout of an account, an IP address or both. The body
+// is either json or a form with the email and ip fields. Only admins can do this.
+func (rx *Remix) APIUnlock(w http.ResponseWriter, r *http.Request) {
+	admin, ok := rx.currentAdmin(r)
+	if !ok {
+		rx.apiErr(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	var req struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+	if isJSONBody(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			rx.apiErr(w, http.StatusBadRequest, errBadForm)
+			return
+		}
+	} else {
+		req.Email = r.FormValue("email")
+		req.IP = r.FormValue("ip")
+	}
+	if req.Email == "" && req.IP == "" {
+		rx.apiErr(w, http.StatusBadRequest, errBadForm)
+		return
+	}
+	rx.unlock(admin, req.Email, req.IP)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIAudit lists the audit events, oldest first. Only admins can see them.
+func (rx *Remix) APIAudit(w http.ResponseWriter, r *http.Request) {
+	if _, ok := rx.currentAdmin(r); !ok {
+		rx.apiErr(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	evts, err := GetAuditEvents(setDB(rx.db, rx.cfg.AccountsDB), rx.auditBucket())
+	if err != nil {
+		evts = []*AuditEvent{}
+	}
+	rx.rendr.JSON(w, http.StatusOK, evts)
+}
+
+// returns the email address of the current user if the user is an admin.
+func (rx *Remix) currentAdmin(r *http.Request) (string, bool) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		return "", false
+	}
+	email, _ := ss.Values["user"].(string)
+	for _, v := range rx.cfg.Admins {
+		if email != "" && strings.EqualFold(v, email) {
+			return email, true
+		}
+	}
+	return "", false
+}
+
+// wraps h, so that only clients which accepts json are served.
+func (rx *Remix) apiJSON(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsJSON(r) {
+			rx.apiErr(w, http.StatusNotAcceptable, errNotAcceptable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writes the error envelope.
+func (rx *Remix) apiErr(w http.ResponseWriter, status int, err error) {
+	rx.rendr.JSON(w, status, &apiError{&apiErrorBody{Status: status, Message: err.Error()}})
+}
+
+// checks the Accept header of the request. A missing header means the client
+// accepts anything.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, v := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "*/*", "application/*", jsonContentType:
+			return true
+		}
+	}
+	return false
+}
+
+// checks if the request body is json.
+func isJSONBody(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == jsonContentType
+}
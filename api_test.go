@@ -0,0 +1,128 @@
+package aurora
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRemix_API(t *testing.T) {
+	var (
+		email     = "api@aurora.com"
+		pass      = "mamamia"
+		userID    = "6f2cbd2f-6c3e-4c37-5a5e-5a1a0b6f7a01"
+		loginPath = "/auth/login"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+
+	usr := &User{UUID: userID, EmailAddress: email}
+	ps, err := hashPassword(pass)
+	if err != nil {
+		t.Error(err)
+	}
+	usr.Pass = ps
+	err = CreateAccount(setDB(rx.db, rx.cfg.AccountsDB), usr, rx.cfg.AccountsBucket)
+	if err != nil {
+		t.Errorf("creating a new account %v", err)
+	}
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, usr.UUID, rx.cfg.DBExtension))
+	err = CreateProfile(pdb, &Profile{ID: usr.UUID}, rx.cfg.ProfilesBucket)
+	if err != nil {
+		t.Errorf("creating profile: %v", err)
+	}
+	meURL := fmt.Sprintf("%s%s/me", ts.URL, apiPrefix)
+
+	// case not logged in
+	res, err := httpGet(client, meURL)
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusUnauthorized, `"error"`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err = client.PostForm(fmt.Sprintf("%s%s", ts.URL, loginPath), url.Values{"email": {email}, "password": {pass}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err = httpGet(client, meURL)
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusOK, userID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err = httpGet(client, fmt.Sprintf("%s%s/profiles/%s", ts.URL, apiPrefix, userID))
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusOK, userID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err = httpGet(client, fmt.Sprintf("%s%s/profiles/bogus", ts.URL, apiPrefix))
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusNotFound, errNotFound.Error())
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err = httpGet(client, fmt.Sprintf("%s%s/photos/bogus", ts.URL, apiPrefix))
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusNotFound, `"status":404`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// case the client does not accept json
+	h := make(http.Header)
+	h.Set("Accept", "text/html")
+	res, err = httpCall(client, "GET", meURL, h, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	err = checkResponse(res, http.StatusNotAcceptable, errNotAcceptable.Error())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	sample := []struct {
+		accept string
+		ok     bool
+	}{
+		{"", true},
+		{"*/*", true},
+		{"application/json", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/*", true},
+		{"text/html", false},
+		{"image/png, text/plain", false},
+	}
+	for _, v := range sample {
+		r, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept", v.accept)
+		if acceptsJSON(r) != v.ok {
+			t.Errorf("accept %q: expected %v got %v", v.accept, v.ok, !v.ok)
+		}
+	}
+}
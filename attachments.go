@@ -0,0 +1,299 @@
+package aurora
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// the bucket in the profile database holding the files the profile attached to
+	// messages, it is laid out like the photoBucket.
+	attachmentBucket = "attachments"
+
+	// where attachments are served from.
+	attachmentsPath = "/attachments"
+
+	// defaults of the attachment limits.
+	defaultAttachmentsField  = "attachment"
+	defaultAttachmentMaxSize = 10 << 20 // 10MB
+)
+
+// the types of files which can be attached, unless configured otherwise.
+var defaultAttachmentTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "application/pdf", "text/plain", "application/zip",
+}
+
+var (
+	errAttachmentSize = errors.New("du! faili hili ni kubwa mno")
+	errAttachmentType = errors.New("du! aina hii ya faili hairuhusiwi")
+)
+
+// Attachment is a file attached to a message. It is stored in the database of the
+// profile which uploaded it.
+//
+// An attachment belongs to the conversation, or group, of the first message it is
+// sent with. Only the participants can fetch it, before it is sent only the uploader
+// can.
+type Attachment struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	UploadedBy  string    `json:"uploaded_by"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+
+	ConversationID string `json:"conversation_id,omitempty"`
+	GroupID        string `json:"group_id,omitempty"`
+
+	// URL is where the file is served.
+	URL string `json:"url"`
+}
+
+func (a *Attachment) isImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// returns the url of the attachment.
+func attachmentURL(a *Attachment) string {
+	v := url.Values{}
+	v.Set("aid", a.ID)
+	v.Set("pid", a.UploadedBy)
+	return attachmentsPath + "?" + v.Encode()
+}
+
+func (rx *Remix) attachmentMaxSize() int64 {
+	if rx.cfg.AttachmentMaxSize > 0 {
+		return int64(rx.cfg.AttachmentMaxSize)
+	}
+	return defaultAttachmentMaxSize
+}
+
+func (rx *Remix) attachmentsField() string {
+	if rx.cfg.AttachmentsField != "" {
+		return rx.cfg.AttachmentsField
+	}
+	return defaultAttachmentsField
+}
+
+// returns the media type of the file if it is one of the allowed types.
+func (rx *Remix) attachmentType(file multipart.File) (string, error) {
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	defer file.Seek(0, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	if err != nil {
+		return "", errAttachmentType
+	}
+	allowed := rx.cfg.AttachmentTypes
+	if len(allowed) == 0 {
+		allowed = defaultAttachmentTypes
+	}
+	for _, v := range allowed {
+		if v == mt {
+			return mt, nil
+		}
+	}
+	return "", errAttachmentType
+}
+
+// saves the uploaded file as an attachment of the profile. Photos are encoded again
+// like the profile photos, other files are kept as they are.
+func (rx *Remix) saveAttachment(p *Profile, file multipart.File, header *multipart.FileHeader) (*Attachment, error) {
+	max := rx.attachmentMaxSize()
+	if header.Size > max {
+		return nil, errAttachmentSize
+	}
+	mt, err := rx.attachmentType(file)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	switch mt {
+	case "image/jpeg", "image/png":
+		f, err := getUploadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if data, _, err = encodePhoto(f); err != nil {
+			return nil, err
+		}
+	default:
+		if data, err = ioutil.ReadAll(io.LimitReader(file, max+1)); err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(data)) > max {
+		return nil, errAttachmentSize
+	}
+	a := &Attachment{
+		ID:          getUUID(),
+		Name:        filepath.Base(header.Filename),
+		ContentType: mt,
+		Size:        len(data),
+		UploadedBy:  p.ID,
+		UploadedAt:  time.Now(),
+	}
+	a.URL = attachmentURL(a)
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, p.ID, rx.cfg.DBExtension))
+	if err = saveUpload(pdb, attachmentBucket, a.ID, a, data); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// returns the attachment which profileID uploaded.
+func (rx *Remix) getAttachment(profileID, id string) (*Attachment, error) {
+	a := &Attachment{}
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, profileID, rx.cfg.DBExtension))
+	if err := getAndUnmarshall(pdb, attachmentBucket, id, a, metaBucket); err != nil {
+		return nil, errNotFound
+	}
+	return a, nil
+}
+
+// checks if profileID is allowed to fetch the attachment.
+func (rx *Remix) canSeeAttachment(profileID string, a *Attachment) bool {
+	switch {
+	case a.UploadedBy == profileID:
+		return true
+	case a.GroupID != "":
+		g, err := rx.msg.getGroup(a.GroupID)
+		return err == nil && g.isMember(profileID)
+	case a.ConversationID != "":
+		for _, v := range strings.Split(a.ConversationID, ":") {
+			if v == profileID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replaces the attachments of the message by the ones the sender uploaded, and binds
+// them to the conversation of the message. Attachments which were sent to another
+// conversation can't be sent again.
+func (m *Messenger) attach(senderID string, msg *MSG) error {
+	for _, v := range msg.Attachments {
+		if v == nil {
+			return errBadForm
+		}
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, senderID, m.rx.cfg.DBExtension))
+	for i, v := range msg.Attachments {
+		a, err := m.rx.getAttachment(senderID, v.ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case a.ConversationID == "" && a.GroupID == "":
+			a.ConversationID = msg.ConversationID
+			a.GroupID = msg.GroupID
+			if err = marshalAndCreate(pdb, a, attachmentBucket, a.ID, metaBucket); err != nil {
+				return err
+			}
+		case a.ConversationID != msg.ConversationID || a.GroupID != msg.GroupID:
+			return errForbidden
+		}
+		msg.Attachments[i] = a
+	}
+	return nil
+}
+
+// removes the attachments of the message, which was deleted for everyone.
+func (m *Messenger) detach(msg *MSG) {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, msg.SenderID, m.rx.cfg.DBExtension))
+	for _, a := range msg.Attachments {
+		pdb.Delete(attachmentBucket, a.ID, metaBucket)
+		pdb.Delete(attachmentBucket, a.ID, dataBucket)
+	}
+}
+
+// ServeAttachment serves a file attached to a message, to the participants of the
+// conversation only.
+func (rx *Remix) ServeAttachment(w http.ResponseWriter, r *http.Request) {
+	var (
+		vars      = r.URL.Query()
+		id        = vars.Get("aid")
+		profileID = vars.Get("pid")
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	a, err := rx.getAttachment(profileID, id)
+	if err != nil || !rx.canSeeAttachment(p.ID, a) {
+		// strangers are not told whether the attachment exists.
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !a.isImage() {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.Name))
+	}
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, profileID, rx.cfg.DBExtension))
+	serveUpload(w, r, pdb, attachmentBucket, a.ID, a.Name, a.UploadedAt)
+}
+
+// APIUploadAttachment uploads a file to be attached to a message, the file is in the
+// attachments field. The returned attachment is sent in the attachments of the
+// message.
+func (rx *Remix) APIUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	user, profile, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if !rx.isVerified(user) {
+		rx.apiErr(w, http.StatusForbidden, errUnverified)
+		return
+	}
+
+	// leave some room for the rest of the multipart form.
+	limit := rx.attachmentMaxSize() + 1<<20
+	if r.ContentLength > limit {
+		rx.apiErr(w, http.StatusRequestEntityTooLarge, errAttachmentSize)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	file, header, err := r.FormFile(rx.attachmentsField())
+	if err != nil {
+		rx.apiErr(w, http.StatusBadRequest, http.ErrMissingFile)
+		return
+	}
+	defer file.Close()
+	a, err := rx.saveAttachment(profile, file, header)
+	switch err {
+	case nil:
+		rx.rendr.JSON(w, http.StatusOK, a)
+	case errAttachmentSize:
+		rx.apiErr(w, http.StatusRequestEntityTooLarge, err)
+	case errAttachmentType:
+		rx.apiErr(w, http.StatusUnsupportedMediaType, err)
+	default:
+		rx.apiErr(w, http.StatusBadRequest, err)
+	}
+}
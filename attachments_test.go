@@ -0,0 +1,115 @@
+package aurora
+
+import (
+	"bytes"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+)
+
+// returns the file header of a multipart form with a single file.
+func testFileHeader(t *testing.T, name string, data []byte) *multipart.FileHeader {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	f, err := w.CreateFormFile(defaultAttachmentsField, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data)
+	w.Close()
+	form, err := multipart.NewReader(buf, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.File[defaultAttachmentsField][0]
+}
+
+func testSaveAttachment(rx *Remix, p *Profile, h *multipart.FileHeader) (*Attachment, error) {
+	f, err := h.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return rx.saveAttachment(p, f, h)
+}
+
+func TestSaveAttachment(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	rx := m.rx
+	p := &Profile{ID: "alice"}
+
+	a, err := testSaveAttachment(rx, p, testFileHeader(t, "../notes.txt", []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "notes.txt" || a.ContentType != "text/plain" || a.Size != 5 || a.UploadedBy != p.ID {
+		t.Errorf("expected the metadata of notes.txt got %v", a)
+	}
+	if !strings.Contains(a.URL, "aid="+a.ID) {
+		t.Errorf("expected the url of the attachment got %s", a.URL)
+	}
+	if _, err = rx.getAttachment(p.ID, a.ID); err != nil {
+		t.Error(err)
+	}
+
+	_, err = testSaveAttachment(rx, p, testFileHeader(t, "page.html", []byte("<html><body></body></html>")))
+	if err != errAttachmentType {
+		t.Errorf("expected %v got %v", errAttachmentType, err)
+	}
+	rx.cfg.AttachmentMaxSize = 3
+	_, err = testSaveAttachment(rx, p, testFileHeader(t, "notes.txt", []byte("hello")))
+	if err != errAttachmentSize {
+		t.Errorf("expected %v got %v", errAttachmentSize, err)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		alice = "alice"
+		bob   = "bob"
+		carol = "carol"
+	)
+	a, err := testSaveAttachment(m.rx, &Profile{ID: alice}, testFileHeader(t, "notes.txt", []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.rx.canSeeAttachment(bob, a) {
+		t.Errorf("expected only %s to see the attachment before it is sent", alice)
+	}
+	msg := &MSG{SenderID: alice, RecipientID: bob, ConversationID: conversationID(alice, bob),
+		Attachments: []*Attachment{{ID: a.ID, Name: "spoofed"}}}
+	if err = m.attach(alice, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Attachments[0].Name != "notes.txt" {
+		t.Errorf("expected the stored attachment got %v", msg.Attachments[0])
+	}
+	if a, err = m.rx.getAttachment(alice, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !m.rx.canSeeAttachment(bob, a) || m.rx.canSeeAttachment(carol, a) {
+		t.Errorf("expected only %s and %s to see the attachment", alice, bob)
+	}
+
+	// the attachment stays in its conversation
+	other := &MSG{SenderID: alice, RecipientID: carol, ConversationID: conversationID(alice, carol),
+		Attachments: []*Attachment{{ID: a.ID}}}
+	if err = m.attach(alice, other); err != errForbidden {
+		t.Errorf("expected %v got %v", errForbidden, err)
+	}
+	if err = m.attach(bob, &MSG{Attachments: []*Attachment{{ID: a.ID}}}); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	if err = m.attach(alice, &MSG{Attachments: []*Attachment{nil}}); err != errBadForm {
+		t.Errorf("expected %v got %v", errBadForm, err)
+	}
+
+	m.detach(msg)
+	if _, err = m.rx.getAttachment(alice, a.ID); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+}
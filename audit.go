@@ -0,0 +1,79 @@
+package aurora
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gernest/nutz"
+)
+
+const (
+	// kinds of audit events
+	auditLockout = "lockout"
+	auditUnlock  = "unlock"
+)
+
+// AuditEvent records something security related which happened, like an account
+// being locked.
+type AuditEvent struct {
+	Kind string `json:"kind"`
+
+	// Subject is what the event is about, e.g the email address of the locked
+	// account.
+	Subject string `json:"subject"`
+
+	// Actor is who caused the event, if anyone.
+	Actor  string    `json:"actor,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// records the event in the accounts database, and logs it.
+func (rx *Remix) audit(evt *AuditEvent) {
+	if evt.At.IsZero() {
+		evt.At = time.Now()
+	}
+	log.Printf("aurora: audit %s subject=%q actor=%q ip=%q %s", evt.Kind, evt.Subject, evt.Actor, evt.IP, evt.Detail)
+	err := SaveAuditEvent(setDB(rx.db, rx.cfg.AccountsDB), rx.auditBucket(), evt)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (rx *Remix) auditBucket() string {
+	if rx.cfg.AuditBucket == "" {
+		return "audit"
+	}
+	return rx.cfg.AuditBucket
+}
+
+// SaveAuditEvent stores the event, keys are ordered by the time of the event.
+func SaveAuditEvent(db nutz.Storage, bucket string, evt *AuditEvent) error {
+	key := fmt.Sprintf("%020d-%s", evt.At.UnixNano(), getUUID())
+	return marshalAndCreate(db, evt, bucket, key)
+}
+
+// GetAuditEvents returns all the audit events, oldest first.
+func GetAuditEvents(db nutz.Storage, bucket string) ([]*AuditEvent, error) {
+	all := db.GetAll(bucket)
+	if all.Error != nil {
+		return nil, all.Error
+	}
+	var keys []string
+	for k := range all.DataList {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rst []*AuditEvent
+	for _, k := range keys {
+		evt := &AuditEvent{}
+		if err := json.Unmarshal(all.DataList[k], evt); err == nil {
+			rst = append(rst, evt)
+		}
+	}
+	return rst, nil
+}
@@ -2,10 +2,14 @@ package aurora
 
 import (
 	"encoding/json"
+	"errors"
 
+	"github.com/boltdb/bolt"
 	"github.com/gernest/nutz"
 )
 
+var errEmailTaken = errors.New("du! email hii imeshasajiliwa")
+
 // CreateAccount creates a new account, where id will be the value returned by
 // invoking Email() method.
 func CreateAccount(db nutz.Storage, a Account, bucket string) error {
@@ -22,6 +26,35 @@ func GetUser(db nutz.Storage, bucket, email string, nest ...string) (*User, erro
 	return usr, nil
 }
 
+// UpdateUser updates the account of the given user.
+func UpdateUser(db nutz.Storage, u *User, bucket string) error {
+	return marshalAndUpdate(db, u, bucket, u.EmailAddress)
+}
+
+// RenameUser moves the account of the user from the old email address to the one in
+// u.EmailAddress. The old record is deleted and the new one is created in a single
+// transaction, so there is never a moment where the account is missing or is there
+// twice.
+func RenameUser(db nutz.Storage, u *User, bucket, old string) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return withTx(db, true, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil || b.Get([]byte(old)) == nil {
+			return errors.New("aurora: no account for " + old)
+		}
+		if b.Get([]byte(u.EmailAddress)) != nil {
+			return errEmailTaken
+		}
+		if err := b.Put([]byte(u.EmailAddress), data); err != nil {
+			return err
+		}
+		return b.Delete([]byte(old))
+	})
+}
+
 // GetAllUsers returns a slice of all users.
 func GetAllUsers(db nutz.Storage, bucket string, nest ...string) ([]string, error) {
 	var usrs []string
@@ -90,3 +90,45 @@ func TestGetAll(t *testing.T) {
 		t.Errorf("expected nil got %v", zz)
 	}
 }
+
+func TestRenameUser(t *testing.T) {
+	bucket := "rename"
+	for _, v := range []string{"old@aurora.com", "taken@aurora.com"} {
+		usr := &User{EmailAddress: v, UUID: getUUID()}
+		if err := CreateAccount(db, usr, bucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usr, err := GetUser(db, bucket, "old@aurora.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr.EmailAddress = "taken@aurora.com"
+	if err = RenameUser(db, usr, bucket, "old@aurora.com"); err != errEmailTaken {
+		t.Errorf("expected %v got %v", errEmailTaken, err)
+	}
+	usr.EmailAddress = "new@aurora.com"
+	if err = RenameUser(db, usr, bucket, "old@aurora.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetUser(db, bucket, "old@aurora.com"); err == nil {
+		t.Error("expected an error")
+	}
+	n, err := GetUser(db, bucket, "new@aurora.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.UUID != usr.UUID {
+		t.Errorf("expected %s got %s", usr.UUID, n.UUID)
+	}
+	all, err := GetAllUsers(db, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("expected 2 users got %d", len(all))
+	}
+	if err = RenameUser(db, usr, bucket, "old@aurora.com"); err == nil {
+		t.Error("expected an error")
+	}
+}
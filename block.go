@@ -0,0 +1,230 @@
+package aurora
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gernest/golem"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// the bucket in the profile database with the profiles the profile blocked, keyed
+	// by their ids.
+	blockedBucket = "blocked"
+
+	// the number of messages a user, and a connection, can send in a minute and at
+	// once, unless configured otherwise.
+	defaultMessageRateLimit     = 60
+	defaultConnMessageRateLimit = 30
+	defaultMessageBurst         = 10
+)
+
+var errRateLimited = errors.New("du! umetuma jumbe nyingi mno, subiri kidogo")
+
+// Block is an entry in the block list of a profile. Messages from blocked profiles
+// are dropped without telling the sender, and they don't see the presence of the
+// profile.
+type Block struct {
+	ID        string    `json:"id"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+// adds otherID to the block list of profileID.
+func (m *Messenger) block(profileID, otherID string) (*Block, error) {
+	if otherID == profileID || !m.rx.profileExists(otherID) {
+		return nil, errNotFound
+	}
+	b := &Block{ID: otherID, BlockedAt: time.Now()}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if err := marshalAndCreate(pdb, b, blockedBucket, otherID); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// removes otherID from the block list of profileID.
+func (m *Messenger) unblock(profileID, otherID string) error {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if pdb.Get(blockedBucket, otherID).Error != nil {
+		return errNotFound
+	}
+	return pdb.Delete(blockedBucket, otherID).Error
+}
+
+// checks if profileID blocked otherID.
+func (m *Messenger) isBlocked(profileID, otherID string) bool {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	return pdb.Get(blockedBucket, otherID).Error == nil
+}
+
+// drops the messages sent by the profiles which profileID has blocked.
+func (m *Messenger) withoutBlocked(profileID string, msgs []*MSG) []*MSG {
+	list := m.blocked(profileID)
+	if len(list) == 0 {
+		return msgs
+	}
+	blocked := make(map[string]bool)
+	for _, b := range list {
+		blocked[b.ID] = true
+	}
+	var rst []*MSG
+	for _, v := range msgs {
+		if !blocked[v.SenderID] {
+			rst = append(rst, v)
+		}
+	}
+	return rst
+}
+
+// returns the block list of the profile, the most recent first.
+func (m *Messenger) blocked(profileID string) []*Block {
+	rst := []*Block{}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	for _, v := range pdb.GetAll(blockedBucket).DataList {
+		b := &Block{}
+		if err := json.Unmarshal(v, b); err == nil {
+			rst = append(rst, b)
+		}
+	}
+	sort.Sort(byBlockedAt(rst))
+	return rst
+}
+
+type byBlockedAt []*Block
+
+func (s byBlockedAt) Len() int           { return len(s) }
+func (s byBlockedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byBlockedAt) Less(i, j int) bool { return s[i].BlockedAt.After(s[j].BlockedAt) }
+
+// checks the message rate limits of the connection and of its user, both allow a
+// burst of messages before they kick in.
+func (m *Messenger) allowSend(conn *golem.Connection) bool {
+	var (
+		cfg       = m.rx.cfg
+		now       = time.Now()
+		userLimit = cfg.MessageRateLimit
+		connLimit = cfg.ConnMessageRateLimit
+		burst     = cfg.MessageBurst
+	)
+	if userLimit <= 0 {
+		userLimit = defaultMessageRateLimit
+	}
+	if connLimit <= 0 {
+		connLimit = defaultConnMessageRateLimit
+	}
+	if burst <= 0 {
+		burst = defaultMessageBurst
+	}
+	return m.connMsgLimit.allow(connKey(conn), connLimit, burst, time.Minute, now) &&
+		m.msgLimit.allow(conn.UserID, userLimit, burst, time.Minute, now)
+}
+
+// returns the key of the connection in the rate limits.
+func connKey(conn *golem.Connection) string {
+	return fmt.Sprintf("%s:%p", conn.UserID, conn)
+}
+
+// APIBlocks lists the profiles the current user blocked.
+func (rx *Remix) APIBlocks(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, rx.msg.blocked(p.ID))
+}
+
+// APIBlock blocks the profile with the id given in the url with a PUT request, and
+// unblocks it with a DELETE request.
+func (rx *Remix) APIBlock(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if r.Method == "DELETE" {
+		if err = rx.msg.unblock(p.ID, id); err != nil {
+			rx.apiErr(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b, err := rx.msg.block(p.ID, id)
+	switch err {
+	case nil:
+		rx.rendr.JSON(w, http.StatusOK, b)
+	case errNotFound:
+		rx.apiErr(w, http.StatusNotFound, err)
+	default:
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+	}
+}
+
+// APIRequests lists the message requests of the current user, the conversations
+// started by profiles who are not contacts of the user.
+func (rx *Remix) APIRequests(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	list, err := rx.msg.folder(p.ID, true)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, list)
+}
+
+// APIRequest accepts the message request from the profile with the id given in the
+// url with a POST request, which moves the conversation to the others. A DELETE
+// request declines it.
+func (rx *Remix) APIRequest(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if r.Method == "DELETE" {
+		if err = rx.msg.declineRequest(p.ID, id); err != nil {
+			rx.apiErr(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	c, err := rx.msg.acceptRequest(p.ID, id)
+	if err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, c)
+}
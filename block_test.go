@@ -0,0 +1,170 @@
+package aurora
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBlock(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		me    = "me"
+		alice = "alice"
+		bob   = "bob"
+	)
+	for _, id := range []string{me, alice, bob} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.createGroup(me, "marafiki", []string{alice, bob}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.block(me, me); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	if _, err := m.block(me, "nobody"); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	if _, err := m.block(me, alice); err != nil {
+		t.Fatal(err)
+	}
+	if !m.isBlocked(me, alice) || m.isBlocked(alice, me) {
+		t.Error("expected only alice to be blocked by me")
+	}
+	if list := m.blocked(me); len(list) != 1 || list[0].ID != alice {
+		t.Errorf("expected %s to be blocked got %v", alice, list)
+	}
+
+	// blocked profiles don't get the presence, nor the typing events
+	if c := m.contacts(me); !reflect.DeepEqual(c, []string{bob}) {
+		t.Errorf("expected %v got %v", []string{bob}, c)
+	}
+	m.online.Add(me, 0, me)
+	defer m.online.Delete(me)
+	if to := m.typingTo(alice, &Typing{To: me}); len(to) != 0 {
+		t.Errorf("expected nobody got %v", to)
+	}
+
+	// the messages alice sends after being blocked stay in her outbox, they don't
+	// show up in my history
+	msg := &MSG{ID: "1", SenderID: alice, RecipientID: me, Text: "habari", SentAt: time.Now()}
+	if err := m.saveMsg(outboxBucket, alice, msg); err != nil {
+		t.Fatal(err)
+	}
+	h, err := m.conversation(me, alice, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 0 {
+		t.Errorf("expected no messages got %v", h.Messages)
+	}
+	if h, err = m.conversation(alice, me, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 1 {
+		t.Errorf("expected alice to see her message got %v", h.Messages)
+	}
+
+	if err := m.unblock(me, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.unblock(me, alice); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	if to := m.typingTo(alice, &Typing{To: me}); !reflect.DeepEqual(to, []string{me}) {
+		t.Errorf("expected %v got %v", []string{me}, to)
+	}
+}
+
+func TestMessageRequests(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		me    = "me"
+		alice = "alice"
+		bob   = "bob"
+		carol = "carol"
+		now   = time.Now()
+	)
+	for _, id := range []string{me, alice, bob, carol} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.createGroup(me, "marafiki", []string{carol}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []*MSG{
+		{ID: "1", SenderID: alice, RecipientID: me, SentAt: now},
+		{ID: "2", SenderID: bob, RecipientID: me, SentAt: now.Add(time.Second)},
+		{ID: "3", SenderID: carol, RecipientID: me, SentAt: now.Add(2 * time.Second)},
+	}
+	for _, v := range msgs {
+		if err := m.indexMessage(me, v, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folder := func(requests bool, want ...string) {
+		list, err := m.folder(me, requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range list {
+			got = append(got, c.With)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v got %v", want, got)
+		}
+	}
+
+	// every first contact is a request, even from group members since anyone can
+	// add me to a group
+	folder(true, carol, bob, alice)
+	folder(false)
+	if c := m.contacts(me); !reflect.DeepEqual(c, []string{carol}) {
+		t.Errorf("expected %v got %v", []string{carol}, c)
+	}
+
+	// replying accepts the request, and so does accepting it
+	if err := m.indexMessage(me, &MSG{ID: "4", SenderID: me, RecipientID: alice, SentAt: now.Add(3 * time.Second)}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.acceptRequest(me, alice); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	if _, err := m.acceptRequest(me, bob); err != nil {
+		t.Fatal(err)
+	}
+	folder(true, carol)
+	folder(false, alice, bob)
+	if _, err := m.acceptRequest(me, carol); err != nil {
+		t.Fatal(err)
+	}
+	folder(true)
+	folder(false, alice, carol, bob)
+
+	// a declined request is gone, until the stranger writes again
+	d := "dave"
+	if err := m.indexMessage(me, &MSG{ID: "5", SenderID: d, RecipientID: me, SentAt: now}, true); err != nil {
+		t.Fatal(err)
+	}
+	folder(true, d)
+	if err := m.declineRequest(me, d); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.declineRequest(me, alice); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	folder(true)
+	if err := m.indexMessage(me, &MSG{ID: "6", SenderID: d, RecipientID: me, SentAt: now}, true); err != nil {
+		t.Fatal(err)
+	}
+	folder(true, d)
+}
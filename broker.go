@@ -0,0 +1,148 @@
+package aurora
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// the environment variable holding the broker secret, it takes precedence over
+// BrokerSecret.
+const brokerSecretEnv = "AURORA_BROKER_SECRET"
+
+// Broker carries the events of the messenger between the nodes running it, so that
+// users connected to different nodes can talk to each other. Nodes are expected to
+// share the database directory.
+type Broker interface {
+	// Publish sends the event to the room on every node, this one included.
+	Publish(room, evt string, data []byte) error
+
+	// Subscribe registers fn to be called with every event published by any node.
+	Subscribe(fn func(room, evt string, data []byte))
+
+	// SetOnline records whether the user is connected to this node.
+	SetOnline(id string, online bool) error
+
+	// Online reports whether the user is connected to any node.
+	Online(id string) bool
+
+	Close() error
+}
+
+// LocalBroker is a Broker for a single node, events never leave the process.
+type LocalBroker struct {
+	mu     sync.RWMutex
+	subs   []func(room, evt string, data []byte)
+	online map[string]bool
+}
+
+// NewLocalBroker returns a broker which keeps everything in memory.
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{online: make(map[string]bool)}
+}
+
+// Publish calls the subscribers right away.
+func (b *LocalBroker) Publish(room, evt string, data []byte) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, fn := range subs {
+		fn(room, evt, data)
+	}
+	return nil
+}
+
+// Subscribe registers fn.
+func (b *LocalBroker) Subscribe(fn func(room, evt string, data []byte)) {
+	b.mu.Lock()
+	b.subs = append(b.subs, fn)
+	b.mu.Unlock()
+}
+
+// SetOnline records the presence of the user.
+func (b *LocalBroker) SetOnline(id string, online bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if online {
+		b.online[id] = true
+		return nil
+	}
+	delete(b.online, id)
+	return nil
+}
+
+// Online reports whether the user is connected.
+func (b *LocalBroker) Online(id string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.online[id]
+}
+
+// Close does nothing, it is here to satisfy the Broker interface.
+func (b *LocalBroker) Close() error {
+	return nil
+}
+
+// returns the broker the messenger should use. When the broker server can't be
+// reached the messenger runs on its own, so that a single node still works.
+func newBroker(cfg *RemixConfig) Broker {
+	if cfg.BrokerAddr == "" {
+		return NewLocalBroker()
+	}
+	b, err := DialBroker(cfg.BrokerAddr, brokerSecret(cfg))
+	if err != nil {
+		log.Println(err)
+		log.Println("aurora: using the in process broker")
+		return NewLocalBroker()
+	}
+	return b
+}
+
+// returns the secret shared by the broker server and the nodes.
+func brokerSecret(cfg *RemixConfig) string {
+	if env := os.Getenv(brokerSecretEnv); env != "" {
+		return env
+	}
+	return cfg.BrokerSecret
+}
+
+// sets the broker of the messenger, events published by any node are emitted to the
+// rooms of this node.
+func (m *Messenger) useBroker(b Broker) {
+	m.broker = b
+	b.Subscribe(m.relay)
+}
+
+// emits the event to the room on every node. When the other nodes can't be reached
+// the event still goes to the room on this node.
+func (m *Messenger) emit(room, evt string, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err = m.broker.Publish(room, evt, b); err != nil {
+		if err != errBrokerDown {
+			log.Println(err)
+		}
+		m.relay(room, evt, b)
+	}
+}
+
+// emits an event which came through the broker to the room on this node. The events
+// handled by callMeBack need the data to be a *MSG, the rest are passed along as they
+// are.
+func (m *Messenger) relay(room, evt string, data []byte) {
+	var v interface{} = json.RawMessage(data)
+	switch evt {
+	case sendEvt, receiveEvt, sendFailedEvt, readEvt, statusEvt:
+		msg := &MSG{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			log.Println(err)
+			return
+		}
+		v = msg
+	}
+	m.rm.Emit(room, evt, v)
+}
@@ -0,0 +1,458 @@
+package aurora
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// The nodes talk to the broker server over TCP, every frame is a json object on its
+// own line. A node starts with a hello frame carrying the shared secret, after it
+// there are two kinds of frames, pub carries an event and presence tells that a user
+// connected to, or left, a node. The server sends every frame it gets to all the
+// nodes, including the one which sent it.
+const (
+	frameHello    = "hello"
+	framePub      = "pub"
+	framePresence = "presence"
+
+	// how long the server waits for a node to take a frame, slow nodes are dropped
+	// so they don't hold up the rest.
+	brokerWriteTimeout = 5 * time.Second
+
+	// how long a node waits before connecting again after losing the server, it
+	// doubles with every failed attempt up to brokerMaxRetry.
+	brokerRetry    = time.Second
+	brokerMaxRetry = 30 * time.Second
+)
+
+var (
+	errBrokerClosed = errors.New("aurora: the broker connection is closed")
+	errBrokerDown   = errors.New("aurora: not connected to the broker")
+)
+
+type brokerFrame struct {
+	Op     string          `json:"op"`
+	Node   string          `json:"node,omitempty"`
+	Secret string          `json:"secret,omitempty"`
+	Room   string          `json:"room,omitempty"`
+	Event  string          `json:"event,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Online bool            `json:"online,omitempty"`
+}
+
+// BrokerServer relays frames between the nodes. It remembers which users are online
+// on which node, so that nodes which connect later know about them, and so that the
+// users of a node which goes away are taken offline.
+//
+// Anything a node sends ends up with the users, so nodes have to know the secret the
+// server was created with. A server without a secret trusts every node, it should
+// only listen on localhost.
+type BrokerServer struct {
+	mu     sync.Mutex
+	ln     net.Listener
+	secret string
+	nodes  map[*brokerNode]bool
+	closed bool
+}
+
+type brokerNode struct {
+	conn   net.Conn
+	wmu    sync.Mutex
+	enc    *json.Encoder
+	id     string
+	online map[string]bool
+}
+
+func (n *brokerNode) send(f *brokerFrame) error {
+	n.wmu.Lock()
+	defer n.wmu.Unlock()
+	return n.write(f)
+}
+
+// writes the frame, wmu should be held.
+func (n *brokerNode) write(f *brokerFrame) error {
+	n.conn.SetWriteDeadline(time.Now().Add(brokerWriteTimeout))
+	return n.enc.Encode(f)
+}
+
+// NewBrokerServer returns a broker server which is not listening yet, nodes need to
+// know the secret to connect.
+func NewBrokerServer(secret string) *BrokerServer {
+	return &BrokerServer{secret: secret, nodes: make(map[*brokerNode]bool)}
+}
+
+// ListenAndServe listens on the TCP address addr and serves the nodes.
+func (s *BrokerServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts nodes on ln until the server is closed.
+func (s *BrokerServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveNode(conn)
+	}
+}
+
+// Close stops accepting nodes and disconnects the connected ones.
+func (s *BrokerServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for n := range s.nodes {
+		n.conn.Close()
+	}
+	if s.ln != nil {
+		return s.ln.Close()
+	}
+	return nil
+}
+
+// checks the hello frame of a node.
+func (s *BrokerServer) allow(f *brokerFrame) bool {
+	if f.Op != frameHello || f.Node == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(f.Secret), []byte(s.secret)) == 1
+}
+
+func (s *BrokerServer) serveNode(conn net.Conn) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	hello := &brokerFrame{}
+	conn.SetReadDeadline(time.Now().Add(brokerWriteTimeout))
+	if err := dec.Decode(hello); err != nil || !s.allow(hello) {
+		log.Printf("aurora: refused the broker node at %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	n := &brokerNode{conn: conn, enc: json.NewEncoder(conn), id: hello.Node, online: make(map[string]bool)}
+
+	// the node is told who is online before any other frame, so a broadcast which
+	// comes in the meantime waits for wmu. Only the node waits if it is slow.
+	var presence []*brokerFrame
+	s.mu.Lock()
+	for other := range s.nodes {
+		for id := range other.online {
+			presence = append(presence, &brokerFrame{Op: framePresence, Node: other.id, ID: id, Online: true})
+		}
+	}
+	s.nodes[n] = true
+	n.wmu.Lock()
+	s.mu.Unlock()
+	for _, f := range presence {
+		if err := n.write(f); err != nil {
+			// the read loop cleans up.
+			break
+		}
+	}
+	n.wmu.Unlock()
+
+	for {
+		f := &brokerFrame{}
+		if err := dec.Decode(f); err != nil {
+			break
+		}
+		switch f.Op {
+		case framePresence:
+			// a node only speaks for its own users.
+			f.Node = n.id
+			s.mu.Lock()
+			if f.Online {
+				n.online[f.ID] = true
+			} else {
+				delete(n.online, f.ID)
+			}
+			s.mu.Unlock()
+			s.broadcast(f)
+		case framePub:
+			s.broadcast(f)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.nodes, n)
+	s.mu.Unlock()
+	conn.Close()
+	for id := range n.online {
+		s.broadcast(&brokerFrame{Op: framePresence, Node: n.id, ID: id})
+	}
+}
+
+func (s *BrokerServer) broadcast(f *brokerFrame) {
+	s.mu.Lock()
+	nodes := make([]*brokerNode, 0, len(s.nodes))
+	for n := range s.nodes {
+		nodes = append(nodes, n)
+	}
+	s.mu.Unlock()
+	for _, n := range nodes {
+		if err := n.send(f); err != nil {
+			// the read loop of the node cleans up.
+			n.conn.Close()
+		}
+	}
+}
+
+// TCPBroker is a Broker which connects the node to a BrokerServer. When the
+// connection is lost it keeps connecting again, meanwhile publishing fails with
+// errBrokerDown and only the users of this node are known to be online.
+type TCPBroker struct {
+	addr   string
+	secret string
+	node   string
+
+	// conn and enc are nil while the broker is not connected.
+	wmu  sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu   sync.RWMutex
+	subs []func(room, evt string, data []byte)
+
+	// online maps every user who is online to the nodes the user is connected to.
+	online map[string]map[string]bool
+}
+
+// DialBroker connects to the broker server at the TCP address addr, with the secret
+// the server was created with.
+func DialBroker(addr, secret string) (*TCPBroker, error) {
+	b := &TCPBroker{
+		addr:   addr,
+		secret: secret,
+		node:   getUUID(),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+		online: make(map[string]map[string]bool),
+	}
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	go b.run(conn)
+	return b, nil
+}
+
+// connects to the server, and tells it again about the users of this node.
+func (b *TCPBroker) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, brokerWriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(conn)
+	conn.SetWriteDeadline(time.Now().Add(brokerWriteTimeout))
+	if err = enc.Encode(&brokerFrame{Op: frameHello, Node: b.node, Secret: b.secret}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	select {
+	case <-b.closed:
+		conn.Close()
+		return nil, errBrokerClosed
+	default:
+	}
+	b.mu.RLock()
+	for id, nodes := range b.online {
+		if nodes[b.node] {
+			enc.Encode(&brokerFrame{Op: framePresence, Node: b.node, ID: id, Online: true})
+		}
+	}
+	b.mu.RUnlock()
+	b.conn, b.enc = conn, enc
+	return conn, nil
+}
+
+// reads from the server, and connects again when the connection is lost until the
+// broker is closed.
+func (b *TCPBroker) run(conn net.Conn) {
+	defer close(b.done)
+	attempts := 0
+	for {
+		if conn != nil {
+			connectedAt := time.Now()
+			b.read(conn)
+			b.disconnected()
+			if time.Since(connectedAt) > brokerMaxRetry {
+				attempts = 0
+			}
+		}
+		attempts++
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(deliveryBackoff(attempts, brokerRetry, brokerMaxRetry)):
+		}
+		var err error
+		if conn, err = b.connect(); err != nil {
+			if err == errBrokerClosed {
+				return
+			}
+			log.Println("aurora: connecting to the broker", err)
+		}
+	}
+}
+
+func (b *TCPBroker) send(f *brokerFrame) error {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	select {
+	case <-b.closed:
+		return errBrokerClosed
+	default:
+	}
+	if b.enc == nil {
+		return errBrokerDown
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(brokerWriteTimeout))
+	if err := b.enc.Encode(f); err != nil {
+		// the read loop notices, and connects again.
+		b.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (b *TCPBroker) read(conn net.Conn) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		f := &brokerFrame{}
+		if err := dec.Decode(f); err != nil {
+			select {
+			case <-b.closed:
+			default:
+				log.Println("aurora: lost the broker connection", err)
+			}
+			return
+		}
+		switch f.Op {
+		case framePub:
+			b.mu.RLock()
+			subs := b.subs
+			b.mu.RUnlock()
+			for _, fn := range subs {
+				fn(f.Room, f.Event, f.Data)
+			}
+		case framePresence:
+			// the presence of this node is recorded when it is set.
+			if f.Node != b.node {
+				b.setOnline(f.ID, f.Node, f.Online)
+			}
+		}
+	}
+}
+
+// forgets the connection, and the users of the other nodes. The server tells about
+// them again after connecting.
+func (b *TCPBroker) disconnected() {
+	b.wmu.Lock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.conn, b.enc = nil, nil
+	b.wmu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, nodes := range b.online {
+		for node := range nodes {
+			if node != b.node {
+				delete(nodes, node)
+			}
+		}
+		if len(nodes) == 0 {
+			delete(b.online, id)
+		}
+	}
+}
+
+func (b *TCPBroker) setOnline(id, node string, online bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nodes, ok := b.online[id]
+	if !online {
+		delete(nodes, node)
+		if len(nodes) == 0 {
+			delete(b.online, id)
+		}
+		return
+	}
+	if !ok {
+		nodes = make(map[string]bool)
+		b.online[id] = nodes
+	}
+	nodes[node] = true
+}
+
+// Publish sends the event to the server.
+func (b *TCPBroker) Publish(room, evt string, data []byte) error {
+	return b.send(&brokerFrame{Op: framePub, Room: room, Event: evt, Data: data})
+}
+
+// Subscribe registers fn.
+func (b *TCPBroker) Subscribe(fn func(room, evt string, data []byte)) {
+	b.mu.Lock()
+	b.subs = append(b.subs, fn)
+	b.mu.Unlock()
+}
+
+// SetOnline records the presence of the user on this node, and tells the other nodes
+// about it. While the broker is not connected the other nodes are told after
+// connecting again.
+func (b *TCPBroker) SetOnline(id string, online bool) error {
+	b.setOnline(id, b.node, online)
+	err := b.send(&brokerFrame{Op: framePresence, Node: b.node, ID: id, Online: online})
+	if err == errBrokerDown {
+		return nil
+	}
+	return err
+}
+
+// Online reports whether the user is connected to any node.
+func (b *TCPBroker) Online(id string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.online[id]) > 0
+}
+
+// Close disconnects from the server.
+func (b *TCPBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.wmu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.wmu.Unlock()
+	})
+	<-b.done
+	return nil
+}
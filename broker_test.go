@@ -0,0 +1,294 @@
+package aurora
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+type brokerEvent struct {
+	room, evt, data string
+}
+
+// subscribes to b, the events are sent to the returned channel.
+func testSubscribe(b Broker) chan brokerEvent {
+	ch := make(chan brokerEvent, 10)
+	b.Subscribe(func(room, evt string, data []byte) {
+		ch <- brokerEvent{room, evt, string(data)}
+	})
+	return ch
+}
+
+func testWaitEvent(t *testing.T, ch chan brokerEvent, want brokerEvent) {
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Errorf("expected %v got %v", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for %v", want)
+	}
+}
+
+// waits for the broker to agree on the presence of id.
+func testWaitOnline(t *testing.T, b Broker, id string, online bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Online(id) != online {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s online to be %v", id, online)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLocalBroker(t *testing.T) {
+	b := NewLocalBroker()
+	ch := testSubscribe(b)
+	if err := b.Publish("room", "evt", []byte(`"data"`)); err != nil {
+		t.Fatal(err)
+	}
+	testWaitEvent(t, ch, brokerEvent{"room", "evt", `"data"`})
+	b.SetOnline("me", true)
+	if !b.Online("me") {
+		t.Error("expected me to be online")
+	}
+	b.SetOnline("me", false)
+	if b.Online("me") {
+		t.Error("expected me to be offline")
+	}
+}
+
+func TestTCPBroker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := "siri"
+	srv := NewBrokerServer(secret)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	a, err := DialBroker(ln.Addr().String(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := DialBroker(ln.Addr().String(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chA, chB := testSubscribe(a), testSubscribe(b)
+
+	// every node gets the event, the one publishing it too
+	if err = a.Publish("me", receiveEvt, []byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := brokerEvent{"me", receiveEvt, `{"id":"1"}`}
+	testWaitEvent(t, chA, want)
+	testWaitEvent(t, chB, want)
+
+	if err = a.SetOnline("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Online("alice") {
+		t.Error("expected alice to be online on her own node right away")
+	}
+	testWaitOnline(t, b, "alice", true)
+	if err = b.SetOnline("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	testWaitOnline(t, a, "bob", true)
+
+	// a node which connects later learns who is online
+	c, err := DialBroker(ln.Addr().String(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testWaitOnline(t, c, "alice", true)
+	testWaitOnline(t, c, "bob", true)
+
+	// the users of a node which goes away are offline
+	b.Close()
+	testWaitOnline(t, a, "bob", false)
+	testWaitOnline(t, c, "bob", false)
+	if err = b.Publish("me", receiveEvt, nil); err != errBrokerClosed {
+		t.Errorf("expected %v got %v", errBrokerClosed, err)
+	}
+
+	if err = a.SetOnline("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	testWaitOnline(t, c, "alice", false)
+}
+
+func TestBrokerSecret(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewBrokerServer("siri")
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	a, err := DialBroker(ln.Addr().String(), "siri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	ch := testSubscribe(a)
+
+	// a node with the wrong secret is dropped, and its frames never reach the others
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	enc.Encode(&brokerFrame{Op: frameHello, Node: "evil", Secret: "wrong"})
+	enc.Encode(&brokerFrame{Op: framePub, Room: "me", Event: receiveEvt, Data: []byte(`{"id":"forged"}`)})
+	if err = a.Publish("me", receiveEvt, []byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	testWaitEvent(t, ch, brokerEvent{"me", receiveEvt, `{"id":"1"}`})
+	select {
+	case got := <-ch:
+		t.Errorf("expected no more events got %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBrokerReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	srv := NewBrokerServer("")
+	go srv.Serve(ln)
+
+	a, err := DialBroker(addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := DialBroker(addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err = a.SetOnline("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	testWaitOnline(t, b, "alice", true)
+
+	// without the server the nodes are on their own
+	srv.Close()
+	testWaitOnline(t, b, "alice", false)
+	if !a.Online("alice") {
+		t.Error("expected alice to be online on her own node")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for a.Publish("me", receiveEvt, nil) != errBrokerDown {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v", errBrokerDown)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the nodes connect again, and tell who is online
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	srv = NewBrokerServer("")
+	go srv.Serve(ln)
+	defer srv.Close()
+	ch := testSubscribe(b)
+	deadline = time.Now().Add(5 * time.Second)
+	for _, v := range []*TCPBroker{a, b} {
+		for v.Publish("ping", receiveEvt, nil) != nil {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the nodes to connect again")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err = a.Publish("me", receiveEvt, []byte(`{"id":"2"}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := brokerEvent{"me", receiveEvt, `{"id":"2"}`}
+
+	// the pings which got through come first
+	got := brokerEvent{room: "ping"}
+	for got.room == "ping" {
+		select {
+		case got = <-ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+	if got != want {
+		t.Errorf("expected %v got %v", want, got)
+	}
+	testWaitOnline(t, b, "alice", true)
+}
+
+func TestBrokerSlowNode(t *testing.T) {
+	srv := NewBrokerServer("")
+	defer srv.Close()
+	join := func(node string) (net.Conn, *json.Decoder) {
+		conn, c := net.Pipe()
+		go srv.serveNode(conn)
+		enc := json.NewEncoder(c)
+		if err := enc.Encode(&brokerFrame{Op: frameHello, Node: node}); err != nil {
+			t.Fatal(err)
+		}
+		return c, json.NewDecoder(c)
+	}
+	a, dec := join("a")
+	defer a.Close()
+	go func() {
+		for dec.Decode(&brokerFrame{}) == nil {
+		}
+	}()
+	if err := json.NewEncoder(a).Encode(&brokerFrame{Op: framePresence, ID: "alice", Online: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		srv.mu.Lock()
+		n := 0
+		for v := range srv.nodes {
+			n += len(v.online)
+		}
+		srv.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected alice to be online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a node which doesn't read doesn't hold up the ones which connect after it
+	slow, _ := join("slow")
+	defer slow.Close()
+	c, dec := join("c")
+	defer c.Close()
+	got := make(chan *brokerFrame, 1)
+	go func() {
+		f := &brokerFrame{}
+		if dec.Decode(f) == nil {
+			got <- f
+		}
+	}()
+	select {
+	case f := <-got:
+		if f.Op != framePresence || f.ID != "alice" || f.Node != "a" || !f.Online {
+			t.Errorf("expected alice online on a got %v", f)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the presence of alice")
+	}
+}
@@ -1,15 +1,48 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
 
 	"github.com/gernest/aurora"
+	"github.com/gorilla/securecookie"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		case "purge":
+			purge()
+			return
+		case "reindex":
+			reindex()
+			return
+		case "broker":
+			broker(os.Args[2:])
+			return
+		}
+	}
+	rx, err := aurora.NewRemix(loadConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./public"))))
+	http.Handle("/", rx.Routes())
+	log.Println("starting server ar port 8080...")
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
+
+func loadConfig() *aurora.RemixConfig {
 	d, err := ioutil.ReadFile("config/app.json")
 	if err != nil {
 		panic(err)
@@ -19,9 +52,114 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	rx := aurora.NewRemix(cfg)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./public"))))
-	http.Handle("/", rx.Routes())
-	log.Println("starting server ar port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	return cfg
+}
+
+// purge deletes the accounts whose deletion grace period is over, it is meant to be
+// run periodically e.g by cron.
+func purge() {
+	rx, err := aurora.NewRemix(loadConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rx.Close()
+	n, err := rx.PurgeDeletedAccounts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("purged %d accounts\n", n)
+}
+
+// reindex builds the search index of the messages again, it is needed once for
+// databases created before messages could be searched.
+func reindex() {
+	rx, err := aurora.NewRemix(loadConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rx.Close()
+	n, err := rx.RebuildSearchIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("indexed %d messages\n", n)
+}
+
+// broker runs the broker server, which connects the nodes running the messenger.
+// Every node should have the address in broker_addr, and the secret in
+// broker_secret. Without a secret it only listens on localhost.
+func broker(args []string) {
+	fs := flag.NewFlagSet("broker", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "address to listen on")
+	secret := fs.String("secret", os.Getenv("AURORA_BROKER_SECRET"), "secret the nodes connect with")
+	fs.Parse(args)
+	if *secret == "" && !isLoopback(*addr) {
+		log.Fatalf("a -secret is needed to listen on %s\n", *addr)
+	}
+	log.Printf("starting broker at %s...\n", *addr)
+	log.Fatal(aurora.NewBrokerServer(*secret).ListenAndServe(*addr))
+}
+
+// checks if the address can only be reached from this machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// keygen prints fresh session key pairs, both as the session_keys config value and
+// in the format expected by the AURORA_SESSION_KEYS environment variable.
+//
+// To rotate keys, put the new pair in front of the existing ones.
+//
+// With -totp it prints a key for encrypting two factor authentication secrets
+// instead, note that this key can't be rotated as easily.
+//
+// With -vapid it prints a key for signing push notifications, changing it means
+// every device has to subscribe again.
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	n := fs.Int("n", 1, "number of key pairs to generate")
+	totp := fs.Bool("totp", false, "generate a two factor authentication key")
+	vapid := fs.Bool("vapid", false, "generate a push notifications key")
+	fs.Parse(args)
+
+	if *vapid {
+		k, err := aurora.GenerateVAPIDKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := aurora.EncodeVAPIDKey(k)
+		fmt.Printf("\"vapid_key\": %q\n\nAURORA_VAPID_KEY=%s\n\npublic key: %s\n", s, s, aurora.VAPIDPublicKey(k))
+		return
+	}
+
+	if *totp {
+		k := base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+		fmt.Printf("\"totp_key\": %q\n\nAURORA_TOTP_KEY=%s\n", k, k)
+		return
+	}
+
+	var keys []*aurora.SessionKey
+	var env string
+	for i := 0; i < *n; i++ {
+		k := aurora.GenerateSessionKey()
+		keys = append(keys, k)
+		if i > 0 {
+			env = env + ","
+		}
+		env = env + k.String()
+	}
+	d, err := json.MarshalIndent(map[string]interface{}{"session_keys": keys}, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(d))
+	fmt.Printf("\nAURORA_SESSION_KEYS=%s\n", env)
 }
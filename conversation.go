@@ -0,0 +1,165 @@
+package aurora
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// the bucket in the profile database where the conversations of the profile are
+// indexed.
+const conversationsBucket = "conversations"
+
+// Conversation is an entry in the index of conversations of a user. Every participant
+// has an own copy, keyed by the id of the other participant, so that listing the
+// chats of a user doesn't need scanning all the messages.
+type Conversation struct {
+	// ID is the same for both participants, it is also set as the ConversationID
+	// of the messages.
+	ID           string   `json:"id"`
+	Participants []string `json:"participants"`
+
+	// With is the id of the other participant.
+	With        string    `json:"with"`
+	LastMessage *MSG      `json:"last_message"`
+	Unread      int       `json:"unread"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Request is true when the conversation was started by a profile who is not a
+	// contact of the owner. It stays in the message requests until the owner accepts
+	// it, or replies.
+	Request bool `json:"request,omitempty"`
+}
+
+// returns the id of the conversation between the profiles a and b, it does not
+// matter which is which.
+func conversationID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+// records msg in the conversation index of owner. unread is true when the message is
+// received by owner and it is not read yet.
+func (m *Messenger) indexMessage(owner string, msg *MSG, unread bool) error {
+	other := msg.RecipientID
+	if other == owner {
+		other = msg.SenderID
+	}
+	return m.updateConversation(owner, other, func(c *Conversation) {
+		switch {
+		case !unread:
+			c.Request = false
+		case c.UpdatedAt.IsZero():
+			// the first message is a request until the owner accepts it. Sharing a
+			// group doesn't count, anyone can add the owner to a group.
+			c.Request = true
+		}
+		if c.LastMessage == nil || !msg.SentAt.Before(c.LastMessage.SentAt) {
+			c.LastMessage = msg
+		}
+		if msg.SentAt.After(c.UpdatedAt) {
+			c.UpdatedAt = msg.SentAt
+		}
+		if unread {
+			c.Unread++
+		}
+	})
+}
+
+// records that owner has read msg.
+func (m *Messenger) markRead(owner string, msg *MSG) error {
+	return m.updateConversation(owner, msg.SenderID, func(c *Conversation) {
+		if c.Unread > 0 {
+			c.Unread--
+		}
+	})
+}
+
+// loads the conversation of owner with other, applies fn to it and saves it back.
+// The conversation is created if it does not exist yet.
+func (m *Messenger) updateConversation(owner, other string, fn func(*Conversation)) error {
+	m.convMu.Lock()
+	defer m.convMu.Unlock()
+	db := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, owner, m.rx.cfg.DBExtension))
+	c := &Conversation{}
+	if err := getAndUnmarshall(db, conversationsBucket, other, c); err != nil {
+		c = &Conversation{
+			ID:           conversationID(owner, other),
+			Participants: []string{owner, other},
+			With:         other,
+		}
+	}
+	fn(c)
+	return marshalAndCreate(db, c, conversationsBucket, other)
+}
+
+// returns the conversations of owner, the most recently active first.
+func (m *Messenger) conversations(owner string) ([]*Conversation, error) {
+	db := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, owner, m.rx.cfg.DBExtension))
+	rst := []*Conversation{}
+	all := db.GetAll(conversationsBucket)
+	if all.Error != nil {
+		// no conversations yet.
+		return rst, nil
+	}
+	for _, v := range all.DataList {
+		c := &Conversation{}
+		if err := json.Unmarshal(v, c); err == nil {
+			rst = append(rst, c)
+		}
+	}
+	sort.Sort(byActivity(rst))
+	return rst, nil
+}
+
+// returns the conversations of owner which are message requests, or the ones which
+// are not.
+func (m *Messenger) folder(owner string, requests bool) ([]*Conversation, error) {
+	all, err := m.conversations(owner)
+	if err != nil {
+		return nil, err
+	}
+	rst := []*Conversation{}
+	for _, c := range all {
+		if c.Request == requests {
+			rst = append(rst, c)
+		}
+	}
+	return rst, nil
+}
+
+// moves the message request from other to the conversations of owner.
+func (m *Messenger) acceptRequest(owner, other string) (*Conversation, error) {
+	m.convMu.Lock()
+	defer m.convMu.Unlock()
+	db := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, owner, m.rx.cfg.DBExtension))
+	c := &Conversation{}
+	if err := getAndUnmarshall(db, conversationsBucket, other, c); err != nil || !c.Request {
+		return nil, errNotFound
+	}
+	c.Request = false
+	if err := marshalAndCreate(db, c, conversationsBucket, other); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// removes the message request from other. If other writes again it is a new request.
+func (m *Messenger) declineRequest(owner, other string) error {
+	m.convMu.Lock()
+	defer m.convMu.Unlock()
+	db := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, owner, m.rx.cfg.DBExtension))
+	c := &Conversation{}
+	if err := getAndUnmarshall(db, conversationsBucket, other, c); err != nil || !c.Request {
+		return errNotFound
+	}
+	return db.Delete(conversationsBucket, other).Error
+}
+
+type byActivity []*Conversation
+
+func (s byActivity) Len() int           { return len(s) }
+func (s byActivity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byActivity) Less(i, j int) bool { return s[i].UpdatedAt.After(s[j].UpdatedAt) }
@@ -0,0 +1,94 @@
+package aurora
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gernest/golem"
+	"github.com/gernest/nutz"
+	"github.com/muesli/cache2go"
+)
+
+// returns a messenger which keeps its databases in a temporary directory, the
+// directory should be removed after the test.
+func testMessenger(t *testing.T) (*Messenger, string) {
+	dir, err := ioutil.TempDir("", "aurora")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx := &Remix{
+		db:  nutz.NewStorage("", 0600, nil),
+		cfg: &RemixConfig{DBDir: dir, DBExtension: ".bdb", ProfilesBucket: "profiles", MessagesBucket: "messages"},
+	}
+	rx.msg = &Messenger{
+		rx:     rx,
+		rm:     golem.NewRoomManager(),
+		online: cache2go.Cache(dir),
+	}
+	rx.msg.useBroker(NewLocalBroker())
+	return rx.msg, dir
+}
+
+func TestConversationIndex(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		err   error
+		me    = "me"
+		alice = "alice"
+		bob   = "bob"
+		now   = time.Now()
+	)
+	msgs := []*MSG{
+		{ID: "1", SenderID: alice, RecipientID: me, SentAt: now},
+		{ID: "2", SenderID: me, RecipientID: bob, SentAt: now.Add(time.Second)},
+		{ID: "3", SenderID: alice, RecipientID: me, SentAt: now.Add(2 * time.Second)},
+	}
+	for _, v := range msgs {
+		if err = m.indexMessage(me, v, v.RecipientID == me); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a late copy of an old message doesn't replace the last message
+	if err = m.indexMessage(me, &MSG{ID: "0", SenderID: me, RecipientID: alice, SentAt: now.Add(-time.Minute)}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.markRead(me, msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := m.conversations(me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 conversations got %d", len(list))
+	}
+	c := list[0]
+	if c.With != alice || c.ID != conversationID(alice, me) {
+		t.Errorf("expected the conversation with %s first got %s", alice, c.With)
+	}
+	if c.LastMessage.ID != "3" {
+		t.Errorf("expected the last message to be 3 got %s", c.LastMessage.ID)
+	}
+	if c.Unread != 1 {
+		t.Errorf("expected 1 unread message got %d", c.Unread)
+	}
+	if list[1].With != bob || list[1].Unread != 0 {
+		t.Errorf("expected the conversation with %s and no unread messages got %v", bob, list[1])
+	}
+	if conversationID(me, bob) != conversationID(bob, me) {
+		t.Error("expected the conversation id to be the same for both participants")
+	}
+
+	empty, err := m.conversations("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty == nil || len(empty) != 0 {
+		t.Errorf("expected no conversations got %v", empty)
+	}
+}
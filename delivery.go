@@ -0,0 +1,239 @@
+package aurora
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gernest/golem"
+	"github.com/muesli/cache2go"
+)
+
+const (
+	// events about delivery
+	ackEvt    = "ack"
+	statusEvt = "status"
+
+	// delivery states of a message, in the order they happen.
+	stateSent      = "sent"
+	stateDelivered = "delivered"
+	stateRead      = "read"
+
+	// the bucket in the profile database holding the messages which are not yet
+	// acknowledged by the profile.
+	pendingBucket = "pending"
+
+	// defaults of the retry policy, in seconds for the intervals.
+	defaultDeliveryRetry       = 5
+	defaultDeliveryMaxRetry    = 300
+	defaultDeliveryMaxAttempts = 10
+)
+
+// pendingDelivery is a message waiting in the queue of the recipient, until the
+// recipient acknowledges it.
+type pendingDelivery struct {
+	Msg         *MSG      `json:"msg"`
+	Attempts    int       `json:"attempts"`
+	QueuedAt    time.Time `json:"queued_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// returns true if state comes after the current state.
+func stateAfter(state, current string) bool {
+	rank := map[string]int{"": 0, stateSent: 1, stateDelivered: 2, stateRead: 3}
+	return rank[state] > rank[current]
+}
+
+// returns how long to wait before the next attempt, it doubles with every attempt.
+func deliveryBackoff(attempts int, base, limit time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+// adds msg to the pending queue of the recipient.
+func (m *Messenger) enqueue(recipient string, msg *MSG) error {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, recipient, m.rx.cfg.DBExtension))
+	p := &pendingDelivery{Msg: msg, QueuedAt: time.Now()}
+	return marshalAndCreate(pdb, p, pendingBucket, msg.ID)
+}
+
+// sends the pending messages of the recipient which are due, or all of them when
+// force is true. Messages which are not acknowledged after the maximum number of
+// attempts are given up on, and the sender is told the sending failed unless the
+// recipient has the message stored already.
+func (m *Messenger) deliverPending(recipient string, force bool) {
+	if !m.isOnline(recipient) {
+		return
+	}
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	var (
+		now      = time.Now()
+		base     = secondsOr(m.rx.cfg.DeliveryRetryInterval, defaultDeliveryRetry)
+		limit    = secondsOr(m.rx.cfg.DeliveryMaxRetryInterval, defaultDeliveryMaxRetry)
+		attempts = m.rx.cfg.DeliveryMaxAttempts
+		pdb      = setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, recipient, m.rx.cfg.DBExtension))
+	)
+	if attempts <= 0 {
+		attempts = defaultDeliveryMaxAttempts
+	}
+	all := pdb.GetAll(pendingBucket)
+	for id, v := range all.DataList {
+		p := &pendingDelivery{}
+		if err := json.Unmarshal(v, p); err != nil || p.Msg == nil {
+			pdb.Delete(pendingBucket, id)
+			continue
+		}
+		if !force && now.Before(p.NextAttempt) {
+			continue
+		}
+		if p.Attempts >= attempts {
+			pdb.Delete(pendingBucket, id)
+
+			// the recipient can have the message without acknowledging it, e.g it
+			// was stored while they were offline.
+			if m.hasMsg(recipient, id) {
+				if err := m.setState(p.Msg.SenderID, id, stateDelivered); err != nil {
+					log.Println(err)
+				}
+				continue
+			}
+			m.deliveryFailed(p.Msg)
+			continue
+		}
+		p.Attempts++
+		p.NextAttempt = now.Add(deliveryBackoff(p.Attempts, base, limit))
+		if err := marshalAndCreate(pdb, p, pendingBucket, id); err != nil {
+			log.Println(err)
+			continue
+		}
+		m.emit(recipient, receiveEvt, p.Msg)
+	}
+}
+
+// gives up on delivering msg, the message goes to the drafts of the sender.
+func (m *Messenger) deliveryFailed(msg *MSG) {
+	if m.isOnline(msg.SenderID) {
+		m.emit(msg.SenderID, sendFailedEvt, msg)
+		return
+	}
+	if err := m.moveTo(draftBucket, outboxBucket, msg.SenderID, msg.ID); err != nil {
+		log.Println(err)
+	}
+}
+
+// removes the message from the pending queue of the recipient, and tells the
+// sender it is delivered.
+func (m *Messenger) acknowledge(recipient, msgID string) error {
+	m.pendingMu.Lock()
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, recipient, m.rx.cfg.DBExtension))
+	p := &pendingDelivery{}
+	err := getAndUnmarshall(pdb, pendingBucket, msgID, p)
+	if err == nil {
+		err = pdb.Delete(pendingBucket, msgID).Error
+	}
+	m.pendingMu.Unlock()
+	if err != nil {
+		// acknowledged already.
+		return nil
+	}
+	return m.setState(p.Msg.SenderID, msgID, stateDelivered)
+}
+
+// updates the delivery state of the message in the outbox of the sender, and tells
+// the sender about it. States never go back, so a late acknowledgement won't turn
+// a read message into a delivered one.
+func (m *Messenger) setState(sender, msgID, state string) error {
+	sdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, sender, m.rx.cfg.DBExtension))
+	msg := &MSG{}
+	if err := getAndUnmarshall(sdb, outboxBucket, msgID, msg, m.rx.cfg.MessagesBucket); err != nil {
+		return err
+	}
+	if !stateAfter(state, msg.State) {
+		return nil
+	}
+	msg.State = state
+	if err := marshalAndCreate(sdb, msg, outboxBucket, msgID, m.rx.cfg.MessagesBucket); err != nil {
+		return err
+	}
+	m.emit(sender, statusEvt, msg)
+	return nil
+}
+
+// checks if the profile has received the message already, that is it is either in
+// the inbox or among the read messages, or the profile has deleted it.
+func (m *Messenger) hasMsg(profileID, msgID string) bool {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if pdb.Get(hiddenBucket, msgID).Error == nil {
+		return true
+	}
+	for _, b := range []string{inboxBucket, readBucket} {
+		if pdb.Get(b, msgID, m.rx.cfg.MessagesBucket).Error == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// the recipient acknowledges a message.
+func (m *Messenger) ack(conn *golem.Connection, msg *MSG) {
+	if err := m.acknowledge(conn.UserID, msg.ID); err != nil {
+		log.Println(err)
+	}
+}
+
+// StartDelivery starts a goroutine which retries delivering pending messages to
+// online users after every interval. Calling it when it is already running does
+// nothing.
+func (m *Messenger) StartDelivery(interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.quit != nil {
+		return
+	}
+	m.quit = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.retry(interval, m.quit, m.done)
+}
+
+// StopDelivery stops the goroutine started by StartDelivery, and waits for it to
+// exit.
+func (m *Messenger) StopDelivery() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.quit == nil {
+		return
+	}
+	close(m.quit)
+	<-m.done
+	m.quit = nil
+	m.done = nil
+}
+
+func (m *Messenger) retry(interval time.Duration, quit, done chan struct{}) {
+	defer close(done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-tick.C:
+			var online []string
+			m.online.Foreach(func(key interface{}, _ *cache2go.CacheItem) {
+				if id, ok := key.(string); ok {
+					online = append(online, id)
+				}
+			})
+			for _, id := range online {
+				m.deliverPending(id, false)
+			}
+		}
+	}
+}
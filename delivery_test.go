@@ -0,0 +1,162 @@
+package aurora
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeliveryBackoff(t *testing.T) {
+	sample := []struct {
+		attempts int
+		wait     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{10, time.Minute},
+	}
+	for _, v := range sample {
+		if w := deliveryBackoff(v.attempts, time.Second, time.Minute); w != v.wait {
+			t.Errorf("expected %v after %d attempts got %v", v.wait, v.attempts, w)
+		}
+	}
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	m.rx.cfg.DeliveryMaxAttempts = 2
+	var (
+		alice = "alice"
+		bob   = "bob"
+	)
+	pending := func() map[string]*pendingDelivery {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, bob, m.rx.cfg.DBExtension))
+		rst := make(map[string]*pendingDelivery)
+		for id := range pdb.GetAll(pendingBucket).DataList {
+			p := &pendingDelivery{}
+			if err := getAndUnmarshall(pdb, pendingBucket, id, p); err != nil {
+				t.Fatal(err)
+			}
+			rst[id] = p
+		}
+		return rst
+	}
+	send := func(id string) *MSG {
+		msg := &MSG{ID: id, SenderID: alice, RecipientID: bob, SentAt: time.Now(), State: stateSent}
+		if err := m.saveMsg(outboxBucket, alice, msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.enqueue(bob, msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	one, two := send("1"), send("2")
+
+	// nothing is sent while the recipient is offline
+	m.deliverPending(bob, true)
+	if p := pending()[one.ID]; p == nil || p.Attempts != 0 {
+		t.Fatalf("expected the message to be pending with no attempts got %v", p)
+	}
+
+	m.online.Add(bob, 0, bob)
+	defer m.online.Delete(bob)
+	m.deliverPending(bob, false)
+	p := pending()[one.ID]
+	if p.Attempts != 1 || !p.NextAttempt.After(time.Now()) {
+		t.Errorf("expected 1 attempt with a later retry got %d at %v", p.Attempts, p.NextAttempt)
+	}
+
+	// a retry which is not due yet waits, unless it is forced
+	m.deliverPending(bob, false)
+	if p = pending()[one.ID]; p.Attempts != 1 {
+		t.Errorf("expected 1 attempt got %d", p.Attempts)
+	}
+
+	if err := m.acknowledge(bob, one.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pending()[one.ID]; ok {
+		t.Error("expected the acknowledged message to leave the queue")
+	}
+	adb := setDB(m.rx.db, getProfileDatabase(dir, alice, m.rx.cfg.DBExtension))
+	out := &MSG{}
+	if err := getAndUnmarshall(adb, outboxBucket, one.ID, out, m.rx.cfg.MessagesBucket); err != nil {
+		t.Fatal(err)
+	}
+	if out.State != stateDelivered {
+		t.Errorf("expected %s got %s", stateDelivered, out.State)
+	}
+
+	// the state never goes back
+	if err := m.setState(alice, one.ID, stateRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setState(alice, one.ID, stateDelivered); err != nil {
+		t.Fatal(err)
+	}
+	if err := getAndUnmarshall(adb, outboxBucket, one.ID, out, m.rx.cfg.MessagesBucket); err != nil {
+		t.Fatal(err)
+	}
+	if out.State != stateRead {
+		t.Errorf("expected %s got %s", stateRead, out.State)
+	}
+	if err := m.acknowledge(bob, one.ID); err != nil {
+		t.Errorf("expected a second acknowledgement to be ignored got %v", err)
+	}
+
+	// the sender gets the message back in drafts after the last attempt
+	for i := 0; i < 3; i++ {
+		m.deliverPending(bob, true)
+	}
+	if _, ok := pending()[two.ID]; ok {
+		t.Error("expected the message to leave the queue after the last attempt")
+	}
+	if adb.Get(draftBucket, two.ID, m.rx.cfg.MessagesBucket).Error != nil {
+		t.Error("expected the message in the drafts of the sender")
+	}
+
+	// a message the recipient has stored is delivered, even if it wasn't acknowledged
+	three := send("3")
+	if err := m.saveMsg(inboxBucket, bob, three); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		m.deliverPending(bob, true)
+	}
+	if _, ok := pending()[three.ID]; ok {
+		t.Error("expected the message to leave the queue after the last attempt")
+	}
+	if adb.Get(draftBucket, three.ID, m.rx.cfg.MessagesBucket).Error == nil {
+		t.Error("expected the stored message not to go to the drafts")
+	}
+	if err := getAndUnmarshall(adb, outboxBucket, three.ID, out, m.rx.cfg.MessagesBucket); err != nil {
+		t.Fatal(err)
+	}
+	if out.State != stateDelivered {
+		t.Errorf("expected %s got %s", stateDelivered, out.State)
+	}
+}
+
+func TestMessenger_HasMsg(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	msg := &MSG{ID: "1", SenderID: "alice", RecipientID: "bob"}
+	if m.hasMsg("bob", msg.ID) {
+		t.Error("expected the message to be missing")
+	}
+	if err := m.saveMsg(inboxBucket, "bob", msg); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasMsg("bob", msg.ID) {
+		t.Error("expected the message in the inbox")
+	}
+	if err := m.moveTo(readBucket, inboxBucket, "bob", msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasMsg("bob", msg.ID) {
+		t.Error("expected the read message to be found")
+	}
+}
@@ -0,0 +1,365 @@
+package aurora
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gernest/golem"
+	"github.com/gernest/nutz"
+)
+
+const (
+	// events sent by clients
+	editEvt   = "edit"
+	deleteEvt = "delete"
+
+	// events sent to clients
+	alertEdited     = "messageEdited"
+	alertDeleted    = "messageDeleted"
+	editFailedEvt   = "editFailed"
+	deleteFailedEvt = "deleteFailed"
+
+	// the bucket in the profile database with the ids of the messages the profile
+	// deleted for itself, they are left out of the history.
+	hiddenBucket = "hidden"
+
+	// the number of seconds a message can be deleted for everyone, unless configured
+	// otherwise.
+	defaultUnsendWindow = 3600
+)
+
+var (
+	errUnsendWindow = errors.New("du! muda wa kufuta ujumbe huu kwa wote umepita")
+	errMsgDeleted   = errors.New("du! ujumbe huu umeshafutwa")
+)
+
+// MSGEdit is an earlier text of an edited message, or the earlier envelope of an
+// encrypted one.
+type MSGEdit struct {
+	Text     string    `json:"text"`
+	Envelope *Envelope `json:"envelope,omitempty"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// EditRequest is the data of the edit and delete websocket events. GroupID is needed
+// only for messages sent to a group. Everyone deletes the message for all the
+// participants instead of only for the one asking.
+//
+// Encrypted messages are edited with a new Envelope instead of the Text.
+type EditRequest struct {
+	ID       string    `json:"id"`
+	GroupID  string    `json:"group_id,omitempty"`
+	Text     string    `json:"text"`
+	Envelope *Envelope `json:"envelope,omitempty"`
+	Everyone bool      `json:"everyone"`
+}
+
+// a place where a copy of a message is stored.
+type msgCopy struct {
+	db     nutz.Storage
+	bucket string
+	nest   []string
+
+	// the profile owning the copy, copies in the groups database have none.
+	owner string
+}
+
+// finds the message with the given id which profileID can see.
+func (m *Messenger) findMsg(profileID, msgID, groupID string) (*MSG, error) {
+	msg := &MSG{}
+	if groupID != "" {
+		g, err := m.getGroup(groupID)
+		if err != nil {
+			return nil, err
+		}
+		if !g.isMember(profileID) {
+			return nil, errNotMember
+		}
+		if err = getAndUnmarshall(m.groupsDB(), groupMessagesBucket, msgID, msg, g.ID); err != nil {
+			return nil, errNotFound
+		}
+		return msg, nil
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	for _, b := range []string{outboxBucket, draftBucket, inboxBucket, readBucket} {
+		if err := getAndUnmarshall(pdb, b, msgID, msg, m.rx.cfg.MessagesBucket); err == nil {
+			return msg, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+// returns the ids of the profiles who should know about changes to msg.
+func (m *Messenger) participants(msg *MSG) []string {
+	if msg.GroupID != "" {
+		g, err := m.getGroup(msg.GroupID)
+		if err != nil {
+			return []string{msg.SenderID}
+		}
+		return g.memberIDs()
+	}
+	return []string{msg.SenderID, msg.RecipientID}
+}
+
+// returns the places where copies of msg might be stored.
+func (m *Messenger) msgCopies(msg *MSG) []msgCopy {
+	var rst []msgCopy
+	add := func(id string, buckets ...string) {
+		pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, id, m.rx.cfg.DBExtension))
+		for _, b := range buckets {
+			rst = append(rst, msgCopy{pdb, b, []string{m.rx.cfg.MessagesBucket}, id})
+		}
+	}
+	add(msg.SenderID, outboxBucket, draftBucket)
+	if msg.GroupID == "" {
+		add(msg.RecipientID, inboxBucket, readBucket)
+		return rst
+	}
+	rst = append(rst, msgCopy{m.groupsDB(), groupMessagesBucket, []string{msg.GroupID}, ""})
+	for _, id := range m.participants(msg) {
+		if id != msg.SenderID {
+			add(id, inboxBucket, readBucket)
+		}
+	}
+	return rst
+}
+
+// applies fn to every stored copy of msg, including the one waiting in the pending
+// queue of the recipient. It returns the updated message.
+func (m *Messenger) updateCopies(msg *MSG, fn func(*MSG)) *MSG {
+	rst := msg
+	for _, c := range m.msgCopies(msg) {
+		cp := &MSG{}
+		if err := getAndUnmarshall(c.db, c.bucket, msg.ID, cp, c.nest...); err != nil {
+			continue
+		}
+		fn(cp)
+		if err := marshalAndCreate(c.db, cp, c.bucket, msg.ID, c.nest...); err != nil {
+			log.Println(err)
+			continue
+		}
+		if c.owner != "" {
+			m.index(c.owner, c.bucket, cp)
+		}
+		rst = cp
+	}
+	if msg.GroupID == "" {
+		m.pendingMu.Lock()
+		pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, msg.RecipientID, m.rx.cfg.DBExtension))
+		p := &pendingDelivery{}
+		if err := getAndUnmarshall(pdb, pendingBucket, msg.ID, p); err == nil && p.Msg != nil {
+			fn(p.Msg)
+			if err = marshalAndCreate(pdb, p, pendingBucket, msg.ID); err != nil {
+				log.Println(err)
+			}
+		}
+		m.pendingMu.Unlock()
+
+		// the conversations show the last message, it should be the current one.
+		for _, owner := range m.participants(msg) {
+			other := msg.RecipientID
+			if owner == other {
+				other = msg.SenderID
+			}
+			err := m.updateConversation(owner, other, func(c *Conversation) {
+				if c.LastMessage != nil && c.LastMessage.ID == rst.ID {
+					c.LastMessage = rst
+				}
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return rst
+}
+
+// drops the edit history of a new message, only the server changes it after the
+// message is sent.
+func resetEdits(msg *MSG) {
+	msg.EditedAt = time.Time{}
+	msg.Edits = nil
+	msg.Deleted = false
+}
+
+// changes the text of a message, only the sender can do it. The earlier texts are
+// kept in the edits of the message.
+func (m *Messenger) editMsg(profileID string, req *EditRequest) (*MSG, error) {
+	if req.Text == "" && req.Envelope == nil {
+		return nil, errBadForm
+	}
+	msg, err := m.findMsg(profileID, req.ID, req.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.SenderID != profileID {
+		return nil, errForbidden
+	}
+	if msg.Deleted {
+		return nil, errMsgDeleted
+	}
+	if msg.Envelope != nil || req.Envelope != nil {
+		// encrypted messages stay encrypted, and plain ones stay plain.
+		if msg.Envelope == nil || req.Envelope == nil {
+			return nil, errEncryptedMsg
+		}
+		if err = checkEnvelope(&MSG{Text: req.Text, Envelope: req.Envelope}); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	return m.updateCopies(msg, func(c *MSG) {
+		c.Edits = append(c.Edits, &MSGEdit{Text: c.Text, Envelope: c.Envelope, EditedAt: now})
+		c.Text = req.Text
+		c.Envelope = req.Envelope
+		c.EditedAt = now
+	}), nil
+}
+
+// deletes a message for everyone, which only the sender can do for a while after
+// sending it. The copies are kept with the text removed, so that clients can show
+// where the message was.
+func (m *Messenger) unsendMsg(profileID string, req *EditRequest) (*MSG, error) {
+	msg, err := m.findMsg(profileID, req.ID, req.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.SenderID != profileID {
+		return nil, errForbidden
+	}
+	if msg.Deleted {
+		return nil, errMsgDeleted
+	}
+	if time.Since(msg.SentAt) > secondsOr(m.rx.cfg.UnsendWindow, defaultUnsendWindow) {
+		return nil, errUnsendWindow
+	}
+	m.detach(msg)
+	rst := m.updateCopies(msg, func(c *MSG) {
+		c.Text = ""
+		c.Edits = nil
+		c.Attachments = nil
+		c.Envelope = nil
+		c.Deleted = true
+	})
+	if msg.GroupID == "" {
+		// there is nothing left to deliver, or to read.
+		m.pendingMu.Lock()
+		pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, msg.RecipientID, m.rx.cfg.DBExtension))
+		pdb.Delete(pendingBucket, msg.ID)
+		m.pendingMu.Unlock()
+		m.boxMu.Lock()
+		if err = m.moveTo(readBucket, inboxBucket, msg.RecipientID, msg.ID); err == nil {
+			if err = m.markRead(msg.RecipientID, msg); err != nil {
+				log.Println(err)
+			}
+		}
+		m.boxMu.Unlock()
+	}
+	return rst, nil
+}
+
+// deletes the copies of a message which belong to the profile, the other participants
+// still have theirs.
+func (m *Messenger) deleteMsgForMe(profileID string, req *EditRequest) (*MSG, error) {
+	msg, err := m.findMsg(profileID, req.ID, req.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if s := pdb.Create(hiddenBucket, msg.ID, []byte(msg.ConversationID)); s.Error != nil {
+		return nil, s.Error
+	}
+	if err = m.acknowledge(profileID, msg.ID); err != nil {
+		log.Println(err)
+	}
+	m.boxMu.Lock()
+	if msg.GroupID == "" && pdb.Get(inboxBucket, msg.ID, m.rx.cfg.MessagesBucket).Error == nil {
+		if err = m.markRead(profileID, msg); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, b := range []string{outboxBucket, draftBucket, inboxBucket, readBucket} {
+		pdb.Delete(b, msg.ID, m.rx.cfg.MessagesBucket)
+	}
+	m.boxMu.Unlock()
+	if err = unindexMsg(pdb, msg.ID); err != nil {
+		log.Println(err)
+	}
+	if msg.GroupID == "" {
+		other := msg.RecipientID
+		if other == profileID {
+			other = msg.SenderID
+		}
+		err = m.updateConversation(profileID, other, func(c *Conversation) {
+			if c.LastMessage != nil && c.LastMessage.ID == msg.ID {
+				c.LastMessage = nil
+			}
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return msg, nil
+}
+
+// returns the ids of the messages the profile deleted for itself.
+func (m *Messenger) hiddenMsgs(profileID string) map[string]bool {
+	rst := make(map[string]bool)
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	for id := range pdb.GetAll(hiddenBucket).DataList {
+		rst[id] = true
+	}
+	return rst
+}
+
+// removes the hidden messages from msgs.
+func withoutHidden(msgs []*MSG, hidden map[string]bool) []*MSG {
+	if len(hidden) == 0 {
+		return msgs
+	}
+	var rst []*MSG
+	for _, v := range msgs {
+		if !hidden[v.ID] {
+			rst = append(rst, v)
+		}
+	}
+	return rst
+}
+
+func (m *Messenger) onEdit(conn *golem.Connection, req *EditRequest) {
+	msg, err := m.editMsg(conn.UserID, req)
+	if err != nil {
+		conn.Emit(editFailedEvt, &InfoMSG{Title: req.ID, Body: err.Error()})
+		return
+	}
+	for _, id := range m.participants(msg) {
+		if !m.isBlocked(id, msg.SenderID) {
+			m.emit(id, alertEdited, msg)
+		}
+	}
+}
+
+func (m *Messenger) onDelete(conn *golem.Connection, req *EditRequest) {
+	if !req.Everyone {
+		msg, err := m.deleteMsgForMe(conn.UserID, req)
+		if err != nil {
+			conn.Emit(deleteFailedEvt, &InfoMSG{Title: req.ID, Body: err.Error()})
+			return
+		}
+
+		// only the devices of the user need to know.
+		m.emit(conn.UserID, alertDeleted, msg)
+		return
+	}
+	msg, err := m.unsendMsg(conn.UserID, req)
+	if err != nil {
+		conn.Emit(deleteFailedEvt, &InfoMSG{Title: req.ID, Body: err.Error()})
+		return
+	}
+	for _, id := range m.participants(msg) {
+		if !m.isBlocked(id, msg.SenderID) {
+			m.emit(id, alertDeleted, msg)
+		}
+	}
+}
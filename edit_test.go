@@ -0,0 +1,127 @@
+package aurora
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEditMsg(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		alice = "alice"
+		bob   = "bob"
+	)
+	for _, id := range []string{alice, bob} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(id, text string, at time.Time) *MSG {
+		msg := &MSG{ID: id, SenderID: alice, RecipientID: bob, Text: text, SentAt: at,
+			ConversationID: conversationID(alice, bob)}
+		for _, v := range []struct {
+			bucket, owner string
+		}{{outboxBucket, alice}, {inboxBucket, bob}} {
+			if err := m.saveMsg(v.bucket, v.owner, msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.indexMessage(v.owner, msg, v.owner == bob); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.enqueue(bob, msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	old := send("1", "habari", time.Now().Add(-2*time.Hour))
+	msg := send("2", "mambo", time.Now())
+
+	if _, err := m.editMsg(bob, &EditRequest{ID: msg.ID, Text: "poa"}); err != errForbidden {
+		t.Errorf("expected %v got %v", errForbidden, err)
+	}
+	edited, err := m.editMsg(alice, &EditRequest{ID: msg.ID, Text: "vipi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Text != "vipi" || edited.EditedAt.IsZero() || len(edited.Edits) != 1 || edited.Edits[0].Text != "mambo" {
+		t.Errorf("expected the edit with the history got %v", edited)
+	}
+
+	// every copy is edited
+	got, err := m.findMsg(bob, msg.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "vipi" {
+		t.Errorf("expected the copy of %s to be edited got %s", bob, got.Text)
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(dir, bob, m.rx.cfg.DBExtension))
+	p := &pendingDelivery{}
+	if err = getAndUnmarshall(pdb, pendingBucket, msg.ID, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Msg.Text != "vipi" {
+		t.Errorf("expected the pending copy to be edited got %s", p.Msg.Text)
+	}
+	list, err := m.conversations(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].LastMessage.Text != "vipi" {
+		t.Errorf("expected the last message to be edited got %s", list[0].LastMessage.Text)
+	}
+
+	// unsending
+	if _, err = m.unsendMsg(alice, &EditRequest{ID: old.ID}); err != errUnsendWindow {
+		t.Errorf("expected %v got %v", errUnsendWindow, err)
+	}
+	if _, err = m.unsendMsg(alice, &EditRequest{ID: msg.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = m.findMsg(bob, msg.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Deleted || got.Text != "" || len(got.Edits) != 0 {
+		t.Errorf("expected the message to be deleted got %v", got)
+	}
+	if pdb.Get(pendingBucket, msg.ID).Error == nil {
+		t.Error("expected the deleted message to leave the queue")
+	}
+	if _, err = m.editMsg(alice, &EditRequest{ID: msg.ID, Text: "tena"}); err != errMsgDeleted {
+		t.Errorf("expected %v got %v", errMsgDeleted, err)
+	}
+
+	// deleting for one participant only
+	if _, err = m.deleteMsgForMe(bob, &EditRequest{ID: old.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.findMsg(bob, old.ID, ""); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	if !m.hasMsg(bob, old.ID) {
+		t.Error("expected the deleted message not to be delivered again")
+	}
+	h, err := m.conversation(bob, alice, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 1 || h.Messages[0].ID != msg.ID {
+		t.Errorf("expected only message %s for %s got %v", msg.ID, bob, h.Messages)
+	}
+	if h, err = m.conversation(alice, bob, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 2 {
+		t.Errorf("expected 2 messages for %s got %d", alice, len(h.Messages))
+	}
+	if list, err = m.conversations(bob); err != nil {
+		t.Fatal(err)
+	}
+	if list[0].Unread != 0 {
+		t.Errorf("expected no unread messages got %d", list[0].Unread)
+	}
+}
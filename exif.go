@@ -0,0 +1,232 @@
+package aurora
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"strings"
+	"time"
+)
+
+// the exif tags aurora cares about, the rest of the metadata including the
+// location and the camera details is dropped when the photos are encoded again.
+const (
+	exifOrientation        = 0x0112
+	exifDateTime           = 0x0132
+	exifIFDPointer         = 0x8769
+	exifDateTimeOriginal   = 0x9003
+	exifOffsetTimeOriginal = 0x9011
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+)
+
+// the few things read from the exif metadata of a jpeg photo.
+type exifInfo struct {
+	// Orientation is how the photo should be turned for viewing, 1 to 8 as in the
+	// exif spec. Zero means the photo didn't say.
+	Orientation int
+
+	// TakenAt is the time the photo was taken, it is in UTC when the camera
+	// didn't record the time zone.
+	TakenAt time.Time
+}
+
+// reads the exif metadata of the given jpeg data, it returns nil when there is
+// none or it doesn't make sense.
+func readExif(data []byte) *exifInfo {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			i += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// the image data starts here, exif always comes before it
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil
+		}
+		seg := data[i+4 : i+2+n]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return parseTIFF(seg[6:])
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// parses the tiff structure which holds the exif tags.
+func parseTIFF(b []byte) *exifInfo {
+	if len(b) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	if order.Uint16(b[2:]) != 42 {
+		return nil
+	}
+	info := &exifInfo{}
+	var taken, original, offset string
+	ifd0 := readIFD(b, order, order.Uint32(b[4:]))
+	if v, ok := ifd0[exifOrientation]; ok {
+		info.Orientation = int(v.short())
+	}
+	if v, ok := ifd0[exifDateTime]; ok {
+		taken = v.ascii()
+	}
+	if v, ok := ifd0[exifIFDPointer]; ok {
+		sub := readIFD(b, order, v.long())
+		if o, ok := sub[exifDateTimeOriginal]; ok {
+			original = o.ascii()
+		}
+		if o, ok := sub[exifOffsetTimeOriginal]; ok {
+			offset = o.ascii()
+		}
+	}
+	if original != "" {
+		taken = original
+	} else {
+		// the offset is only for the original time
+		offset = ""
+	}
+	info.TakenAt = exifTime(taken, offset)
+	return info
+}
+
+// a single entry of an exif directory.
+type exifEntry struct {
+	order  binary.ByteOrder
+	typ    uint16
+	count  uint32
+	value  []byte
+	tiff   []byte
+	offset uint32
+}
+
+func (e exifEntry) short() uint16 {
+	if e.typ != 3 {
+		return 0
+	}
+	return e.order.Uint16(e.value)
+}
+
+func (e exifEntry) long() uint32 {
+	if e.typ != 4 {
+		return 0
+	}
+	return e.order.Uint32(e.value)
+}
+
+func (e exifEntry) ascii() string {
+	if e.typ != 2 {
+		return ""
+	}
+	if e.count <= 4 {
+		// short strings are kept in the entry itself
+		return strings.TrimRight(string(e.value[:e.count]), "\x00 ")
+	}
+	end := uint64(e.offset) + uint64(e.count)
+	if end > uint64(len(e.tiff)) {
+		return ""
+	}
+	return strings.TrimRight(string(e.tiff[e.offset:end]), "\x00 ")
+}
+
+// reads the entries of the directory which is at the given offset.
+func readIFD(b []byte, order binary.ByteOrder, off uint32) map[uint16]exifEntry {
+	rst := make(map[uint16]exifEntry)
+	if uint64(off)+2 > uint64(len(b)) {
+		return rst
+	}
+	n := int(order.Uint16(b[off:]))
+	start := int(off) + 2
+	for i := 0; i < n; i++ {
+		p := start + i*12
+		if p+12 > len(b) {
+			break
+		}
+		rst[order.Uint16(b[p:])] = exifEntry{
+			order:  order,
+			typ:    order.Uint16(b[p+2:]),
+			count:  order.Uint32(b[p+4:]),
+			value:  b[p+8 : p+12],
+			tiff:   b,
+			offset: order.Uint32(b[p+8:]),
+		}
+	}
+	return rst
+}
+
+// parses the exif date, the offset is like +03:00.
+func exifTime(v, offset string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse(exifTimeLayout+"-07:00", v+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse(exifTimeLayout, v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// turns the image the way the exif orientation says, so that it looks right
+// without the metadata.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			i, j := src.PixOffset(sx, sy), dst.PixOffset(x, y)
+			copy(dst.Pix[j:j+4], src.Pix[i:i+4])
+		}
+	}
+	return dst
+}
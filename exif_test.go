@@ -0,0 +1,138 @@
+package aurora
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"testing"
+	"time"
+)
+
+// returns an exif segment with the orientation, and the time the photo was taken
+// in the exif directory.
+func testExif(orientation uint16, taken, offset string) []byte {
+	var (
+		tiff = new(bytes.Buffer)
+		be   = binary.BigEndian
+		// the strings go after the two directories
+		sub  = uint32(8 + 2 + 2*12 + 4)
+		text = sub + 2 + 2*12 + 4
+	)
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(tiff, be, tag)
+		binary.Write(tiff, be, typ)
+		binary.Write(tiff, be, count)
+		binary.Write(tiff, be, value)
+	}
+	tiff.WriteString("MM")
+	binary.Write(tiff, be, uint16(42))
+	binary.Write(tiff, be, uint32(8))
+
+	binary.Write(tiff, be, uint16(2))
+	entry(exifOrientation, 3, 1, uint32(orientation)<<16)
+	entry(exifIFDPointer, 4, 1, sub)
+	binary.Write(tiff, be, uint32(0))
+
+	binary.Write(tiff, be, uint16(2))
+	entry(exifDateTimeOriginal, 2, uint32(len(taken)+1), text)
+	entry(exifOffsetTimeOriginal, 2, uint32(len(offset)+1), text+uint32(len(taken)+1))
+	binary.Write(tiff, be, uint32(0))
+	tiff.WriteString(taken + "\x00" + offset + "\x00")
+
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	rst := []byte{0xFF, 0xE1, 0, 0}
+	be.PutUint16(rst[2:], uint16(len(seg)+2))
+	return append(rst, seg...)
+}
+
+// returns a jpeg photo which is w by h, with the given exif segment.
+func testJPEG(t *testing.T, w, h int, exif []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	img.Set(0, 0, color.White)
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	return append(append([]byte{0xFF, 0xD8}, exif...), data[2:]...)
+}
+
+func TestReadExif(t *testing.T) {
+	data := testJPEG(t, 4, 2, testExif(6, "2016:03:01 09:30:00", "+03:00"))
+	x := readExif(data)
+	if x == nil {
+		t.Fatal("expected the exif metadata")
+	}
+	if x.Orientation != 6 {
+		t.Errorf("expected orientation 6 got %d", x.Orientation)
+	}
+	want := time.Date(2016, 3, 1, 6, 30, 0, 0, time.UTC)
+	if !x.TakenAt.Equal(want) {
+		t.Errorf("expected %v got %v", want, x.TakenAt)
+	}
+	if x = readExif(testJPEG(t, 4, 2, nil)); x != nil {
+		t.Errorf("expected no metadata got %v", x)
+	}
+	if x = readExif([]byte("not a jpeg")); x != nil {
+		t.Errorf("expected no metadata got %v", x)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.White)
+	sample := []struct {
+		orientation int
+		w, h, x, y  int
+	}{
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+	}
+	for _, v := range sample {
+		o := orientImage(img, v.orientation)
+		if b := o.Bounds(); b.Dx() != v.w || b.Dy() != v.h {
+			t.Errorf("orientation %d: expected %dx%d got %v", v.orientation, v.w, v.h, b)
+			continue
+		}
+		if r, _, _, _ := o.At(v.x, v.y).RGBA(); r != 0xffff {
+			t.Errorf("orientation %d: expected the white pixel at %d,%d", v.orientation, v.x, v.y)
+		}
+	}
+}
+
+func TestEncodePhotoExif(t *testing.T) {
+	f, err := ioutil.TempFile("", "aurora")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(testJPEG(t, 4, 2, testExif(6, "2016:03:01 09:30:00", "")))
+	f.Seek(0, 0)
+	var file multipart.File = f
+	data, info, err := encodePhoto(&FileUpload{Body: &file, Ext: "jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 2 || info.Height != 4 {
+		t.Errorf("expected the photo to be turned got %dx%d", info.Width, info.Height)
+	}
+	want := time.Date(2016, 3, 1, 9, 30, 0, 0, time.UTC)
+	if !info.TakenAt.Equal(want) {
+		t.Errorf("expected %v got %v", want, info.TakenAt)
+	}
+	if readExif(data) != nil {
+		t.Error("expected the metadata to be dropped")
+	}
+}
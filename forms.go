@@ -216,3 +216,121 @@ func ComposeProfileForm() gforms.ModelForm {
 		),
 	))
 }
+
+// holds the forgot password form data
+type forgotForm struct {
+	Email string `gforms:"email"`
+}
+
+// ComposeForgotForm builds a form for requesting a password reset link(with gforms)
+func ComposeForgotForm() gforms.ModelForm {
+	return gforms.DefineModelForm(forgotForm{}, gforms.NewFields(
+		gforms.NewTextField(
+			"email",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+				gforms.EmailValidator(MsgEmail),
+			},
+		),
+	))
+}
+
+// holds the password reset form data
+type resetForm struct {
+	Token       string `gforms:"token"`
+	Pass        string `gforms:"pass"`
+	ConfirmPass string `gforms:"confirm_pass"`
+}
+
+// ComposeResetForm builds a form for setting a new password(with gforms). The password
+// rules are the same as the ones of the registration form.
+func ComposeResetForm() gforms.ModelForm {
+	return gforms.DefineModelForm(resetForm{}, gforms.NewFields(
+		gforms.NewTextField(
+			"token",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+			},
+		),
+		gforms.NewTextField(
+			"pass",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+				IsName(),
+				gforms.MinLengthValidator(6, MsgMinLength),
+			},
+		),
+		gforms.NewTextField(
+			"confirm_pass",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+				IsName(),
+				gforms.MinLengthValidator(6, MsgMinLength),
+				EqualValidator{to: "pass", Message: MsgEqual},
+			},
+		),
+	))
+}
+
+// holds the change password form data
+type passwordForm struct {
+	Password    string `gforms:"password"`
+	Pass        string `gforms:"pass"`
+	ConfirmPass string `gforms:"confirm_pass"`
+}
+
+// ComposePasswordForm builds a form for changing the password(with gforms), the
+// current password is required.
+func ComposePasswordForm() gforms.ModelForm {
+	return gforms.DefineModelForm(passwordForm{}, gforms.NewFields(
+		gforms.NewTextField(
+			"password",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+			},
+		),
+		gforms.NewTextField(
+			"pass",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+				IsName(),
+				gforms.MinLengthValidator(6, MsgMinLength),
+			},
+		),
+		gforms.NewTextField(
+			"confirm_pass",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+				IsName(),
+				gforms.MinLengthValidator(6, MsgMinLength),
+				EqualValidator{to: "pass", Message: MsgEqual},
+			},
+		),
+	))
+}
+
+// holds the change email form data
+type emailForm struct {
+	Email    string `gforms:"email"`
+	Password string `gforms:"password"`
+}
+
+// ComposeEmailForm builds a form for changing the email address(with gforms), the
+// current password is required.
+func ComposeEmailForm() gforms.ModelForm {
+	return gforms.DefineModelForm(emailForm{}, gforms.NewFields(
+		gforms.NewTextField(
+			"email",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+				gforms.EmailValidator(MsgEmail),
+			},
+		),
+		gforms.NewTextField(
+			"password",
+			gforms.Validators{
+				gforms.Required(MsgRequired),
+			},
+		),
+	))
+}
@@ -0,0 +1,430 @@
+package aurora
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gernest/golem"
+	"github.com/gernest/nutz"
+)
+
+const (
+	// events sent by clients
+	groupCreateEvt  = "groupCreate"
+	groupInviteEvt  = "groupInvite"
+	groupLeaveEvt   = "groupLeave"
+	groupRoleEvt    = "groupRole"
+	groupSendEvt    = "groupSend"
+	groupHistoryEvt = "groupHistory"
+
+	// events sent to clients
+	groupEvt        = "group"
+	groupMessageEvt = "groupMessage"
+	groupFailedEvt  = "groupFailed"
+
+	// roles of group members
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+
+	// buckets in the groups database
+	groupsBucket        = "groups"
+	groupMessagesBucket = "messages"
+
+	// the bucket in the profile database which lists the groups of the profile.
+	profileGroupsBucket = "groups"
+)
+
+var (
+	errNotMember  = errors.New("du! wewe sio mwanachama wa kundi hili")
+	errGroupName  = errors.New("du! kundi linahitaji jina")
+	errBadRole    = errors.New("aurora: unknown group role")
+	errSameMember = errors.New("du! tayari ni mwanachama wa kundi hili")
+)
+
+// Group is a chat room created by a user. Members maps the profile id of every
+// member to the member's role.
+type Group struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	Members   map[string]string `json:"members"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// GroupRequest is the data of the group websocket events.
+type GroupRequest struct {
+	GroupID   string   `json:"group_id"`
+	Name      string   `json:"name"`
+	Members   []string `json:"members"`
+	ProfileID string   `json:"profile_id"`
+	Role      string   `json:"role"`
+}
+
+func (g *Group) isMember(id string) bool {
+	_, ok := g.Members[id]
+	return ok
+}
+
+// admins are allowed to invite new members, the owner is an admin too.
+func (g *Group) isAdmin(id string) bool {
+	r := g.Members[id]
+	return r == roleOwner || r == roleAdmin
+}
+
+// returns the ids of the members, sorted.
+func (g *Group) memberIDs() []string {
+	var rst []string
+	for k := range g.Members {
+		rst = append(rst, k)
+	}
+	sort.Strings(rst)
+	return rst
+}
+
+// returns the database where groups and their messages are stored.
+func (m *Messenger) groupsDB() nutz.Storage {
+	name := m.rx.cfg.GroupsDB
+	if name == "" {
+		name = filepath.Join(m.rx.cfg.DBDir, "groups"+m.rx.cfg.DBExtension)
+	}
+	return setDB(m.rx.db, name)
+}
+
+func (m *Messenger) getGroup(id string) (*Group, error) {
+	g := &Group{}
+	if err := getAndUnmarshall(m.groupsDB(), groupsBucket, id, g); err != nil {
+		return nil, errNotFound
+	}
+	return g, nil
+}
+
+// saves the group, and updates the list of groups of the given profiles. Profiles
+// which are no longer members are removed from the group.
+func (m *Messenger) saveGroup(g *Group, profiles ...string) error {
+	g.UpdatedAt = time.Now()
+	if err := marshalAndCreate(m.groupsDB(), g, groupsBucket, g.ID); err != nil {
+		return err
+	}
+	for _, id := range profiles {
+		pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, id, m.rx.cfg.DBExtension))
+		if role, ok := g.Members[id]; ok {
+			if s := pdb.Create(profileGroupsBucket, g.ID, []byte(role)); s.Error != nil {
+				return s.Error
+			}
+			continue
+		}
+		pdb.Delete(profileGroupsBucket, g.ID)
+	}
+	return nil
+}
+
+// creates a new group owned by owner, with the given members.
+func (m *Messenger) createGroup(owner, name string, members []string) (*Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errGroupName
+	}
+	now := time.Now()
+	g := &Group{
+		ID:        getUUID(),
+		Name:      name,
+		Owner:     owner,
+		Members:   map[string]string{owner: roleOwner},
+		CreatedAt: now,
+	}
+	for _, v := range members {
+		if v != owner && m.rx.profileExists(v) {
+			g.Members[v] = roleMember
+		}
+	}
+	m.groupMu.Lock()
+	defer m.groupMu.Unlock()
+	if err := m.saveGroup(g, g.memberIDs()...); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// adds profileID to the group, only admins can invite.
+func (m *Messenger) inviteToGroup(actor, groupID, profileID string) (*Group, error) {
+	m.groupMu.Lock()
+	defer m.groupMu.Unlock()
+	g, err := m.getGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !g.isAdmin(actor) {
+		return nil, errForbidden
+	}
+	if g.isMember(profileID) {
+		return nil, errSameMember
+	}
+	if !m.rx.profileExists(profileID) {
+		return nil, errNotFound
+	}
+	g.Members[profileID] = roleMember
+	if err = m.saveGroup(g, profileID); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// removes profileID from the group. When the owner leaves, the ownership goes to an
+// admin, or to any member if there is no admin. The group is deleted when the last
+// member leaves.
+func (m *Messenger) leaveGroup(profileID, groupID string) (*Group, error) {
+	m.groupMu.Lock()
+	defer m.groupMu.Unlock()
+	g, err := m.getGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !g.isMember(profileID) {
+		return nil, errNotMember
+	}
+	delete(g.Members, profileID)
+	if len(g.Members) == 0 {
+		gdb := m.groupsDB()
+		for k := range gdb.GetAll(groupMessagesBucket, g.ID).DataList {
+			gdb.Delete(groupMessagesBucket, k, g.ID)
+		}
+		gdb.Delete(groupsBucket, g.ID)
+		pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+		pdb.Delete(profileGroupsBucket, g.ID)
+		return g, nil
+	}
+	changed := []string{profileID}
+	if g.Owner == profileID {
+		next := ""
+		for _, id := range g.memberIDs() {
+			if g.Members[id] == roleAdmin {
+				next = id
+				break
+			}
+		}
+		if next == "" {
+			next = g.memberIDs()[0]
+		}
+		g.Owner = next
+		g.Members[next] = roleOwner
+		changed = append(changed, next)
+	}
+	if err = m.saveGroup(g, changed...); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// sets the role of a member, only the owner can do this. The owner role can't be
+// given away, except by leaving the group.
+func (m *Messenger) setGroupRole(actor, groupID, profileID, role string) (*Group, error) {
+	if role != roleAdmin && role != roleMember {
+		return nil, errBadRole
+	}
+	m.groupMu.Lock()
+	defer m.groupMu.Unlock()
+	g, err := m.getGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if g.Owner != actor || profileID == actor {
+		return nil, errForbidden
+	}
+	if !g.isMember(profileID) {
+		return nil, errNotMember
+	}
+	g.Members[profileID] = role
+	if err = m.saveGroup(g, profileID); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// stores the message in the group history and sends it to the members. Members who
+// are offline get a copy in their inbox, like with direct messages.
+func (m *Messenger) sendToGroup(sender *Profile, msg *MSG) error {
+	g, err := m.getGroup(msg.GroupID)
+	if err != nil {
+		return err
+	}
+	if !g.isMember(sender.ID) {
+		return errNotMember
+	}
+	if msg.Envelope != nil {
+		// there is no key agreement for groups yet.
+		return errBadForm
+	}
+	msg.ID = getUUID()
+	msg.SenderID = sender.ID
+	msg.RecipientID = ""
+	msg.ConversationID = g.ID
+	msg.SenderName = fmt.Sprintf("%s %s", sender.FirstName, sender.LastName)
+	msg.SentAt = time.Now()
+	msg.Status = http.StatusOK
+	resetEdits(msg)
+	if err = m.attach(sender.ID, msg); err != nil {
+		return err
+	}
+
+	// only the other members can be mentioned.
+	mentioned := make(map[string]bool)
+	var mentions []string
+	for _, id := range msg.Mentions {
+		if id != sender.ID && g.isMember(id) && !mentioned[id] {
+			mentioned[id] = true
+			mentions = append(mentions, id)
+		}
+	}
+	msg.Mentions = mentions
+	if err = marshalAndCreate(m.groupsDB(), msg, groupMessagesBucket, msg.ID, g.ID); err != nil {
+		return err
+	}
+	for _, id := range g.memberIDs() {
+		// like direct messages, members who blocked the sender don't get it.
+		if m.isBlocked(id, sender.ID) {
+			continue
+		}
+		if m.isOnline(id) {
+			m.emit(id, groupMessageEvt, msg)
+			continue
+		}
+		if err = m.saveMsg(inboxBucket, id, msg); err != nil {
+			log.Println(err)
+		}
+		switch {
+		case id == sender.ID:
+		case mentioned[id]:
+			m.notify(id, newNotification(notifyMention, msg))
+		default:
+			m.notify(id, newNotification(notifyMessage, msg))
+		}
+	}
+	return nil
+}
+
+// returns a page of the history of the group, only members can see it.
+func (m *Messenger) groupHistory(profileID, groupID, cursor string, limit int) (*History, error) {
+	g, err := m.getGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !g.isMember(profileID) {
+		return nil, errNotMember
+	}
+	var msgs []*MSG
+	all := m.groupsDB().GetAll(groupMessagesBucket, g.ID)
+	for _, v := range all.DataList {
+		msg := &MSG{}
+		if err := json.Unmarshal(v, msg); err == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	msgs = m.withoutBlocked(profileID, withoutHidden(msgs, m.hiddenMsgs(profileID)))
+	h, err := pageMessages(msgs, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	h.With = g.ID
+	return h, nil
+}
+
+// returns the groups profileID is a member of, sorted by name.
+func (m *Messenger) userGroups(profileID string) ([]*Group, error) {
+	rst := []*Group{}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	all := pdb.GetAll(profileGroupsBucket)
+	for id := range all.DataList {
+		g, err := m.getGroup(id)
+		if err != nil || !g.isMember(profileID) {
+			continue
+		}
+		rst = append(rst, g)
+	}
+	sort.Sort(byGroupName(rst))
+	return rst, nil
+}
+
+type byGroupName []*Group
+
+func (s byGroupName) Len() int           { return len(s) }
+func (s byGroupName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byGroupName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// tells every member, and anyone else given, about the current state of the group.
+func (m *Messenger) emitGroup(g *Group, others ...string) {
+	for _, id := range append(g.memberIDs(), others...) {
+		m.emit(id, groupEvt, g)
+	}
+}
+
+func (m *Messenger) groupFailed(conn *golem.Connection, evt string, err error) {
+	conn.Emit(groupFailedEvt, &InfoMSG{Title: evt, Body: err.Error()})
+}
+
+func (m *Messenger) onGroupCreate(conn *golem.Connection, req *GroupRequest) {
+	g, err := m.createGroup(conn.UserID, req.Name, req.Members)
+	if err != nil {
+		m.groupFailed(conn, groupCreateEvt, err)
+		return
+	}
+	m.emitGroup(g)
+}
+
+func (m *Messenger) onGroupInvite(conn *golem.Connection, req *GroupRequest) {
+	g, err := m.inviteToGroup(conn.UserID, req.GroupID, req.ProfileID)
+	if err != nil {
+		m.groupFailed(conn, groupInviteEvt, err)
+		return
+	}
+	m.emitGroup(g)
+}
+
+func (m *Messenger) onGroupLeave(conn *golem.Connection, req *GroupRequest) {
+	g, err := m.leaveGroup(conn.UserID, req.GroupID)
+	if err != nil {
+		m.groupFailed(conn, groupLeaveEvt, err)
+		return
+	}
+	m.emitGroup(g, conn.UserID)
+}
+
+func (m *Messenger) onGroupRole(conn *golem.Connection, req *GroupRequest) {
+	g, err := m.setGroupRole(conn.UserID, req.GroupID, req.ProfileID, req.Role)
+	if err != nil {
+		m.groupFailed(conn, groupRoleEvt, err)
+		return
+	}
+	m.emitGroup(g)
+}
+
+func (m *Messenger) onGroupSend(conn *golem.Connection, msg *MSG) {
+	p := m.currentUser(conn)
+	if p == nil {
+		m.groupFailed(conn, groupSendEvt, errForbidden)
+		return
+	}
+	if !m.allowSend(conn) {
+		m.groupFailed(conn, groupSendEvt, errRateLimited)
+		return
+	}
+	if err := m.sendToGroup(p, msg); err != nil {
+		m.groupFailed(conn, groupSendEvt, err)
+	}
+}
+
+func (m *Messenger) onGroupHistory(conn *golem.Connection, req *HistoryRequest) {
+	h, err := m.groupHistory(conn.UserID, req.With, req.Before, req.Limit)
+	if err != nil {
+		h = &History{With: req.With, Error: err.Error()}
+	}
+	conn.Emit(groupHistoryEvt, h)
+}
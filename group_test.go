@@ -0,0 +1,204 @@
+package aurora
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGroups(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		owner  = "owner"
+		admin  = "admin"
+		member = "member"
+		guest  = "guest"
+	)
+	for _, id := range []string{owner, admin, member, guest} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.createGroup(owner, " ", nil); err != errGroupName {
+		t.Errorf("expected %v got %v", errGroupName, err)
+	}
+	g, err := m.createGroup(owner, "marafiki", []string{admin, member, "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Members) != 3 || g.Members[owner] != roleOwner {
+		t.Errorf("expected 3 members with %s as owner got %v", owner, g.Members)
+	}
+
+	// only the owner sets roles, only admins invite
+	if _, err = m.setGroupRole(member, g.ID, admin, roleAdmin); err != errForbidden {
+		t.Errorf("expected %v got %v", errForbidden, err)
+	}
+	if _, err = m.setGroupRole(owner, g.ID, admin, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.inviteToGroup(member, g.ID, guest); err != errForbidden {
+		t.Errorf("expected %v got %v", errForbidden, err)
+	}
+	if _, err = m.inviteToGroup(admin, g.ID, guest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.inviteToGroup(admin, g.ID, guest); err != errSameMember {
+		t.Errorf("expected %v got %v", errSameMember, err)
+	}
+
+	// members who are offline get the message in their inbox
+	m.online.Add(owner, 0, owner)
+	defer m.online.Delete(owner)
+	sender := &Profile{ID: member, FirstName: member}
+	forged := &MSG{GroupID: g.ID, Text: "habari", Deleted: true, EditedAt: time.Now(), Edits: []*MSGEdit{{Text: "uongo"}}}
+	if err = m.sendToGroup(sender, forged); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.sendToGroup(&Profile{ID: "nobody"}, &MSG{GroupID: g.ID, Text: "habari"}); err != errNotMember {
+		t.Errorf("expected %v got %v", errNotMember, err)
+	}
+	gdb := setDB(m.rx.db, getProfileDatabase(dir, guest, m.rx.cfg.DBExtension))
+	if n := len(gdb.GetAll(inboxBucket, m.rx.cfg.MessagesBucket).DataList); n != 1 {
+		t.Errorf("expected 1 message in the inbox of %s got %d", guest, n)
+	}
+	odb := setDB(m.rx.db, getProfileDatabase(dir, owner, m.rx.cfg.DBExtension))
+	if n := len(odb.GetAll(inboxBucket, m.rx.cfg.MessagesBucket).DataList); n != 0 {
+		t.Errorf("expected no message in the inbox of %s got %d", owner, n)
+	}
+	h, err := m.groupHistory(guest, g.ID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 1 || h.Messages[0].Text != "habari" || h.Messages[0].SenderID != member {
+		t.Errorf("expected the message in the history got %v", h.Messages)
+	}
+	if v := h.Messages[0]; v.Deleted || len(v.Edits) != 0 || !v.EditedAt.IsZero() {
+		t.Errorf("expected the edits sent by the client to be dropped got %v", v)
+	}
+	if _, err = m.groupHistory("nobody", g.ID, "", 0); err != errNotMember {
+		t.Errorf("expected %v got %v", errNotMember, err)
+	}
+
+	// members who blocked the sender don't get the message, nor see it
+	if _, err = m.block(guest, member); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.sendToGroup(sender, &MSG{GroupID: g.ID, Text: "habari tena"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(gdb.GetAll(inboxBucket, m.rx.cfg.MessagesBucket).DataList); n != 1 {
+		t.Errorf("expected 1 message in the inbox of %s got %d", guest, n)
+	}
+	if h, err = m.groupHistory(guest, g.ID, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 0 {
+		t.Errorf("expected no messages from %s got %v", member, h.Messages)
+	}
+	if err = m.unblock(guest, member); err != nil {
+		t.Fatal(err)
+	}
+
+	// the admin takes over when the owner leaves
+	if _, err = m.leaveGroup(owner, g.ID); err != nil {
+		t.Fatal(err)
+	}
+	g, err = m.getGroup(g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Owner != admin || g.Members[admin] != roleOwner || g.isMember(owner) {
+		t.Errorf("expected %s to be the owner got %v", admin, g)
+	}
+	list, err := m.userGroups(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected no groups got %d", len(list))
+	}
+	list, err = m.userGroups(guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != g.ID {
+		t.Errorf("expected the group got %v", list)
+	}
+
+	// the group is gone when the last member leaves
+	for _, id := range []string{admin, member, guest} {
+		if _, err = m.leaveGroup(id, g.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = m.getGroup(g.ID); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+}
+
+// a pusher which passes the notifications it is given to a channel.
+type chanPusher chan *Notification
+
+func (p chanPusher) Push(sub *PushSubscription, payload []byte) error {
+	n := &Notification{}
+	if err := json.Unmarshal(payload, n); err != nil {
+		return err
+	}
+	p <- n
+	return nil
+}
+
+func TestGroupNotify(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		owner  = "owner"
+		member = "member"
+		guest  = "guest"
+	)
+	for _, id := range []string{owner, member, guest} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := m.createGroup(owner, "marafiki", []string{member, guest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make(chanPusher, 10)
+	m.push = p
+	for _, id := range []string{owner, member, guest} {
+		if _, err = m.subscribe(id, newTestDevice(t).subscription("https://push.example.com/"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every member who is offline is told, the mentioned ones about the mention
+	msg := &MSG{GroupID: g.ID, Text: "habari", Mentions: []string{guest}}
+	if err = m.sendToGroup(&Profile{ID: owner, FirstName: owner}, msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-p:
+			got[n.Kind] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected 2 notifications got %d", i)
+		}
+	}
+	if !got[notifyMessage] || !got[notifyMention] {
+		t.Errorf("expected a message and a mention got %v", got)
+	}
+	select {
+	case n := <-p:
+		t.Errorf("expected no notification for the sender got %v", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
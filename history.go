@@ -0,0 +1,197 @@
+package aurora
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gernest/golem"
+	"github.com/gernest/nutz"
+)
+
+const (
+	historyEvt = "history"
+
+	// the number of messages in a page of history, unless asked otherwise.
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+var errBadCursor = errors.New("aurora: bad cursor")
+
+// History is a page of a conversation between two users. Messages are ordered from
+// the oldest to the newest, Next is the cursor for the page of older messages and it
+// is empty when there is nothing older.
+type History struct {
+	With     string `json:"with"`
+	Messages []*MSG `json:"messages"`
+	Next     string `json:"next,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HistoryRequest is the data of the history websocket event.
+type HistoryRequest struct {
+	With   string `json:"with"`
+	Before string `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+// replies to the connection with a page of the conversation with req.With.
+func (m *Messenger) history(conn *golem.Connection, req *HistoryRequest) {
+	h, err := m.conversation(conn.UserID, req.With, req.Before, req.Limit)
+	if err != nil {
+		h = &History{With: req.With, Error: err.Error()}
+	}
+	conn.Emit(historyEvt, h)
+}
+
+// returns a page of the conversation between the profiles me and other, the page
+// ends just before the cursor.
+//
+// Each message is stored in the databases of both the sender and the recipient, but
+// depending on whether the recipient was online only one of the copies might be
+// there. So both databases are searched, and the copies are merged.
+func (m *Messenger) conversation(me, other, cursor string, limit int) (*History, error) {
+	if !m.rx.profileExists(me) || !m.rx.profileExists(other) {
+		return nil, errNotFound
+	}
+	mine := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, me, m.rx.cfg.DBExtension))
+	theirs := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, other, m.rx.cfg.DBExtension))
+	all := collectMessages(mine, m.rx.cfg.MessagesBucket, me, other,
+		inboxBucket, outboxBucket, readBucket, draftBucket)
+
+	// drafts are messages which failed to be delivered, the other user's drafts are
+	// none of our business.
+	all = append(all, collectMessages(theirs, m.rx.cfg.MessagesBucket, me, other,
+		inboxBucket, outboxBucket, readBucket)...)
+
+	// the messages of a blocked profile are only in the databases of the sender,
+	// they shouldn't show up through the merge.
+	all = m.withoutBlocked(me, withoutHidden(all, m.hiddenMsgs(me)))
+	h, err := pageMessages(all, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	h.With = other
+	return h, nil
+}
+
+// returns the messages exchanged between a and b, found in the given buckets.
+func collectMessages(db nutz.Storage, msgBucket, a, b string, buckets ...string) []*MSG {
+	var rst []*MSG
+	for _, bucket := range buckets {
+		all := db.GetAll(bucket, msgBucket)
+		if all.Error != nil {
+			continue
+		}
+		for _, v := range all.DataList {
+			msg := &MSG{}
+			if err := json.Unmarshal(v, msg); err != nil {
+				continue
+			}
+			if (msg.SenderID == a && msg.RecipientID == b) || (msg.SenderID == b && msg.RecipientID == a) {
+				rst = append(rst, msg)
+			}
+		}
+	}
+	return rst
+}
+
+// sorts the messages by the time they were sent, removes duplicates and returns the
+// limit messages which come just before the cursor. An empty cursor means the newest
+// messages.
+func pageMessages(msgs []*MSG, cursor string, limit int) (*History, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	seen := make(map[string]bool)
+	var uniq []*MSG
+	for _, v := range msgs {
+		if seen[v.ID] {
+			continue
+		}
+		seen[v.ID] = true
+		uniq = append(uniq, v)
+	}
+	sort.Sort(bySentAt(uniq))
+
+	end := len(uniq)
+	if cursor != "" {
+		at, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		end = sort.Search(len(uniq), func(i int) bool {
+			return !msgBefore(uniq[i], at, id)
+		})
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	h := &History{Messages: uniq[start:end]}
+	if h.Messages == nil {
+		h.Messages = []*MSG{}
+	}
+	if start > 0 {
+		h.Next = encodeCursor(uniq[start])
+	}
+	return h, nil
+}
+
+// returns true if msg comes before the message sent at the given time with the
+// given id. Messages sent at the same time are ordered by id.
+func msgBefore(msg *MSG, at time.Time, id string) bool {
+	if msg.SentAt.Equal(at) {
+		return msg.ID < id
+	}
+	return msg.SentAt.Before(at)
+}
+
+type bySentAt []*MSG
+
+func (s bySentAt) Len() int           { return len(s) }
+func (s bySentAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySentAt) Less(i, j int) bool { return msgBefore(s[i], s[j].SentAt, s[j].ID) }
+
+// cursors are opaque to clients, they point to a message by the time it was sent
+// and its id.
+func encodeCursor(msg *MSG) string {
+	c := fmt.Sprintf("%d:%s", msg.SentAt.UnixNano(), msg.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(c))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errBadCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errBadCursor
+	}
+	n, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", errBadCursor
+	}
+	return time.Unix(0, n), parts[1], nil
+}
+
+// checks if there is a profile with the given id, without creating its database
+// as opening it would.
+func (rx *Remix) profileExists(id string) bool {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+		return false
+	}
+	_, err := os.Stat(getProfileDatabase(rx.cfg.DBDir, id, rx.cfg.DBExtension))
+	return err == nil
+}
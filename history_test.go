@@ -0,0 +1,164 @@
+package aurora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPageMessages(t *testing.T) {
+	now := time.Now()
+	var msgs []*MSG
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, &MSG{ID: fmt.Sprintf("msg%d", i), SentAt: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	// the copies of a message in the sender's and the recipient's databases
+	all := append([]*MSG{msgs[3], msgs[1], msgs[4]}, msgs...)
+
+	h, err := pageMessages(all, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Messages) != 2 || h.Messages[0].ID != "msg3" || h.Messages[1].ID != "msg4" {
+		t.Errorf("expected msg3 and msg4 got %v", h.Messages)
+	}
+	var ids []string
+	for h.Next != "" {
+		h, err = pageMessages(all, h.Next, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range h.Messages {
+			ids = append(ids, v.ID)
+		}
+	}
+	if fmt.Sprint(ids) != "[msg1 msg2 msg0]" {
+		t.Errorf("expected [msg1 msg2 msg0] got %v", ids)
+	}
+
+	// messages sent at the same time are ordered by id
+	same := []*MSG{{ID: "b", SentAt: now}, {ID: "a", SentAt: now}, {ID: "c", SentAt: now}}
+	h, err = pageMessages(same, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = pageMessages(same, h.Next, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Messages[0].ID != "b" {
+		t.Errorf("expected b got %s", h.Messages[0].ID)
+	}
+
+	if _, err = pageMessages(all, "bogus", 2); err != errBadCursor {
+		t.Errorf("expected %v got %v", errBadCursor, err)
+	}
+	h, err = pageMessages(nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Messages == nil || h.Next != "" {
+		t.Errorf("expected an empty page got %v", h)
+	}
+}
+
+func TestRemix_Conversation(t *testing.T) {
+	var (
+		email = "history@aurora.com"
+		pass  = "mamamia"
+		me    = "2b1f4c1e-0d3a-4f6e-8e6a-6c0f1f3e9a01"
+		other = "2b1f4c1e-0d3a-4f6e-8e6a-6c0f1f3e9a02"
+		third = "2b1f4c1e-0d3a-4f6e-8e6a-6c0f1f3e9a03"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+
+	ps, err := hashPassword(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CreateAccount(setDB(rx.db, rx.cfg.AccountsDB), &User{UUID: me, EmailAddress: email, Pass: ps}, rx.cfg.AccountsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{me, other, third} {
+		pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, id, rx.cfg.DBExtension))
+		if err = CreateProfile(pdb, &Profile{ID: id}, rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		sent := &MSG{ID: fmt.Sprintf("sent%d", i), SenderID: me, RecipientID: other, SentAt: now.Add(time.Duration(2*i) * time.Second)}
+		if err = rx.msg.saveMsg(outboxBucket, me, sent); err != nil {
+			t.Fatal(err)
+		}
+		if err = rx.msg.saveMsg(inboxBucket, other, sent); err != nil {
+			t.Fatal(err)
+		}
+		got := &MSG{ID: fmt.Sprintf("got%d", i), SenderID: other, RecipientID: me, SentAt: now.Add(time.Duration(2*i+1) * time.Second)}
+		if err = rx.msg.saveMsg(outboxBucket, other, got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noise := &MSG{ID: "noise", SenderID: third, RecipientID: me, SentAt: now}
+	if err = rx.msg.saveMsg(inboxBucket, me, noise); err != nil {
+		t.Fatal(err)
+	}
+
+	convURL := fmt.Sprintf("%s%s/conversations/%s", ts.URL, apiPrefix, other)
+	res, err := httpGet(client, convURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusUnauthorized)
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+"/auth/login", url.Values{"email": {email}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	var ids []string
+	next := ""
+	for {
+		res, err = httpGet(client, convURL+"?limit=4&before="+next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		h := &History{}
+		if err = json.Unmarshal(b, h); err != nil {
+			t.Fatalf("decoding %s: %v", b, err)
+		}
+		var page []string
+		for _, v := range h.Messages {
+			page = append(page, v.ID)
+		}
+		ids = append(page, ids...)
+		if h.Next == "" {
+			break
+		}
+		next = h.Next
+	}
+	if fmt.Sprint(ids) != "[sent0 got0 sent1 got1 sent2 got2]" {
+		t.Errorf("expected the whole conversation got %v", ids)
+	}
+
+	res, err = httpGet(client, fmt.Sprintf("%s%s/conversations/%s", ts.URL, apiPrefix, "nobody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+}
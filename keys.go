@@ -0,0 +1,350 @@
+package aurora
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// the bucket in the profile database holding the public keys the clients of the
+	// profile published, for end to end encrypted messages. It looks like this
+	//
+	//	keys
+	//	    |---bundle the identity key and the signed pre key
+	//	    |---prekeys
+	//	              |---<id> a one time pre key
+	keysBucket    = "keys"
+	bundleKey     = "bundle"
+	preKeysBucket = "prekeys"
+
+	// sent to the contacts of a profile when its identity key changes, or it stops
+	// using end to end encryption.
+	keysChangedEvt = "keysChanged"
+
+	// limits on what is published to the key directory.
+	maxPublicKeySize  = 256
+	maxOneTimeKeys    = 100
+	maxCiphertextSize = 64 << 10 // 64KB
+
+	// the number of bundles a profile can fetch in a minute, every fetch uses up a
+	// one time key of the other profile.
+	defaultKeyClaimLimit = 30
+)
+
+var (
+	errNoKeys       = errors.New("du! mpokeaji hajawasha usimbaji fiche")
+	errBadKey       = errors.New("du! ufunguo huu si sahihi")
+	errTooManyKeys  = errors.New("du! funguo ni nyingi mno")
+	errPlaintext    = errors.New("du! ujumbe uliosimbwa hauwezi kuwa na maandishi wala viambatisho")
+	errEncryptedMsg = errors.New("du! ujumbe uliosimbwa unahitaji bahasha mpya")
+)
+
+// PreKey is a public key the clients use to agree on the keys of a conversation. Keys
+// and signatures are base64 encoded, the server never looks into them.
+type PreKey struct {
+	ID        int    `json:"id"`
+	Key       string `json:"key"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// KeyBundle is the entry of a profile in the key directory.
+//
+// When publishing, OneTimeKeys are added to the ones which are left. A new identity
+// key replaces everything, and the contacts of the profile are told about it.
+//
+// When fetched by another profile, OneTimeKey is one of the one time keys, which is
+// given out only once. Remaining is the number of one time keys left, clients should
+// publish more when it gets low.
+type KeyBundle struct {
+	ProfileID    string    `json:"profile_id"`
+	IdentityKey  string    `json:"identity_key"`
+	SignedPreKey *PreKey   `json:"signed_pre_key"`
+	OneTimeKeys  []*PreKey `json:"one_time_keys,omitempty"`
+	OneTimeKey   *PreKey   `json:"one_time_key,omitempty"`
+	Remaining    int       `json:"remaining"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Envelope is the content of an end to end encrypted message. The server stores and
+// relays it as it is, the message itself has no text.
+//
+// IdentityKey is the identity key of the sender. The first message of a conversation
+// also has the ephemeral key of the sender and the ids of the pre keys of the
+// recipient which were used, so that the recipient can work out the same keys.
+type Envelope struct {
+	Ciphertext     string `json:"ciphertext"`
+	IdentityKey    string `json:"identity_key"`
+	EphemeralKey   string `json:"ephemeral_key,omitempty"`
+	SignedPreKeyID int    `json:"signed_pre_key_id,omitempty"`
+	OneTimeKeyID   int    `json:"one_time_key_id,omitempty"`
+}
+
+// checks that s is a base64 encoded key of a sane size.
+func checkKey(s string) error {
+	if s == "" || len(s) > maxPublicKeySize {
+		return errBadKey
+	}
+	if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+		return errBadKey
+	}
+	return nil
+}
+
+// checks the envelope of an encrypted message. The server can't read it, but it
+// makes sure nothing is sent in the clear next to it.
+func checkEnvelope(msg *MSG) error {
+	e := msg.Envelope
+	if e == nil {
+		return nil
+	}
+	if msg.Text != "" || len(msg.Attachments) > 0 {
+		return errPlaintext
+	}
+	if e.Ciphertext == "" || len(e.Ciphertext) > maxCiphertextSize {
+		return errBadForm
+	}
+	if _, err := base64.StdEncoding.DecodeString(e.Ciphertext); err != nil {
+		return errBadForm
+	}
+	if err := checkKey(e.IdentityKey); err != nil {
+		return err
+	}
+	if e.EphemeralKey != "" {
+		return checkKey(e.EphemeralKey)
+	}
+	return nil
+}
+
+// checks an encrypted direct message before it is sent, the recipient must be able
+// to read it.
+func (m *Messenger) checkEncrypted(msg *MSG) error {
+	if msg.Envelope == nil {
+		return nil
+	}
+	if err := checkEnvelope(msg); err != nil {
+		return err
+	}
+	if _, err := m.getBundle(msg.RecipientID); err != nil {
+		return errNoKeys
+	}
+	return nil
+}
+
+// returns the identity key and signed pre key of the profile, without one time keys.
+func (m *Messenger) getBundle(profileID string) (*KeyBundle, error) {
+	if !m.rx.profileExists(profileID) {
+		return nil, errNotFound
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	b := &KeyBundle{}
+	if err := getAndUnmarshall(pdb, keysBucket, bundleKey, b); err != nil || b.SignedPreKey == nil {
+		return nil, errNotFound
+	}
+	b.Remaining = len(pdb.GetAll(preKeysBucket, keysBucket).DataList)
+	return b, nil
+}
+
+// adds the keys to the key directory entry of the profile. Publishing a new signed
+// pre key rotates it, publishing a new identity key starts over.
+func (m *Messenger) publishKeys(profileID string, req *KeyBundle) (*KeyBundle, error) {
+	if err := checkKey(req.IdentityKey); err != nil {
+		return nil, err
+	}
+	if req.SignedPreKey == nil || req.SignedPreKey.Signature == "" {
+		return nil, errBadKey
+	}
+	if err := checkKey(req.SignedPreKey.Key); err != nil {
+		return nil, err
+	}
+	if len(req.OneTimeKeys) > maxOneTimeKeys {
+		return nil, errTooManyKeys
+	}
+	for _, k := range req.OneTimeKeys {
+		if k == nil {
+			return nil, errBadKey
+		}
+		if err := checkKey(k.Key); err != nil {
+			return nil, err
+		}
+	}
+	m.keyMu.Lock()
+	defer m.keyMu.Unlock()
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	old, err := m.getBundle(profileID)
+	changed := err == nil && old.IdentityKey != req.IdentityKey
+	if changed {
+		// the one time keys go with the identity key they were made for.
+		for id := range pdb.GetAll(preKeysBucket, keysBucket).DataList {
+			pdb.Delete(preKeysBucket, id, keysBucket)
+		}
+	} else if err == nil && old.Remaining+len(req.OneTimeKeys) > maxOneTimeKeys {
+		return nil, errTooManyKeys
+	}
+	for _, k := range req.OneTimeKeys {
+		if err = marshalAndCreate(pdb, k, preKeysBucket, strconv.Itoa(k.ID), keysBucket); err != nil {
+			return nil, err
+		}
+	}
+	b := &KeyBundle{
+		ProfileID:    profileID,
+		IdentityKey:  req.IdentityKey,
+		SignedPreKey: req.SignedPreKey,
+		UpdatedAt:    time.Now(),
+	}
+	if err = marshalAndCreate(pdb, b, keysBucket, bundleKey); err != nil {
+		return nil, err
+	}
+	if changed {
+		m.keysChanged(b)
+	}
+	return m.getBundle(profileID)
+}
+
+// removes the profile from the key directory, it can't get encrypted messages
+// anymore.
+func (m *Messenger) removeKeys(profileID string) error {
+	m.keyMu.Lock()
+	defer m.keyMu.Unlock()
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if _, err := m.getBundle(profileID); err != nil {
+		return err
+	}
+	for id := range pdb.GetAll(preKeysBucket, keysBucket).DataList {
+		pdb.Delete(preKeysBucket, id, keysBucket)
+	}
+	if err := pdb.Delete(keysBucket, bundleKey).Error; err != nil {
+		return err
+	}
+	m.keysChanged(&KeyBundle{ProfileID: profileID, UpdatedAt: time.Now()})
+	return nil
+}
+
+// returns the bundle of the profile for starting an encrypted conversation with it,
+// with one of its one time keys which is removed from the directory. There might be
+// none left, the signed pre key is enough on its own.
+func (m *Messenger) claimKeys(profileID string) (*KeyBundle, error) {
+	m.keyMu.Lock()
+	defer m.keyMu.Unlock()
+	b, err := m.getBundle(profileID)
+	if err != nil {
+		return nil, err
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	all := pdb.GetAll(preKeysBucket, keysBucket).DataList
+	var ids []string
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var k *PreKey
+		if err = pdb.Delete(preKeysBucket, id, keysBucket).Error; err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(all[id], &k); err != nil || k == nil || k.Key == "" {
+			// keys stored before they were checked, nobody can use them.
+			b.Remaining--
+			continue
+		}
+		b.OneTimeKey = k
+		b.Remaining--
+		break
+	}
+	return b, nil
+}
+
+// tells the contacts of the profile that its keys changed, their clients should warn
+// about it before sending anything else.
+func (m *Messenger) keysChanged(b *KeyBundle) {
+	for _, id := range m.contacts(b.ProfileID) {
+		if m.isOnline(id) {
+			m.emit(id, keysChangedEvt, b)
+		}
+	}
+}
+
+// APIKeys returns the key directory entry of the current user. A PUT request with a
+// json encoded KeyBundle publishes keys, and a DELETE request removes the entry.
+func (rx *Remix) APIKeys(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		if err = rx.msg.removeKeys(p.ID); err != nil {
+			rx.apiErr(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "PUT":
+		req := &KeyBundle{}
+		if err = json.NewDecoder(r.Body).Decode(req); err != nil {
+			rx.apiErr(w, http.StatusBadRequest, errBadForm)
+			return
+		}
+		b, err := rx.msg.publishKeys(p.ID, req)
+		switch err {
+		case nil:
+			rx.rendr.JSON(w, http.StatusOK, b)
+		case errBadKey, errTooManyKeys:
+			rx.apiErr(w, http.StatusBadRequest, err)
+		default:
+			log.Println(err)
+			rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		}
+	default:
+		b, err := rx.msg.getBundle(p.ID)
+		if err != nil {
+			rx.apiErr(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		rx.rendr.JSON(w, http.StatusOK, b)
+	}
+}
+
+// APIClaimKeys returns the keys for starting an encrypted conversation with the
+// profile with the id given in the url. Every request uses up one of its one time
+// keys, so they are rate limited.
+func (rx *Remix) APIClaimKeys(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if !rx.msg.keyClaimLimit.allow(p.ID, defaultKeyClaimLimit, time.Minute, time.Now()) {
+		rx.apiErr(w, http.StatusTooManyRequests, errRateLimited)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if rx.msg.isBlocked(id, p.ID) {
+		// blocked profiles can't tell the difference.
+		rx.apiErr(w, http.StatusNotFound, errNoKeys)
+		return
+	}
+	b, err := rx.msg.claimKeys(id)
+	if err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNoKeys)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, b)
+}
@@ -0,0 +1,149 @@
+package aurora
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+)
+
+func testKey(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestKeyDirectory(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		alice = "alice"
+		bob   = "bob"
+	)
+	for _, id := range []string{alice, bob} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.claimKeys(alice); err != errNotFound {
+		t.Errorf("expected %v got %v", errNotFound, err)
+	}
+	bundle := &KeyBundle{
+		IdentityKey:  testKey("identity"),
+		SignedPreKey: &PreKey{ID: 1, Key: testKey("signed"), Signature: testKey("sig")},
+		OneTimeKeys:  []*PreKey{{ID: 1, Key: testKey("one")}, {ID: 2, Key: testKey("two")}},
+	}
+	if _, err := m.publishKeys(alice, &KeyBundle{IdentityKey: "not base64!"}); err != errBadKey {
+		t.Errorf("expected %v got %v", errBadKey, err)
+	}
+	if _, err := m.publishKeys(alice, &KeyBundle{IdentityKey: bundle.IdentityKey, SignedPreKey: &PreKey{Key: testKey("signed")}}); err != errBadKey {
+		t.Errorf("expected the unsigned pre key to be refused got %v", err)
+	}
+	if _, err := m.publishKeys(alice, &KeyBundle{IdentityKey: bundle.IdentityKey, SignedPreKey: bundle.SignedPreKey, OneTimeKeys: []*PreKey{nil}}); err != errBadKey {
+		t.Errorf("expected the null one time key to be refused got %v", err)
+	}
+	b, err := m.publishKeys(alice, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Remaining != 2 || b.ProfileID != alice || len(b.OneTimeKeys) != 0 {
+		t.Errorf("expected 2 one time keys left got %v", b)
+	}
+
+	// every one time key is given out once
+	seen := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		if b, err = m.claimKeys(alice); err != nil {
+			t.Fatal(err)
+		}
+		if b.OneTimeKey == nil || seen[b.OneTimeKey.ID] {
+			t.Fatalf("expected a new one time key got %v", b.OneTimeKey)
+		}
+		seen[b.OneTimeKey.ID] = true
+	}
+
+	// a broken key in the directory is dropped instead of given out
+	pdb := setDB(m.rx.db, getProfileDatabase(dir, alice, m.rx.cfg.DBExtension))
+	if err = pdb.Create(preKeysBucket, "9", []byte("null"), keysBucket).Error; err != nil {
+		t.Fatal(err)
+	}
+	if b, err = m.claimKeys(alice); err != nil {
+		t.Fatal(err)
+	}
+	if b.OneTimeKey != nil || b.Remaining != 0 || b.SignedPreKey.ID != 1 {
+		t.Errorf("expected only the signed pre key got %v", b)
+	}
+
+	// rotating the signed pre key keeps the one time keys, a new identity drops them
+	bundle.SignedPreKey = &PreKey{ID: 2, Key: testKey("signed2"), Signature: testKey("sig2")}
+	bundle.OneTimeKeys = []*PreKey{{ID: 3, Key: testKey("three")}}
+	if b, err = m.publishKeys(alice, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if b.Remaining != 1 || b.SignedPreKey.ID != 2 {
+		t.Errorf("expected the rotated pre key and 1 one time key got %v", b)
+	}
+	bundle.IdentityKey = testKey("identity2")
+	bundle.OneTimeKeys = nil
+	if b, err = m.publishKeys(alice, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if b.Remaining != 0 || b.IdentityKey != bundle.IdentityKey {
+		t.Errorf("expected the new identity without one time keys got %v", b)
+	}
+
+	// encrypted messages can only go to profiles with keys, with nothing in the clear
+	env := &Envelope{Ciphertext: testKey("secret"), IdentityKey: testKey("bob")}
+	msg := &MSG{SenderID: bob, RecipientID: alice, Envelope: env}
+	if err = m.checkEncrypted(msg); err != nil {
+		t.Errorf("expected the message to be fine got %v", err)
+	}
+	if err = m.checkEncrypted(&MSG{SenderID: alice, RecipientID: bob, Envelope: env}); err != errNoKeys {
+		t.Errorf("expected %v got %v", errNoKeys, err)
+	}
+	if err = m.checkEncrypted(&MSG{SenderID: bob, RecipientID: alice, Text: "siri", Envelope: env}); err != errPlaintext {
+		t.Errorf("expected %v got %v", errPlaintext, err)
+	}
+	if err = m.checkEncrypted(&MSG{SenderID: bob, RecipientID: alice, Envelope: &Envelope{IdentityKey: env.IdentityKey}}); err != errBadForm {
+		t.Errorf("expected %v got %v", errBadForm, err)
+	}
+
+	if err = m.removeKeys(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.checkEncrypted(msg); err != errNoKeys {
+		t.Errorf("expected %v got %v", errNoKeys, err)
+	}
+}
+
+func TestEditEncrypted(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		alice = "alice"
+		bob   = "bob"
+	)
+	env := &Envelope{Ciphertext: testKey("secret"), IdentityKey: testKey("alice")}
+	msg := &MSG{ID: "1", SenderID: alice, RecipientID: bob, Envelope: env, SentAt: time.Now(),
+		ConversationID: conversationID(alice, bob)}
+	if err := m.saveMsg(outboxBucket, alice, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.editMsg(alice, &EditRequest{ID: msg.ID, Text: "siri"}); err != errEncryptedMsg {
+		t.Errorf("expected %v got %v", errEncryptedMsg, err)
+	}
+	next := &Envelope{Ciphertext: testKey("secret2"), IdentityKey: env.IdentityKey}
+	edited, err := m.editMsg(alice, &EditRequest{ID: msg.ID, Envelope: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Envelope.Ciphertext != next.Ciphertext || edited.Text != "" || edited.Edits[0].Envelope.Ciphertext != env.Ciphertext {
+		t.Errorf("expected the new envelope with the old one in the edits got %v", edited)
+	}
+	unsent, err := m.unsendMsg(alice, &EditRequest{ID: msg.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsent.Envelope != nil || len(unsent.Edits) != 0 {
+		t.Errorf("expected nothing left of the message got %v", unsent)
+	}
+}
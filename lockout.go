@@ -0,0 +1,179 @@
+package aurora
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// nested buckets of the login attempts bucket
+	accountAttempts = "accounts"
+	ipAttempts      = "ips"
+
+	// defaults for the lockout policy
+	defaultMaxAttempts   = 5
+	defaultMaxAttemptsIP = 20
+	defaultLockout       = 60   // seconds
+	defaultMaxLockout    = 3600 // seconds
+)
+
+// MsgLocked is the error message shown when login is locked
+var MsgLocked = "du! umejaribu kuingia mara nyingi, jaribu tena baada ya %s"
+
+// loginAttempts tracks failed logins of an account or an IP address.
+type loginAttempts struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// lockoutPolicy decides when and for how long logins are locked. After max failures
+// every other failure locks for twice as long as the previous one, starting with base
+// and never longer than limit.
+type lockoutPolicy struct {
+	max   int
+	base  time.Duration
+	limit time.Duration
+}
+
+// records a failure at the time now, and returns true if it caused a lockout.
+func (a *loginAttempts) fail(now time.Time, p lockoutPolicy) bool {
+	// forget old failures, so that a typo every other week won't lock anyone.
+	if !a.LastFailure.IsZero() && now.Sub(a.LastFailure) > p.limit {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailure = now
+	if a.Failures < p.max {
+		return false
+	}
+	d := p.base
+	for i := p.max; i < a.Failures && d < p.limit; i++ {
+		d *= 2
+	}
+	if d > p.limit {
+		d = p.limit
+	}
+	a.LockedUntil = now.Add(d)
+	return true
+}
+
+func (a *loginAttempts) locked(now time.Time) bool {
+	return a.LockedUntil.After(now)
+}
+
+// returns the time until which login is locked for the email or the ip, the time is
+// zero when login is not locked.
+func (rx *Remix) lockedUntil(email, ip string) time.Time {
+	var until time.Time
+	now := time.Now()
+	for _, a := range []*loginAttempts{
+		rx.getAttempts(accountAttempts, email),
+		rx.getAttempts(ipAttempts, ip),
+	} {
+		if a.locked(now) && a.LockedUntil.After(until) {
+			until = a.LockedUntil
+		}
+	}
+	return until
+}
+
+// records a failed login, for both the account and the ip address.
+func (rx *Remix) loginFailed(email, ip string) {
+	now := time.Now()
+	policies := map[string]lockoutPolicy{
+		accountAttempts: rx.lockoutPolicy(rx.cfg.LoginMaxAttempts, defaultMaxAttempts),
+		ipAttempts:      rx.lockoutPolicy(rx.cfg.LoginMaxAttemptsIP, defaultMaxAttemptsIP),
+	}
+	keys := map[string]string{accountAttempts: email, ipAttempts: ip}
+	for kind, key := range keys {
+		a := rx.getAttempts(kind, key)
+		if a.fail(now, policies[kind]) {
+			rx.audit(&AuditEvent{
+				Kind:    auditLockout,
+				Subject: attemptsKey(key),
+				IP:      ip,
+				Detail:  fmt.Sprintf("%s locked until %s after %d failures", kind, a.LockedUntil.Format(time.RFC3339), a.Failures),
+			})
+		}
+		if err := rx.putAttempts(kind, key, a); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// forgets failed logins of the account, the ip address is left alone otherwise anyone
+// with a valid account could reset the counter of their ip.
+func (rx *Remix) loginSucceeded(email string) {
+	rx.deleteAttempts(accountAttempts, email)
+}
+
+// unlock removes the lockout of the email and the ip, any of them can be empty.
+func (rx *Remix) unlock(actor, email, ip string) {
+	if email != "" {
+		rx.deleteAttempts(accountAttempts, email)
+		rx.audit(&AuditEvent{Kind: auditUnlock, Subject: attemptsKey(email), Actor: actor})
+	}
+	if ip != "" {
+		rx.deleteAttempts(ipAttempts, ip)
+		rx.audit(&AuditEvent{Kind: auditUnlock, Subject: ip, Actor: actor})
+	}
+}
+
+func (rx *Remix) lockoutPolicy(max, def int) lockoutPolicy {
+	if max <= 0 {
+		max = def
+	}
+	return lockoutPolicy{
+		max:   max,
+		base:  secondsOr(rx.cfg.LoginLockout, defaultLockout),
+		limit: secondsOr(rx.cfg.LoginMaxLockout, defaultMaxLockout),
+	}
+}
+
+func (rx *Remix) getAttempts(kind, key string) *loginAttempts {
+	a := &loginAttempts{}
+	if key == "" {
+		return a
+	}
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	if err := getAndUnmarshall(adb, rx.attemptsBucket(), attemptsKey(key), a, kind); err != nil {
+		return &loginAttempts{}
+	}
+	return a
+}
+
+func (rx *Remix) putAttempts(kind, key string, a *loginAttempts) error {
+	if key == "" {
+		return nil
+	}
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	return marshalAndCreate(adb, a, rx.attemptsBucket(), attemptsKey(key), kind)
+}
+
+func (rx *Remix) deleteAttempts(kind, key string) {
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	adb.Delete(rx.attemptsBucket(), attemptsKey(key), kind)
+}
+
+func (rx *Remix) attemptsBucket() string {
+	if rx.cfg.LoginAttemptsBucket == "" {
+		return "login_attempts"
+	}
+	return rx.cfg.LoginAttemptsBucket
+}
+
+func attemptsKey(key string) string {
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+// returns the lockout error message for the given time.
+func lockedMsg(until time.Time) string {
+	d := until.Sub(time.Now())
+	if d < time.Second {
+		d = time.Second
+	}
+	return fmt.Sprintf(MsgLocked, d.Round(time.Second))
+}
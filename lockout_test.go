@@ -0,0 +1,152 @@
+package aurora
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginAttempts(t *testing.T) {
+	var (
+		now = time.Now()
+		p   = lockoutPolicy{max: 3, base: time.Minute, limit: 5 * time.Minute}
+		a   = &loginAttempts{}
+	)
+	for i := 0; i < 2; i++ {
+		if a.fail(now, p) {
+			t.Errorf("Expected no lockout after %d failures", a.Failures)
+		}
+	}
+	if a.locked(now) {
+		t.Error("Expected not to be locked")
+	}
+
+	// the lockout doubles with every failure, up to the limit
+	for _, d := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if !a.fail(now, p) {
+			t.Fatalf("Expected a lockout after %d failures", a.Failures)
+		}
+		if got := a.LockedUntil.Sub(now); got != d {
+			t.Errorf("Expected a lockout of %v got %v", d, got)
+		}
+	}
+	if !a.locked(now) {
+		t.Error("Expected to be locked")
+	}
+	if a.locked(now.Add(6 * time.Minute)) {
+		t.Error("Expected the lockout to expire")
+	}
+
+	// old failures are forgotten
+	if a.fail(now.Add(time.Hour), p) {
+		t.Error("Expected no lockout after a long time")
+	}
+	if a.Failures != 1 {
+		t.Errorf("Expected 1 got %d", a.Failures)
+	}
+}
+
+func TestRemix_Lockout(t *testing.T) {
+	var (
+		email     = "lock@aurora.com"
+		admin     = "admin@aurora.com"
+		pass      = "mamamia"
+		loginPath = "/auth/login"
+		unlock    = apiPrefix + "/admin/unlock"
+		ip        = "127.0.0.1"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+	rx.cfg.LoginMaxAttempts = 3
+	rx.cfg.Admins = []string{admin}
+	defer rx.unlock("", "", ip)
+
+	ps, err := hashPassword(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{email, admin} {
+		usr := &User{UUID: getUUID(), EmailAddress: v, FirstName: "lock", Pass: ps}
+		err = CreateAccount(setDB(rx.db, rx.cfg.AccountsDB), usr, rx.cfg.AccountsBucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		res, err := client.PostForm(ts.URL+loginPath, url.Values{"email": {email}, "password": {"wrong"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkResponse(res, http.StatusOK, "login-form")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// even the right password is refused while locked
+	res, err := client.PostForm(ts.URL+loginPath, url.Values{"email": {email}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusTooManyRequests, "umejaribu")
+	if err != nil {
+		t.Error(err)
+	}
+
+	evts, err := GetAuditEvents(setDB(rx.db, rx.cfg.AccountsDB), rx.auditBucket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, v := range evts {
+		if v.Kind == auditLockout && v.Subject == email {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a lockout audit event for %s", email)
+	}
+
+	// only admins can unlock
+	res, err = client.PostForm(ts.URL+unlock, url.Values{"email": {email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusForbidden)
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+loginPath, url.Values{"email": {admin}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "search")
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+unlock, url.Values{"email": {strings.ToUpper(email)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = httpGet(client, ts.URL+"/auth/logout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = client.PostForm(ts.URL+loginPath, url.Values{"email": {email}, "password": {pass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "search")
+	if err != nil {
+		t.Error(err)
+	}
+}
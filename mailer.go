@@ -0,0 +1,120 @@
+package aurora
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Mail is an email message
+type Mail struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(m *Mail) error
+}
+
+// SMTPMailer sends emails through a SMTP server.
+type SMTPMailer struct {
+	Addr     string // host:port of the server
+	Username string
+	Password string
+}
+
+// Send sends m via the SMTP server. Plain authentication is used only when Username
+// is set.
+func (s *SMTPMailer) Send(m *Mail) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, m.From, []string{m.To}, m.bytes())
+}
+
+// FileMailer writes emails as files into Dir, this is handy during development.
+type FileMailer struct {
+	Dir string
+}
+
+// Send writes m to a new file in Dir.
+func (f *FileMailer) Send(m *Mail) error {
+	err := os.MkdirAll(f.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), getUUID())
+	return ioutil.WriteFile(filepath.Join(f.Dir, name), m.bytes(), 0600)
+}
+
+// MemMailer keeps emails in memory, it is meant for tests.
+type MemMailer struct {
+	mu   sync.Mutex
+	sent []*Mail
+}
+
+// Send stores m.
+func (mm *MemMailer) Send(m *Mail) error {
+	mm.mu.Lock()
+	mm.sent = append(mm.sent, m)
+	mm.mu.Unlock()
+	return nil
+}
+
+// Sent returns all the emails sent so far.
+func (mm *MemMailer) Sent() []*Mail {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]*Mail(nil), mm.sent...)
+}
+
+// Last returns the most recent email sent to the given address, or nil if there is
+// none.
+func (mm *MemMailer) Last(to string) *Mail {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for i := len(mm.sent) - 1; i >= 0; i-- {
+		if mm.sent[i].To == to {
+			return mm.sent[i]
+		}
+	}
+	return nil
+}
+
+// returns a mailer based on the configuration.
+func newMailer(cfg *RemixConfig) Mailer {
+	switch cfg.Mailer {
+	case "smtp":
+		return &SMTPMailer{Addr: cfg.SMTPAddr, Username: cfg.SMTPUser, Password: cfg.SMTPPassword}
+	case "file":
+		return &FileMailer{Dir: cfg.MailDir}
+	}
+	return &MemMailer{}
+}
+
+// renders the mail in the internet message format.
+func (m *Mail) bytes() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(m.Body)
+	return buf.Bytes()
+}
@@ -0,0 +1,56 @@
+package aurora
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemMailer(t *testing.T) {
+	m := &MemMailer{}
+	for _, to := range []string{"a@aurora.com", "b@aurora.com", "a@aurora.com"} {
+		err := m.Send(&Mail{To: to, Subject: "hello", Body: to})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if len(m.Sent()) != 3 {
+		t.Errorf("Expected 3 got %d", len(m.Sent()))
+	}
+	if l := m.Last("b@aurora.com"); l == nil || l.Body != "b@aurora.com" {
+		t.Errorf("Expected the mail sent to b got %v", l)
+	}
+	if l := m.Last("c@aurora.com"); l != nil {
+		t.Errorf("Expected nil got %v", l)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aurora-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &FileMailer{Dir: filepath.Join(dir, "mail")}
+	err = m.Send(&Mail{From: "aurora@aurora.com", To: "a@aurora.com", Subject: "hello", Body: "hey there"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 got %d", len(files))
+	}
+	d, err := ioutil.ReadFile(filepath.Join(m.Dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"To: a@aurora.com", "Subject: hello", "hey there"} {
+		if !contains(string(d), v) {
+			t.Errorf("Expected %s to contain %s", d, v)
+		}
+	}
+}
@@ -24,6 +24,32 @@ type User struct {
 	ConfirmPass  string    `json:"-" gforms:"confirm_pass"`
 	CreatedAt    time.Time `json:"created_at" gforms:"-"`
 	UpdatedAt    time.Time `json:"updated_at" gforms:"-"`
+
+	// EmailVerified is true when the user has proved to own the email address.
+	EmailVerified bool      `json:"email_verified" gforms:"-"`
+	VerifiedAt    time.Time `json:"verified_at" gforms:"-"`
+
+	// TOTPSecret is the encrypted secret for two factor authentication, it is
+	// empty when two factor authentication is disabled.
+	TOTPSecret string `json:"totp_secret,omitempty" gforms:"-"`
+
+	// TOTPLastStep is the time step of the last accepted code, codes of this step
+	// or older are rejected.
+	TOTPLastStep int64 `json:"totp_last_step,omitempty" gforms:"-"`
+
+	// RecoveryCodes are hashes of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes,omitempty" gforms:"-"`
+
+	// DeleteAt is when the account is going to be deleted for good, it is zero unless
+	// the user asked for the account to be deleted. Logging in before then cancels
+	// the deletion.
+	DeleteAt time.Time `json:"delete_at" gforms:"-"`
+}
+
+// deleted returns true if the account is past its deletion time, such an account is
+// treated as if it does not exist even before it is purged.
+func (u *User) deleted() bool {
+	return !u.DeleteAt.IsZero() && time.Now().After(u.DeleteAt)
 }
 
 // Email user email address
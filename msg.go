@@ -2,7 +2,9 @@ package aurora
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/muesli/cache2go"
@@ -47,6 +49,34 @@ type MSG struct {
 	ReceivedAt  time.Time `json:"received_at"`
 	Status      int       `json:"status"`
 	SenderName  string    `json:"sender_name"`
+
+	// ConversationID is the id of the Conversation the message belongs to.
+	ConversationID string `json:"conversation_id"`
+
+	// GroupID is set for messages sent to a group, they have no recipient.
+	GroupID string `json:"group_id,omitempty"`
+
+	// Attachments are the files sent with the message, they are uploaded first.
+	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	// State is how far the message has gone, one of sent, delivered or read. It is
+	// kept on the copy in the outbox of the sender.
+	State string `json:"state,omitempty"`
+
+	// EditedAt is when the text was last changed, the earlier texts are in Edits.
+	EditedAt time.Time  `json:"edited_at"`
+	Edits    []*MSGEdit `json:"edits,omitempty"`
+
+	// Deleted is true for messages the sender deleted for everyone, they have no
+	// text.
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Envelope is set for end to end encrypted messages instead of the text, only
+	// direct messages can be encrypted.
+	Envelope *Envelope `json:"envelope,omitempty"`
+
+	// Mentions are the ids of the members mentioned in a group message.
+	Mentions []string `json:"mentions,omitempty"`
 }
 
 // InfoMSG this is for sharing information across the messenger nodes
@@ -62,21 +92,75 @@ type Messenger struct {
 	rm     *golem.RoomManager
 	route  *golem.Router
 	online *cache2go.CacheTable
+
+	// broker carries events to the other nodes, and knows who is online on them.
+	// online only has the users connected to this node.
+	broker Broker
+
+	// push sends notifications to users who are offline, it is nil when push
+	// notifications are not configured.
+	push Pusher
+
+	// pushSlots limits the notifications being sent at the same time.
+	pushOnce  sync.Once
+	pushSlots chan struct{}
+
+	// guards updates of the conversations index.
+	convMu sync.Mutex
+
+	// guards updates of groups.
+	groupMu sync.Mutex
+
+	// guards the pending delivery queues.
+	pendingMu sync.Mutex
+
+	// mu guards quit and done, which control the retry goroutine.
+	mu   sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+
+	// limit the presence and typing events of every user.
+	presenceLimit rateLimiter
+	typingLimit   rateLimiter
+
+	// limit the messages sent by every user, and by every connection.
+	msgLimit     burstLimiter
+	connMsgLimit burstLimiter
+
+	// keyMu guards the key directory, one time keys must be given out only once.
+	keyMu         sync.Mutex
+	keyClaimLimit rateLimiter
+
+	// devices holds the connections of every user who is online, with the status
+	// of each connection. A user is online as long as one of them is open.
+	devMu   sync.Mutex
+	devices map[string]map[*golem.Connection]string
+
+	// guards moving messages between the inbox and read buckets, every
+	// connection of the recipient handles the same events.
+	boxMu sync.Mutex
 }
 
 // NewMessenger creates a new messenger
 func NewMessenger(rx *Remix) *Messenger {
-	return &Messenger{
+	m := &Messenger{
 		rx:     rx,
 		rm:     golem.NewRoomManager(),
 		route:  golem.NewRouter(),
 		online: cache2go.Cache(onlineCache),
 	}
+	m.useBroker(newBroker(rx.cfg))
+	m.push = newPusher(rx.cfg)
+	return m
 }
 
 func (m *Messenger) validateSession(w http.ResponseWriter, r *http.Request) bool {
 	if ss, ok := m.rx.isInSession(r); ok && !ss.IsNew {
-		return true
+		if !m.rx.cfg.RequireVerifiedEmail {
+			return true
+		}
+		user, _, err := m.rx.getCurrentUserAndProfile(ss)
+		return err == nil && m.rx.isVerified(user)
 	}
 	return false
 }
@@ -91,6 +175,17 @@ func (m *Messenger) onConnect(conn *golem.Connection, r *http.Request) {
 			m.rm.Join(mainRoom, conn)
 			m.rm.Join(p.ID, conn)
 			m.online.Add(p.ID, 0, p)
+			if err = m.broker.SetOnline(p.ID, true); err != nil {
+				log.Println(err)
+			}
+
+			// whatever was not acknowledged before is sent again.
+			m.deliverPending(p.ID, true)
+
+			if m.connect(conn) {
+				m.broadcastPresence(m.setPresence(p.ID, statusOnline))
+			}
+			m.sendContactsPresence(conn)
 		}
 	}
 }
@@ -103,15 +198,59 @@ func (m *Messenger) callMeBack(conn *golem.Connection, msg *golem.Message) *gole
 		case *MSG:
 			if p != nil {
 				if p.ID == data.SenderID {
+					// the id is always new, otherwise a client could overwrite an old
+					// message by sending it again.
+					data.ID = getUUID()
+					data.GroupID = ""
 					data.SenderName = fmt.Sprintf("%s %s", p.FirstName, p.LastName)
 					data.SentAt = time.Now()
+					data.ConversationID = conversationID(data.SenderID, data.RecipientID)
+					data.State = stateSent
+
+					// mentions are only for groups.
+					resetEdits(data)
+					data.Mentions = nil
+					if m.isBlocked(p.ID, data.RecipientID) {
+						data.Status = http.StatusForbidden
+						return setMSG(alertSendFailed, data, msg)
+					}
+
+					// encrypted messages are relayed as they are, the server can only
+					// check their envelope.
+					if err := m.checkEncrypted(data); err != nil {
+						data.Status = http.StatusBadRequest
+						return setMSG(alertSendFailed, data, msg)
+					}
+					if err := m.attach(p.ID, data); err != nil {
+						data.Status = http.StatusForbidden
+						return setMSG(alertSendFailed, data, msg)
+					}
 					err := m.saveMsg(outboxBucket, p.ID, data)
 					if err != nil {
 						data.Status = http.StatusInternalServerError
 						return setMSG(alertSendFailed, data, msg)
 					}
+					if err = m.indexMessage(p.ID, data, false); err != nil {
+						log.Println(err)
+					}
+
+					// the other devices of the sender get a copy.
+					m.emit(p.ID, statusEvt, data)
+
+					// the sender is not told about being blocked, the message is just
+					// never delivered.
+					if m.isBlocked(data.RecipientID, p.ID) {
+						data.Status = http.StatusOK
+						return setMSG(alertSendSuccess, data, msg)
+					}
+
+					// the message stays in the queue of the recipient until it is
+					// acknowledged.
+					if err = m.enqueue(data.RecipientID, data); err != nil {
+						log.Println(err)
+					}
 					if m.isOnline(data.RecipientID) {
-						m.rm.Emit(data.RecipientID, receiveEvt, data)
+						m.deliverPending(data.RecipientID, false)
 						data.Status = http.StatusOK
 						return setMSG(alertSendSuccess, data, msg)
 					}
@@ -120,6 +259,10 @@ func (m *Messenger) callMeBack(conn *golem.Connection, msg *golem.Message) *gole
 						data.Status = http.StatusInternalServerError
 						return setMSG(alertSendFailed, data, msg)
 					}
+					if err = m.indexMessage(data.RecipientID, data, true); err != nil {
+						log.Println(err)
+					}
+					m.notifyMsg(data)
 					data.Status = http.StatusOK
 					return setMSG(alertSendSuccess, data, msg)
 				}
@@ -131,19 +274,23 @@ func (m *Messenger) callMeBack(conn *golem.Connection, msg *golem.Message) *gole
 		case *MSG:
 			if p != nil {
 				if p.ID == data.RecipientID {
-					data.ReceivedAt = time.Now()
-					err := m.saveMsg(inboxBucket, p.ID, data)
-					if err != nil {
-						msg.SetEvent(ignoreEvt)
-						if m.isOnline(data.SenderID) {
-							m.rm.Emit(data.SenderID, sendFailedEvt, data)
+
+					// a message can be delivered more than once, and to more than one
+					// connection, it is saved only the first time.
+					m.boxMu.Lock()
+					defer m.boxMu.Unlock()
+					if !m.hasMsg(p.ID, data.ID) {
+						data.ReceivedAt = time.Now()
+						err := m.saveMsg(inboxBucket, p.ID, data)
+						if err != nil {
+							// it is still pending, so it will be sent again.
+							log.Println(err)
+							msg.SetEvent(ignoreEvt)
 							return msg
 						}
-						err = m.moveTo(draftBucket, outboxBucket, data.SenderID, data.ID)
-						if err != nil {
-							// TODO: log this?
+						if err = m.indexMessage(p.ID, data, true); err != nil {
+							log.Println(err)
 						}
-						return msg
 					}
 					data.Status = http.StatusOK
 					return setMSG(alertInbox, data, msg)
@@ -166,10 +313,32 @@ func (m *Messenger) callMeBack(conn *golem.Connection, msg *golem.Message) *gole
 		switch data := msg.GetData().(type) {
 		case *MSG:
 			if p != nil && data.RecipientID == p.ID {
+
+				// every connection of the recipient gets the read event, which keeps
+				// the devices in sync, but only the first one moves the message.
+				m.boxMu.Lock()
+				defer m.boxMu.Unlock()
 				err := m.moveTo(readBucket, inboxBucket, p.ID, data.ID)
 				if err != nil {
 					// TODO: log this?
 				}
+
+				// a message which is not in the inbox is already read.
+				if err == nil {
+					if err = m.markRead(p.ID, data); err != nil {
+						log.Println(err)
+					}
+				}
+
+				// reading a message acknowledges it too.
+				if err = m.acknowledge(p.ID, data.ID); err != nil {
+					log.Println(err)
+				}
+				if m.hasMsg(p.ID, data.ID) {
+					if err = m.setState(data.SenderID, data.ID, stateRead); err != nil {
+						log.Println(err)
+					}
+				}
 				return setMSG(alertRead, nil, msg)
 			}
 
@@ -187,7 +356,11 @@ func (m *Messenger) saveMsg(bucket string, profileID string, msg *MSG) error {
 	}
 	pdb := getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension)
 	mdb := setDB(m.rx.db, pdb)
-	return marshalAndCreate(mdb, msg, bucket, msg.ID, m.rx.cfg.MessagesBucket)
+	if err := marshalAndCreate(mdb, msg, bucket, msg.ID, m.rx.cfg.MessagesBucket); err != nil {
+		return err
+	}
+	m.index(profileID, bucket, msg)
+	return nil
 }
 
 // moves message data from one bucket to another.
@@ -202,7 +375,13 @@ func (m *Messenger) moveTo(dest, src, profileID, msgID string) error {
 	if s.Error != nil {
 		return s.Error
 	}
-	return mdb.Delete(src, msgID, m.rx.cfg.MessagesBucket).Error
+	if err := mdb.Delete(src, msgID, m.rx.cfg.MessagesBucket).Error; err != nil {
+		return err
+	}
+	if err := moveIndexedMsg(mdb, msgID, dest); err != nil {
+		log.Println(err)
+	}
+	return nil
 }
 
 // gets the user's profile of a given websocket connection.
@@ -230,31 +409,51 @@ func setMSG(evt string, data interface{}, msg *golem.Message) *golem.Message {
 
 // sends an info message
 func (m *Messenger) info(conn *golem.Connection, msg *InfoMSG) {
-	m.rm.Emit(mainRoom, infoEvt, msg)
+	m.emit(mainRoom, infoEvt, msg)
 }
 
-// sends a message
+// sends a message. Only the connection which sends it handles it, the other
+// connections of the sender are told about it afterwards.
 func (m *Messenger) send(conn *golem.Connection, msg *MSG) {
-	m.rm.Emit(msg.SenderID, sendEvt, msg)
+	if !m.allowSend(conn) {
+		msg.Status = http.StatusTooManyRequests
+		conn.Emit(alertSendFailed, msg)
+		return
+	}
+	conn.Emit(sendEvt, msg)
 }
 
 // reading a message.
 func (m *Messenger) read(conn *golem.Connection, msg *MSG) {
-	m.rm.Emit(msg.RecipientID, readEvt, msg)
+	m.emit(msg.RecipientID, readEvt, msg)
 }
 
 // when the connection is closed, it makes sure the cache is updated and all the channels
 // the given connection was subscribed to are unsubscribed.
 func (m *Messenger) onClose(conn *golem.Connection) {
-	m.online.Delete(conn.UserID)
 	m.rm.Leave(conn.UserID, conn)
 	m.rm.Leave(mainRoom, conn)
+	m.connMsgLimit.forget(connKey(conn))
+
+	// the user is still online on the other devices.
+	if m.disconnect(conn) {
+		m.online.Delete(conn.UserID)
+		if err := m.broker.SetOnline(conn.UserID, false); err != nil {
+			log.Println(err)
+		}
+
+		// nor is the user offline when connected to another node.
+		if !m.isOnline(conn.UserID) {
+			m.broadcastPresence(m.setPresence(conn.UserID, statusOffline))
+		}
+	}
 }
 
 // checks if the user with a given key is still online.
-// it uses the siple cache2go to store online users in memory.
+// it uses the siple cache2go to store online users in memory, users connected to
+// other nodes are known by the broker.
 func (m *Messenger) isOnline(key string) bool {
-	return m.online.Exists(key)
+	return m.online.Exists(key) || m.broker.Online(key)
 }
 
 // Handler handles websocket connections for messaging
@@ -265,5 +464,17 @@ func (m *Messenger) Handler() func(http.ResponseWriter, *http.Request) {
 	m.route.On("info", m.info)
 	m.route.On("read", m.read)
 	m.route.On("send", m.send)
+	m.route.On(ackEvt, m.ack)
+	m.route.On(presenceEvt, m.onPresence)
+	m.route.On(typingEvt, m.onTyping)
+	m.route.On(editEvt, m.onEdit)
+	m.route.On(deleteEvt, m.onDelete)
+	m.route.On(historyEvt, m.history)
+	m.route.On(groupCreateEvt, m.onGroupCreate)
+	m.route.On(groupInviteEvt, m.onGroupInvite)
+	m.route.On(groupLeaveEvt, m.onGroupLeave)
+	m.route.On(groupRoleEvt, m.onGroupRole)
+	m.route.On(groupSendEvt, m.onGroupSend)
+	m.route.On(groupHistoryEvt, m.onGroupHistory)
 	return m.route.Handler()
 }
@@ -7,10 +7,12 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gernest/golem"
 	"github.com/gorilla/websocket"
 )
 
@@ -171,3 +173,43 @@ func setDeadline(t *testing.T, ws *websocket.Conn) {
 		t.Errorf("set read deadline %v", err)
 	}
 }
+
+func TestMessenger_CallMeBack(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		me  = "me"
+		bob = "bob"
+	)
+	for _, id := range []string{me, bob} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orig := &MSG{SenderID: me, RecipientID: bob, Text: "habari"}
+	if err := m.saveMsg(outboxBucket, me, orig); err != nil {
+		t.Fatal(err)
+	}
+
+	// sending again with an old id makes a new message
+	data := &MSG{ID: orig.ID, GroupID: "kikundi", SenderID: me, RecipientID: bob, Text: "uongo"}
+	msg := &golem.Message{}
+	msg.SetEvent(sendEvt)
+	msg.SetData(data)
+	rst := m.callMeBack(&golem.Connection{UserID: me}, msg)
+	if rst.GetEvent() != alertSendSuccess {
+		t.Fatalf("expected %s got %s", alertSendSuccess, rst.GetEvent())
+	}
+	if data.ID == orig.ID || data.GroupID != "" {
+		t.Errorf("expected a new direct message got %v", data)
+	}
+	mdb := setDB(m.rx.db, getProfileDatabase(dir, me, m.rx.cfg.DBExtension))
+	got := &MSG{}
+	if err := getAndUnmarshall(mdb, outboxBucket, orig.ID, got, m.rx.cfg.MessagesBucket); err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != orig.Text {
+		t.Errorf("expected %s got %s", orig.Text, got.Text)
+	}
+}
@@ -0,0 +1,249 @@
+package aurora
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gernest/golem"
+)
+
+const (
+	// events sent by clients, and relayed to other clients.
+	presenceEvt = "presence"
+	typingEvt   = "typing"
+
+	// presence status of a user.
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+
+	// the bucket in the profile database where the last presence of the profile is
+	// kept.
+	presenceBucket = "presence"
+
+	// the number of events a user can send in a minute, unless configured otherwise.
+	defaultTypingRateLimit   = 30
+	defaultPresenceRateLimit = 10
+)
+
+// Presence tells whether a user is around. LastSeen is when the status last changed,
+// so for an offline user it is when the user left.
+type Presence struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Typing is the data of the typing event, it is sent either to a user or to the
+// members of a group. It is not stored anywhere.
+type Typing struct {
+	From    string `json:"from"`
+	To      string `json:"to,omitempty"`
+	GroupID string `json:"group_id,omitempty"`
+	Typing  bool   `json:"typing"`
+}
+
+// records the status of the profile.
+func (m *Messenger) setPresence(id, status string) *Presence {
+	p := &Presence{ID: id, Status: status, LastSeen: time.Now()}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, id, m.rx.cfg.DBExtension))
+	if err := marshalAndCreate(pdb, p, presenceBucket, id); err != nil {
+		log.Println(err)
+	}
+	return p
+}
+
+// returns the presence of the profile. Users who are not connected are offline, no
+// matter what was recorded last.
+func (m *Messenger) presenceOf(id string) *Presence {
+	p := &Presence{}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, id, m.rx.cfg.DBExtension))
+	if err := getAndUnmarshall(pdb, presenceBucket, id, p); err != nil {
+		p = &Presence{ID: id}
+	}
+	if !m.isOnline(id) {
+		p.Status = statusOffline
+	}
+	return p
+}
+
+// returns the ids of the profiles the given profile chats with, either directly or
+// in a group. The profiles it blocked are left out.
+func (m *Messenger) contacts(id string) []string {
+	seen := map[string]bool{id: true}
+	var rst []string
+	for _, b := range m.blocked(id) {
+		seen[b.ID] = true
+	}
+	add := func(c string) {
+		if !seen[c] {
+			seen[c] = true
+			rst = append(rst, c)
+		}
+	}
+	if convs, err := m.conversations(id); err == nil {
+		for _, c := range convs {
+			// strangers are not told about the user until the request is accepted.
+			if !c.Request {
+				add(c.With)
+			}
+		}
+	}
+	if groups, err := m.userGroups(id); err == nil {
+		for _, g := range groups {
+			for _, c := range g.memberIDs() {
+				add(c)
+			}
+		}
+	}
+	sort.Strings(rst)
+	return rst
+}
+
+// tells the contacts who are online about the presence of a user.
+func (m *Messenger) broadcastPresence(p *Presence) {
+	for _, c := range m.contacts(p.ID) {
+		if m.isOnline(c) {
+			m.emit(c, presenceEvt, p)
+		}
+	}
+}
+
+// tells the connection about the presence of the contacts of its user.
+func (m *Messenger) sendContactsPresence(conn *golem.Connection) {
+	for _, p := range m.contactsPresence(conn.UserID) {
+		conn.Emit(presenceEvt, p)
+	}
+}
+
+// returns the presence of the contacts of the given profile, contacts who blocked
+// the profile are left out.
+func (m *Messenger) contactsPresence(id string) []*Presence {
+	var rst []*Presence
+	for _, c := range m.contacts(id) {
+		if !m.isBlocked(c, id) {
+			rst = append(rst, m.presenceOf(c))
+		}
+	}
+	return rst
+}
+
+// the client tells the user is away, or back. Other connections of the user may still
+// be active, so the user is away only when all of them are.
+func (m *Messenger) onPresence(conn *golem.Connection, req *Presence) {
+	if req.Status != statusOnline && req.Status != statusAway {
+		return
+	}
+	limit := m.rx.cfg.PresenceRateLimit
+	if limit <= 0 {
+		limit = defaultPresenceRateLimit
+	}
+	if !m.presenceLimit.allow(conn.UserID, limit, time.Minute, time.Now()) {
+		return
+	}
+	if status, ok := m.setDeviceStatus(conn, req.Status); ok {
+		m.broadcastPresence(m.setPresence(conn.UserID, status))
+	}
+}
+
+// relays the typing event to the other participants of the conversation. Events
+// above the rate limit are dropped, they are of no use by the time they would be
+// allowed anyway.
+func (m *Messenger) onTyping(conn *golem.Connection, req *Typing) {
+	limit := m.rx.cfg.TypingRateLimit
+	if limit <= 0 {
+		limit = defaultTypingRateLimit
+	}
+	if !m.typingLimit.allow(conn.UserID, limit, time.Minute, time.Now()) {
+		return
+	}
+	for _, id := range m.typingTo(conn.UserID, req) {
+		m.emit(id, typingEvt, req)
+	}
+}
+
+// sets the sender of the typing event, and returns who should get it.
+func (m *Messenger) typingTo(from string, req *Typing) []string {
+	req.From = from
+	if req.GroupID != "" {
+		g, err := m.getGroup(req.GroupID)
+		if err != nil || !g.isMember(from) {
+			return nil
+		}
+		var rst []string
+		for _, id := range g.memberIDs() {
+			if id != from && m.isOnline(id) && !m.isBlocked(id, from) {
+				rst = append(rst, id)
+			}
+		}
+		return rst
+	}
+	if req.To == "" || req.To == from || !m.isOnline(req.To) || m.isBlocked(req.To, from) {
+		return nil
+	}
+	return []string{req.To}
+}
+
+// counts a new connection of the user, and returns true if the user was not online
+// before, that is either offline or away on all the other connections.
+func (m *Messenger) connect(conn *golem.Connection) bool {
+	m.devMu.Lock()
+	defer m.devMu.Unlock()
+	if m.devices == nil {
+		m.devices = make(map[string]map[*golem.Connection]string)
+	}
+	d, ok := m.devices[conn.UserID]
+	if !ok {
+		d = make(map[*golem.Connection]string)
+		m.devices[conn.UserID] = d
+	}
+	before := deviceStatus(d)
+	d[conn] = statusOnline
+	return before != statusOnline
+}
+
+// forgets the connection, and returns true if it was the last one of the user.
+func (m *Messenger) disconnect(conn *golem.Connection) bool {
+	m.devMu.Lock()
+	defer m.devMu.Unlock()
+	d, ok := m.devices[conn.UserID]
+	if !ok {
+		return false
+	}
+	delete(d, conn)
+	if len(d) > 0 {
+		return false
+	}
+	delete(m.devices, conn.UserID)
+	return true
+}
+
+// sets the status of a single connection, and returns the status of the user and
+// whether it changed. A user is away only when every connection is away.
+func (m *Messenger) setDeviceStatus(conn *golem.Connection, status string) (string, bool) {
+	m.devMu.Lock()
+	defer m.devMu.Unlock()
+	d, ok := m.devices[conn.UserID]
+	if !ok {
+		return statusOffline, false
+	}
+	before := deviceStatus(d)
+	if _, ok = d[conn]; ok {
+		d[conn] = status
+	}
+	after := deviceStatus(d)
+	return after, after != before
+}
+
+func deviceStatus(d map[*golem.Connection]string) string {
+	if len(d) == 0 {
+		return statusOffline
+	}
+	for _, s := range d {
+		if s == statusOnline {
+			return statusOnline
+		}
+	}
+	return statusAway
+}
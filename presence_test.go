@@ -0,0 +1,125 @@
+package aurora
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gernest/golem"
+)
+
+func TestPresence(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		me    = "me"
+		alice = "alice"
+		bob   = "bob"
+		carol = "carol"
+	)
+	for _, id := range []string{me, alice, bob, carol} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.indexMessage(me, &MSG{ID: "1", SenderID: alice, RecipientID: me, SentAt: time.Now()}, true); err != nil {
+		t.Fatal(err)
+	}
+	g, err := m.createGroup(me, "marafiki", []string{bob, alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := m.contacts(me); !reflect.DeepEqual(c, []string{alice, bob}) {
+		t.Errorf("expected %v got %v", []string{alice, bob}, c)
+	}
+
+	m.online.Add(me, 0, me)
+	before := time.Now()
+	m.setPresence(me, statusAway)
+	p := m.presenceOf(me)
+	if p.Status != statusAway || p.LastSeen.Before(before) {
+		t.Errorf("expected %s since %v got %v", statusAway, before, p)
+	}
+
+	// the recorded status does not matter once the user is gone
+	m.online.Delete(me)
+	if p = m.presenceOf(me); p.Status != statusOffline || p.LastSeen.Before(before) {
+		t.Errorf("expected %s with the last seen time got %v", statusOffline, p)
+	}
+	if p = m.presenceOf(carol); p.Status != statusOffline || !p.LastSeen.IsZero() {
+		t.Errorf("expected %s and never seen got %v", statusOffline, p)
+	}
+
+	// typing goes only to online participants
+	m.online.Add(alice, 0, alice)
+	defer m.online.Delete(alice)
+	req := &Typing{GroupID: g.ID, Typing: true}
+	if to := m.typingTo(me, req); !reflect.DeepEqual(to, []string{alice}) || req.From != me {
+		t.Errorf("expected %v from %s got %v from %s", []string{alice}, me, to, req.From)
+	}
+	if to := m.typingTo(carol, &Typing{GroupID: g.ID}); len(to) != 0 {
+		t.Errorf("expected nobody for a stranger got %v", to)
+	}
+	if to := m.typingTo(me, &Typing{To: bob}); len(to) != 0 {
+		t.Errorf("expected nobody for an offline user got %v", to)
+	}
+	if to := m.typingTo(me, &Typing{To: me}); len(to) != 0 {
+		t.Errorf("expected nobody got %v", to)
+	}
+
+	// members who blocked the user don't see it typing, nor its presence
+	if _, err = m.block(alice, me); err != nil {
+		t.Fatal(err)
+	}
+	if to := m.typingTo(me, &Typing{GroupID: g.ID, Typing: true}); len(to) != 0 {
+		t.Errorf("expected nobody got %v", to)
+	}
+	var ids []string
+	for _, v := range m.contactsPresence(me) {
+		ids = append(ids, v.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{bob}) {
+		t.Errorf("expected %v got %v", []string{bob}, ids)
+	}
+}
+
+func TestMessenger_Devices(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	phone := &golem.Connection{UserID: "me"}
+	laptop := &golem.Connection{UserID: "me"}
+	if !m.connect(phone) {
+		t.Error("expected the first connection to bring the user online")
+	}
+	if m.connect(laptop) {
+		t.Error("expected no change for the second connection")
+	}
+
+	// away only when every device is away
+	if s, ok := m.setDeviceStatus(phone, statusAway); ok {
+		t.Errorf("expected no change got %s", s)
+	}
+	if s, ok := m.setDeviceStatus(laptop, statusAway); !ok || s != statusAway {
+		t.Errorf("expected %s got %s", statusAway, s)
+	}
+	tablet := &golem.Connection{UserID: "me"}
+	if !m.connect(tablet) {
+		t.Error("expected a new connection to bring the user back online")
+	}
+
+	// closing one tab leaves the user online
+	if m.disconnect(laptop) || m.disconnect(tablet) {
+		t.Error("expected the user to be online while the phone is connected")
+	}
+	if !m.disconnect(phone) {
+		t.Error("expected the last connection to take the user offline")
+	}
+	if m.disconnect(phone) {
+		t.Error("expected closing twice to do nothing")
+	}
+	if s, ok := m.setDeviceStatus(phone, statusOnline); ok || s != statusOffline {
+		t.Errorf("expected %s got %s", statusOffline, s)
+	}
+}
@@ -0,0 +1,734 @@
+package aurora
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// the bucket in the profile database with the push subscriptions of the profile,
+	// keyed by their ids.
+	pushBucket = "push"
+
+	// the bucket in the profile database with the notification preferences.
+	notificationsBucket = "notifications"
+	prefsKey            = "prefs"
+
+	// the kinds of notifications.
+	notifyMessage = "message"
+	notifyRequest = "request"
+	notifyMention = "mention"
+
+	// the environment variable with the VAPID key, it takes precedence over
+	// RemixConfig.VAPIDKey.
+	vapidKeyEnv = "AURORA_VAPID_KEY"
+
+	// the number of seconds the push service keeps a notification for an offline
+	// device, unless configured otherwise.
+	defaultPushTTL = 86400
+
+	// push services accept at most 4096 bytes, which is a single record.
+	pushRecordSize = 4096
+
+	maxPushSubscriptions = 10
+	maxPushPreview       = 120
+
+	// the notifications being sent at the same time, the rest are dropped. A push
+	// service which doesn't reply in pushTimeout is given up on.
+	maxPushWorkers = 32
+	pushTimeout    = 10 * time.Second
+)
+
+var (
+	errNoPush          = errors.New("aurora: push notifications are not configured")
+	errPushGone        = errors.New("aurora: the push subscription is gone")
+	errPushTooLarge    = errors.New("aurora: the push message is too large")
+	errBadVAPIDKey     = errors.New("aurora: bad VAPID key")
+	errBadSubscription = errors.New("du! usajili huu wa arifa si sahihi")
+	errTooManyDevices  = errors.New("du! vifaa vilivyosajiliwa kwa arifa ni vingi mno")
+	errPrivateAddr     = errors.New("aurora: the push service is not on a public address")
+)
+
+// PushSubscription is where the push service of a browser takes the notifications
+// of one device, it is what PushManager.subscribe gives the client.
+type PushSubscription struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Keys      PushKeys  `json:"keys"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PushKeys are the keys the push messages are encrypted for, base64url encoded.
+type PushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// NotificationPrefs are the notifications a profile wants. Previews puts the text of
+// messages in the notifications, encrypted messages never have one.
+type NotificationPrefs struct {
+	Messages bool `json:"messages"`
+	Requests bool `json:"requests"`
+	Mentions bool `json:"mentions"`
+	Previews bool `json:"previews"`
+}
+
+// Notification is the payload of a push message.
+type Notification struct {
+	Kind           string    `json:"kind"`
+	Title          string    `json:"title"`
+	Body           string    `json:"body"`
+	From           string    `json:"from"`
+	MessageID      string    `json:"message_id"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	GroupID        string    `json:"group_id,omitempty"`
+	SentAt         time.Time `json:"sent_at"`
+}
+
+// Pusher sends push messages.
+type Pusher interface {
+	Push(sub *PushSubscription, payload []byte) error
+}
+
+// WebPusher sends push messages with the web push protocol. The messages are
+// encrypted for the subscription as in RFC 8291, and the push service is told who
+// sends them with VAPID as in RFC 8292.
+type WebPusher struct {
+	Key     *ecdsa.PrivateKey
+	Subject string // a mailto: or https: url the push service can reach us at
+	TTL     int    // seconds
+	Client  *http.Client
+}
+
+// Push encrypts payload and posts it to the endpoint of the subscription. It returns
+// errPushGone when the subscription is not valid anymore.
+func (p *WebPusher) Push(sub *PushSubscription, payload []byte) error {
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := p.vapid(sub.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = defaultPushTTL
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	client := p.Client
+	if client == nil {
+		client = pushClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return errPushGone
+	case res.StatusCode >= 300:
+		return fmt.Errorf("aurora: push service replied %s", res.Status)
+	}
+	return nil
+}
+
+// the client push messages are sent with, unless the pusher has its own. It only
+// connects to public addresses, the endpoints come from the clients and must not
+// reach the services next to aurora.
+var pushClient = &http.Client{
+	Timeout: pushTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: pushTimeout,
+			Control: dialPublic,
+		}).DialContext,
+		TLSHandshakeTimeout: pushTimeout,
+	},
+}
+
+// the networks which are not public, the rest are assumed to be.
+var privateNets = func() []*net.IPNet {
+	var rst []*net.IPNet
+	for _, v := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(v)
+		rst = append(rst, n)
+	}
+	return rst
+}()
+
+// checks if the address is public, that is not loopback, private nor link local.
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// refuses connections to addresses which are not public. It is checked just before
+// connecting, with the address the name of the host resolved to.
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicIP(net.ParseIP(host)) {
+		return errPrivateAddr
+	}
+	return nil
+}
+
+// returns the VAPID authorization header for the push service of endpoint.
+func (p *WebPusher) vapid(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64(`{"typ":"JWT","alg":"ES256"}`)
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": p.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	input := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, p.Key, h[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	copy(sig[32-len(r.Bytes()):32], r.Bytes())
+	copy(sig[64-len(s.Bytes()):], s.Bytes())
+	jwt := input + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return fmt.Sprintf("vapid t=%s, k=%s", jwt, VAPIDPublicKey(p.Key)), nil
+}
+
+func b64(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// decodes base64url, with or without padding as browsers differ.
+func decodeB64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// GenerateVAPIDKey returns a new key for signing push messages.
+func GenerateVAPIDKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// EncodeVAPIDKey returns the private key in the format of RemixConfig.VAPIDKey.
+func EncodeVAPIDKey(k *ecdsa.PrivateKey) string {
+	d := make([]byte, 32)
+	b := k.D.Bytes()
+	copy(d[32-len(b):], b)
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+// ParseVAPIDKey parses a key encoded by EncodeVAPIDKey.
+func ParseVAPIDKey(s string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeB64URL(s)
+	if err != nil || len(d) != 32 {
+		return nil, errBadVAPIDKey
+	}
+	k := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	k.Curve = elliptic.P256()
+	if k.D.Sign() == 0 || k.D.Cmp(k.Curve.Params().N) >= 0 {
+		return nil, errBadVAPIDKey
+	}
+	k.X, k.Y = k.Curve.ScalarBaseMult(d)
+	return k, nil
+}
+
+// VAPIDPublicKey returns the public key which clients pass to PushManager.subscribe
+// as the applicationServerKey.
+func VAPIDPublicKey(k *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(k.Curve, k.X, k.Y))
+}
+
+// HKDF with SHA-256 for up to 32 bytes of output, which is all web push needs.
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:n]
+}
+
+// returns the content encryption key and nonce of a push message, as in RFC 8291.
+func pushKeys(secret, auth, salt, uaPublic, asPublic []byte) (key, nonce []byte) {
+	info := append([]byte("WebPush: info\x00"), uaPublic...)
+	info = append(info, asPublic...)
+	ikm := hkdf(auth, secret, info, 32)
+	key = hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce = hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	return key, nonce
+}
+
+// returns the public key and auth secret of the subscription.
+func subscriptionKeys(sub *PushSubscription) ([]byte, []byte, error) {
+	pub, err := decodeB64URL(sub.Keys.P256dh)
+	if err != nil || len(pub) != 65 {
+		return nil, nil, errBadSubscription
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), pub); x == nil {
+		return nil, nil, errBadSubscription
+	}
+	auth, err := decodeB64URL(sub.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, nil, errBadSubscription
+	}
+	return pub, auth, nil
+}
+
+// encrypts the payload for the subscription with the aes128gcm content encoding, in a
+// single record.
+func encryptPush(sub *PushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, auth, err := subscriptionKeys(sub)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	as, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, as.X, as.Y)
+	ux, uy := elliptic.Unmarshal(curve, uaPublic)
+	sx, _ := curve.ScalarMult(ux, uy, as.D.Bytes())
+	secret := make([]byte, 32)
+	copy(secret[32-len(sx.Bytes()):], sx.Bytes())
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, nonce := pushKeys(secret, auth, salt, uaPublic, asPublic)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the header is the salt, the record size and the public key of the sender.
+	buf := &bytes.Buffer{}
+	buf.Write(salt)
+	binary.Write(buf, binary.BigEndian, uint32(pushRecordSize))
+	buf.WriteByte(byte(len(asPublic)))
+	buf.Write(asPublic)
+
+	// the last record ends with 2.
+	record := append(append([]byte{}, payload...), 2)
+	if buf.Len()+len(record)+gcm.Overhead() > pushRecordSize {
+		return nil, errPushTooLarge
+	}
+	buf.Write(gcm.Seal(nil, nonce, record, nil))
+	return buf.Bytes(), nil
+}
+
+// returns the pusher for the configuration, or nil when there is no VAPID key.
+func newPusher(cfg *RemixConfig) Pusher {
+	s := cfg.VAPIDKey
+	if env := os.Getenv(vapidKeyEnv); env != "" {
+		s = env
+	}
+	if s == "" {
+		return nil
+	}
+	k, err := ParseVAPIDKey(s)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return &WebPusher{Key: k, Subject: cfg.VAPIDSubject, TTL: cfg.PushTTL, Client: pushClient}
+}
+
+// returns the id of the subscription with the given endpoint.
+func subscriptionID(endpoint string) string {
+	h := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(h[:16])
+}
+
+// adds the subscription to the profile, subscribing again with the same endpoint
+// updates its keys.
+func (m *Messenger) subscribe(profileID string, sub *PushSubscription) (*PushSubscription, error) {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errBadSubscription
+	}
+
+	// names are checked again when the push messages are sent, they could resolve
+	// to anything.
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, errBadSubscription
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicIP(ip) {
+		return nil, errBadSubscription
+	}
+	if _, _, err = subscriptionKeys(sub); err != nil {
+		return nil, err
+	}
+	sub.ID = subscriptionID(sub.Endpoint)
+	sub.CreatedAt = time.Now()
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if pdb.Get(pushBucket, sub.ID).Error != nil && len(m.subscriptions(profileID)) >= maxPushSubscriptions {
+		return nil, errTooManyDevices
+	}
+	if err = marshalAndCreate(pdb, sub, pushBucket, sub.ID); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// removes the subscription from the profile.
+func (m *Messenger) unsubscribe(profileID, id string) error {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if pdb.Get(pushBucket, id).Error != nil {
+		return errNotFound
+	}
+	return pdb.Delete(pushBucket, id).Error
+}
+
+// returns the push subscriptions of the profile, the oldest first.
+func (m *Messenger) subscriptions(profileID string) []*PushSubscription {
+	rst := []*PushSubscription{}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	for _, v := range pdb.GetAll(pushBucket).DataList {
+		sub := &PushSubscription{}
+		if err := json.Unmarshal(v, sub); err == nil {
+			rst = append(rst, sub)
+		}
+	}
+	sort.Sort(bySubscribedAt(rst))
+	return rst
+}
+
+type bySubscribedAt []*PushSubscription
+
+func (s bySubscribedAt) Len() int           { return len(s) }
+func (s bySubscribedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySubscribedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+
+// returns the notification preferences of the profile, everything but previews is on
+// unless the profile says otherwise.
+func (m *Messenger) notificationPrefs(profileID string) *NotificationPrefs {
+	prefs := &NotificationPrefs{Messages: true, Requests: true, Mentions: true}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	getAndUnmarshall(pdb, notificationsBucket, prefsKey, prefs)
+	return prefs
+}
+
+func (m *Messenger) setNotificationPrefs(profileID string, prefs *NotificationPrefs) error {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	return marshalAndCreate(pdb, prefs, notificationsBucket, prefsKey)
+}
+
+// checks if the notification is of a kind the profile wants.
+func (p *NotificationPrefs) wants(kind string) bool {
+	switch kind {
+	case notifyMessage:
+		return p.Messages
+	case notifyRequest:
+		return p.Requests
+	case notifyMention:
+		return p.Mentions
+	}
+	return false
+}
+
+// returns the notification about msg.
+func newNotification(kind string, msg *MSG) *Notification {
+	n := &Notification{
+		Kind:           kind,
+		Title:          msg.SenderName,
+		From:           msg.SenderID,
+		MessageID:      msg.ID,
+		ConversationID: msg.ConversationID,
+		GroupID:        msg.GroupID,
+		SentAt:         msg.SentAt,
+	}
+	if msg.Envelope == nil {
+		n.Body = msg.Text
+		if r := []rune(n.Body); len(r) > maxPushPreview {
+			n.Body = string(r[:maxPushPreview]) + "…"
+		}
+	}
+	return n
+}
+
+// the text of a notification without a preview.
+func notificationBody(kind string) string {
+	switch kind {
+	case notifyRequest:
+		return "Mtu mpya anataka kukutumia ujumbe"
+	case notifyMention:
+		return "Umetajwa kwenye kikundi"
+	}
+	return "Una ujumbe mpya"
+}
+
+// sends the notification to every device of the profile, if the profile wants it.
+// Subscriptions which are gone are removed.
+func (m *Messenger) dispatch(profileID string, n *Notification) error {
+	if m.push == nil {
+		return errNoPush
+	}
+	prefs := m.notificationPrefs(profileID)
+	if !prefs.wants(n.Kind) {
+		return nil
+	}
+	if !prefs.Previews || n.Body == "" {
+		n.Body = notificationBody(n.Kind)
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	for _, sub := range m.subscriptions(profileID) {
+		err = m.push.Push(sub, payload)
+		switch err {
+		case nil:
+		case errPushGone:
+			m.unsubscribe(profileID, sub.ID)
+		default:
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// dispatches the notification in the background. When there are already
+// maxPushWorkers notifications being sent the notification is dropped, the message
+// is still in the inbox.
+func (m *Messenger) notify(profileID string, n *Notification) {
+	if m.push == nil {
+		return
+	}
+	m.pushOnce.Do(func() {
+		m.pushSlots = make(chan struct{}, maxPushWorkers)
+	})
+	select {
+	case m.pushSlots <- struct{}{}:
+	default:
+		log.Printf("aurora: too many push notifications, dropped the one for %s", profileID)
+		return
+	}
+	go func() {
+		defer func() { <-m.pushSlots }()
+		if err := m.dispatch(profileID, n); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// notifies the recipient of a direct message, which is a message request when it
+// comes from a stranger.
+func (m *Messenger) notifyMsg(msg *MSG) {
+	kind := notifyMessage
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, msg.RecipientID, m.rx.cfg.DBExtension))
+	c := &Conversation{}
+	if err := getAndUnmarshall(pdb, conversationsBucket, msg.SenderID, c); err == nil && c.Request {
+		kind = notifyRequest
+	}
+	m.notify(msg.RecipientID, newNotification(kind, msg))
+}
+
+// PushStub is a push service which keeps the push messages in memory, it is meant for
+// tests. Subscriptions should have the url of a server running it as the endpoint.
+type PushStub struct {
+	mu       sync.Mutex
+	received []*StubPush
+
+	// Gone makes the stub reply as if all subscriptions expired.
+	Gone bool
+}
+
+// StubPush is a push message received by PushStub.
+type StubPush struct {
+	Path          string
+	Authorization string
+	TTL           string
+	Body          []byte
+}
+
+// ServeHTTP accepts push messages, it checks them about as much as a real push
+// service would.
+func (s *PushStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t=") ||
+		r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, pushRecordSize+1))
+	if err != nil || len(body) > pushRecordSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Gone {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+	s.received = append(s.received, &StubPush{
+		Path:          r.URL.Path,
+		Authorization: r.Header.Get("Authorization"),
+		TTL:           r.Header.Get("TTL"),
+		Body:          body,
+	})
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Received returns the push messages received so far.
+func (s *PushStub) Received() []*StubPush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*StubPush(nil), s.received...)
+}
+
+// APIPushKey returns the VAPID public key, which clients need to subscribe.
+func (rx *Remix) APIPushKey(w http.ResponseWriter, r *http.Request) {
+	p, ok := rx.msg.push.(*WebPusher)
+	if !ok {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	rx.rendr.JSON(w, http.StatusOK, map[string]string{"public_key": VAPIDPublicKey(p.Key)})
+}
+
+// APIPushSubscriptions lists the push subscriptions of the current user. A POST
+// request with the json encoded subscription of a device adds it.
+func (rx *Remix) APIPushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if r.Method == "GET" {
+		rx.rendr.JSON(w, http.StatusOK, rx.msg.subscriptions(p.ID))
+		return
+	}
+	sub := &PushSubscription{}
+	if err = json.NewDecoder(r.Body).Decode(sub); err != nil {
+		rx.apiErr(w, http.StatusBadRequest, errBadForm)
+		return
+	}
+	sub, err = rx.msg.subscribe(p.ID, sub)
+	switch err {
+	case nil:
+		rx.rendr.JSON(w, http.StatusCreated, sub)
+	case errBadSubscription, errTooManyDevices:
+		rx.apiErr(w, http.StatusBadRequest, err)
+	default:
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+	}
+}
+
+// APIPushUnsubscribe removes the push subscription with the id given in the url.
+func (rx *Remix) APIPushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if err = rx.msg.unsubscribe(p.ID, mux.Vars(r)["id"]); err != nil {
+		rx.apiErr(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APINotifications returns the notification preferences of the current user, a PUT
+// request with json encoded NotificationPrefs replaces them.
+func (rx *Remix) APINotifications(w http.ResponseWriter, r *http.Request) {
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		rx.apiErr(w, http.StatusUnauthorized, errForbidden)
+		return
+	}
+	_, p, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+		return
+	}
+	if r.Method == "PUT" {
+		prefs := &NotificationPrefs{}
+		if err = json.NewDecoder(r.Body).Decode(prefs); err != nil {
+			rx.apiErr(w, http.StatusBadRequest, errBadForm)
+			return
+		}
+		if err = rx.msg.setNotificationPrefs(p.ID, prefs); err != nil {
+			rx.apiErr(w, http.StatusInternalServerError, errInternalServer)
+			return
+		}
+	}
+	rx.rendr.JSON(w, http.StatusOK, rx.msg.notificationPrefs(p.ID))
+}
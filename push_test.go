@@ -0,0 +1,351 @@
+package aurora
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a browser which subscribed to push messages.
+type testDevice struct {
+	key  *ecdsa.PrivateKey
+	auth []byte
+}
+
+func newTestDevice(t *testing.T) *testDevice {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDevice{key: k, auth: make([]byte, 16)}
+	rand.Read(d.auth)
+	return d
+}
+
+func (d *testDevice) subscription(endpoint string) *PushSubscription {
+	return &PushSubscription{
+		Endpoint: endpoint,
+		Keys: PushKeys{
+			P256dh: base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), d.key.X, d.key.Y)),
+			Auth:   base64.URLEncoding.EncodeToString(d.auth),
+		},
+	}
+}
+
+// decrypts a push message the way the browser does.
+func (d *testDevice) decrypt(t *testing.T, body []byte) []byte {
+	salt, rs, n := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	asPublic, ciphertext := body[21:21+n], body[21+n:]
+	if rs != pushRecordSize {
+		t.Errorf("expected record size %d got %d", pushRecordSize, rs)
+	}
+	curve := elliptic.P256()
+	ax, ay := elliptic.Unmarshal(curve, asPublic)
+	sx, _ := curve.ScalarMult(ax, ay, d.key.D.Bytes())
+	secret := make([]byte, 32)
+	copy(secret[32-len(sx.Bytes()):], sx.Bytes())
+	key, nonce := pushKeys(secret, d.auth, salt, elliptic.Marshal(curve, d.key.X, d.key.Y), asPublic)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record[len(record)-1] != 2 {
+		t.Errorf("expected the last record delimiter got %d", record[len(record)-1])
+	}
+	return record[:len(record)-1]
+}
+
+// the example of RFC 8291 appendix A.
+func TestPushKeys(t *testing.T) {
+	b64 := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var (
+		asPrivate = b64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+		asPublic  = b64("BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8")
+		uaPublic  = b64("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+		salt      = b64("DGv6ra1nlYgDCS1FRnbzlw")
+		auth      = b64("BTBZMqHH6r4Tts7J_aSIgg")
+	)
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, uaPublic)
+	secret, _ := curve.ScalarMult(x, y, asPrivate)
+	key, nonce := pushKeys(secret.Bytes(), auth, salt, uaPublic, asPublic)
+	if k := base64.RawURLEncoding.EncodeToString(key); k != "oIhVW04MRdy2XN9CiKLxTg" {
+		t.Errorf("expected oIhVW04MRdy2XN9CiKLxTg got %s", k)
+	}
+	if n := base64.RawURLEncoding.EncodeToString(nonce); n != "4h_95klXJ5E_qnoN" {
+		t.Errorf("expected 4h_95klXJ5E_qnoN got %s", n)
+	}
+}
+
+func TestEncryptPush(t *testing.T) {
+	d := newTestDevice(t)
+	sub := d.subscription("https://push.example.com/1")
+	body, err := encryptPush(sub, []byte("habari"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(d.decrypt(t, body)); got != "habari" {
+		t.Errorf("expected habari got %s", got)
+	}
+	if _, err = encryptPush(sub, make([]byte, pushRecordSize)); err != errPushTooLarge {
+		t.Errorf("expected %v got %v", errPushTooLarge, err)
+	}
+	sub.Keys.Auth = "short"
+	if _, err = encryptPush(sub, []byte("habari")); err != errBadSubscription {
+		t.Errorf("expected %v got %v", errBadSubscription, err)
+	}
+}
+
+func TestVAPID(t *testing.T) {
+	k, err := GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseVAPIDKey(EncodeVAPIDKey(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VAPIDPublicKey(parsed) != VAPIDPublicKey(k) {
+		t.Error("expected the parsed key to be the same")
+	}
+	if _, err = ParseVAPIDKey("c2hvcnQ"); err != errBadVAPIDKey {
+		t.Errorf("expected %v got %v", errBadVAPIDKey, err)
+	}
+
+	p := &WebPusher{Key: k, Subject: "mailto:admin@aurora.com"}
+	now := time.Now()
+	h, err := p.vapid("https://push.example.com:8443/send/1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwt, pub string
+	for _, v := range strings.Split(strings.TrimPrefix(h, "vapid "), ", ") {
+		switch {
+		case strings.HasPrefix(v, "t="):
+			jwt = v[2:]
+		case strings.HasPrefix(v, "k="):
+			pub = v[2:]
+		}
+	}
+	if pub != VAPIDPublicKey(k) {
+		t.Errorf("expected the public key got %s", pub)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a jwt got %s", jwt)
+	}
+	claims := make(map[string]interface{})
+	data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err = json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != "https://push.example.com:8443" || claims["sub"] != p.Subject {
+		t.Errorf("expected the audience and subject got %v", claims)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&k.PublicKey, sum[:], r, s) {
+		t.Error("expected a valid signature")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	stub := &PushStub{}
+	srv := httptest.NewTLSServer(stub)
+	defer srv.Close()
+	k, err := GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	me := "me"
+	msg := &MSG{ID: "1", SenderID: "alice", SenderName: "Alice", RecipientID: me, Text: "habari za asubuhi", SentAt: time.Now()}
+	if err = m.dispatch(me, newNotification(notifyMessage, msg)); err != errNoPush {
+		t.Errorf("expected %v got %v", errNoPush, err)
+	}
+
+	// the push service is example.com, which is the stub.
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	m.push = &WebPusher{Key: k, Subject: "mailto:admin@aurora.com", Client: &http.Client{Transport: tr}}
+
+	d := newTestDevice(t)
+	for _, v := range []string{
+		"http://push.example.com/1",
+		"https://localhost/1",
+		"https://127.0.0.1/1",
+		"https://[::1]/1",
+		"https://10.0.0.1/1",
+		"https://192.168.1.1/1",
+		"https://169.254.169.254/1",
+	} {
+		if _, err = m.subscribe(me, d.subscription(v)); err != errBadSubscription {
+			t.Errorf("%s: expected %v got %v", v, errBadSubscription, err)
+		}
+	}
+	sub, err := m.subscribe(me, d.subscription("https://example.com/phone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.subscribe(me, d.subscription("https://example.com/phone")); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.subscriptions(me); len(s) != 1 || s[0].ID != sub.ID {
+		t.Errorf("expected one subscription got %v", s)
+	}
+
+	// without previews the notification doesn't have the text
+	if err = m.dispatch(me, newNotification(notifyMessage, msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := stub.Received()
+	if len(got) != 1 || got[0].Path != "/phone" || got[0].TTL != "86400" {
+		t.Fatalf("expected one push to the phone got %v", got)
+	}
+	n := &Notification{}
+	if err = json.Unmarshal(d.decrypt(t, got[0].Body), n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Kind != notifyMessage || n.Title != "Alice" || n.Body != notificationBody(notifyMessage) || n.MessageID != msg.ID {
+		t.Errorf("expected the notification of the message got %v", n)
+	}
+
+	prefs := &NotificationPrefs{Messages: false, Requests: true, Mentions: true, Previews: true}
+	if err = m.setNotificationPrefs(me, prefs); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.dispatch(me, newNotification(notifyMessage, msg)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.Received()) != 1 {
+		t.Error("expected no push for unwanted notifications")
+	}
+	if err = m.dispatch(me, newNotification(notifyRequest, msg)); err != nil {
+		t.Fatal(err)
+	}
+	got = stub.Received()
+	if len(got) != 2 {
+		t.Fatalf("expected a push for the request got %d", len(got))
+	}
+	if err = json.Unmarshal(d.decrypt(t, got[1].Body), n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Kind != notifyRequest || n.Body != msg.Text {
+		t.Errorf("expected the request with a preview got %v", n)
+	}
+
+	// subscriptions which are gone are forgotten
+	stub.Gone = true
+	if err = m.dispatch(me, newNotification(notifyRequest, msg)); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.subscriptions(me); len(s) != 0 {
+		t.Errorf("expected no subscriptions got %v", s)
+	}
+}
+
+// a pusher which waits until it is released.
+type blockingPusher struct {
+	mu      sync.Mutex
+	n       int
+	release chan struct{}
+}
+
+func (p *blockingPusher) Push(sub *PushSubscription, payload []byte) error {
+	p.mu.Lock()
+	p.n++
+	p.mu.Unlock()
+	<-p.release
+	return nil
+}
+
+func (p *blockingPusher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+func TestNotifyLimit(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	p := &blockingPusher{release: make(chan struct{})}
+	m.push = p
+	me := "me"
+	if _, err := m.subscribe(me, newTestDevice(t).subscription("https://push.example.com/1")); err != nil {
+		t.Fatal(err)
+	}
+	msg := &MSG{ID: "1", SenderID: "alice", RecipientID: me, Text: "habari", SentAt: time.Now()}
+	for i := 0; i < maxPushWorkers+5; i++ {
+		m.notify(me, newNotification(notifyMessage, msg))
+	}
+	for i := 0; i < 100 && p.count() < maxPushWorkers; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := p.count(); n != maxPushWorkers {
+		t.Errorf("expected %d pushes at the same time got %d", maxPushWorkers, n)
+	}
+	close(p.release)
+	for i := 0; i < 100 && len(m.pushSlots) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.notify(me, newNotification(notifyMessage, msg))
+	for i := 0; i < 100 && p.count() == maxPushWorkers; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := p.count(); n != maxPushWorkers+1 {
+		t.Errorf("expected a push once the others are done got %d", n-maxPushWorkers)
+	}
+}
+
+func TestPushClient(t *testing.T) {
+	srv := httptest.NewServer(&PushStub{})
+	defer srv.Close()
+
+	// names which resolve to private addresses are refused when connecting
+	u := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	for _, v := range []string{srv.URL, u} {
+		_, err := pushClient.Post(v, "application/octet-stream", nil)
+		if err == nil || !strings.Contains(err.Error(), errPrivateAddr.Error()) {
+			t.Errorf("%s: expected %v got %v", v, errPrivateAddr, err)
+		}
+	}
+	for _, v := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		if !publicIP(net.ParseIP(v)) {
+			t.Errorf("expected %s to be public", v)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package aurora
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts events by key in fixed windows of time. The zero value is ready
+// to use.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// allow reports whether another event of key is allowed at now, when only limit
+// events are allowed in every window. A limit of zero or less allows everything.
+func (l *rateLimiter) allow(key string, limit int, window time.Duration, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.windows == nil {
+		l.windows = make(map[string]*rateWindow)
+	}
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= window {
+		l.prune(now, window)
+		l.windows[key] = &rateWindow{start: now, count: 1}
+		return true
+	}
+	if w.count >= limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// forgets the windows which are over, so keys which are not used anymore don't pile
+// up.
+func (l *rateLimiter) prune(now time.Time, window time.Duration) {
+	for k, w := range l.windows {
+		if now.Sub(w.start) >= window {
+			delete(l.windows, k)
+		}
+	}
+}
+
+// burstLimiter allows events by key at a steady rate, with bursts of up to a given
+// number of events after a quiet period. The zero value is ready to use.
+type burstLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether another event of key is allowed at now, when limit events
+// are allowed in every window and up to burst of them at once. A limit of zero or
+// less allows everything.
+func (l *burstLimiter) allow(key string, limit, burst int, window time.Duration, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	rate := float64(limit) / float64(window)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now, rate, burst)
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forget removes the key, for keys which won't be used again.
+func (l *burstLimiter) forget(key string) {
+	l.mu.Lock()
+	delete(l.buckets, key)
+	l.mu.Unlock()
+}
+
+// forgets the buckets which are full again, they are no different from new ones.
+func (l *burstLimiter) prune(now time.Time, rate float64, burst int) {
+	for k, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))*rate >= float64(burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package aurora
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", 3, time.Minute, now) {
+			t.Fatalf("expected event %d to be allowed", i)
+		}
+	}
+	if l.allow("a", 3, time.Minute, now) {
+		t.Error("expected the event above the limit to be dropped")
+	}
+	if !l.allow("b", 3, time.Minute, now) {
+		t.Error("expected other keys to have their own limit")
+	}
+	if !l.allow("a", 3, time.Minute, now.Add(time.Minute)) {
+		t.Error("expected the event in the next window to be allowed")
+	}
+	if _, ok := l.windows["b"]; ok {
+		t.Error("expected the window which is over to be forgotten")
+	}
+	if !l.allow("a", 0, time.Minute, now) {
+		t.Error("expected no limit to allow everything")
+	}
+}
+
+func TestBurstLimiter(t *testing.T) {
+	var l burstLimiter
+	now := time.Now()
+
+	// 60 a minute is one a second, after a burst of 3
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", 60, 3, time.Minute, now) {
+			t.Fatalf("expected event %d of the burst to be allowed", i)
+		}
+	}
+	if l.allow("a", 60, 3, time.Minute, now) {
+		t.Error("expected the event above the burst to be dropped")
+	}
+	if !l.allow("a", 60, 3, time.Minute, now.Add(time.Second)) {
+		t.Error("expected an event a second later to be allowed")
+	}
+	if l.allow("a", 60, 3, time.Minute, now.Add(time.Second)) {
+		t.Error("expected only one event a second after the burst")
+	}
+	if !l.allow("b", 60, 3, time.Minute, now.Add(time.Minute)) {
+		t.Error("expected other keys to have their own limit")
+	}
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("expected the full bucket to be forgotten")
+	}
+	l.forget("b")
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("expected the bucket to be forgotten")
+	}
+	if !l.allow("a", 0, 0, time.Minute, now) {
+		t.Error("expected no limit to allow everything")
+	}
+}
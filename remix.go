@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -20,6 +22,15 @@ var (
 	errInternalServer = errors.New("du! naona imezingua, jaribu tena badae")
 	errForbidden      = errors.New("du! hauna ruhususa ya kufika kwenye hii kurasa")
 	errBadForm        = errors.New("du! inaonekana fomu haujaijaza vizuri, tafadhali rudia tena")
+	errUnverified     = errors.New("du! unatakiwa kuthibitisha email yako kwanza")
+)
+
+var (
+	resetMailSubject = "Badili namba ya siri"
+	resetMailBody    = "Habari %s,\n\nFungua kiungo hiki ili kubadili namba yako ya siri\n\n%s\n\nKama hukuomba kubadili namba ya siri, puuza ujumbe huu.\n"
+
+	verifyMailSubject = "Thibitisha email yako"
+	verifyMailBody    = "Habari %s,\n\nKaribu aurora, fungua kiungo hiki ili kuthibitisha email yako\n\n%s\n"
 )
 
 // Remix all the fun is here
@@ -29,6 +40,7 @@ type Remix struct {
 	rendr *render.Render
 	cfg   *RemixConfig
 	msg   *Messenger
+	mail  Mailer
 }
 
 // RemixConfig contain configuration values for Remix
@@ -54,6 +66,19 @@ type RemixConfig struct {
 	SessMaxAge     int    `json:"sessions_max_age"`
 	SessionPath    string `json:"session_path"`
 
+	// SessCleanupInterval is the number of seconds between removing expired
+	// sessions from the database, zero disables the cleanup.
+	SessCleanupInterval int `json:"sessions_cleanup_interval"`
+
+	// SessionKeys are the hash/block key pairs used to sign and encrypt session
+	// cookies. The first pair is used for new cookies, the rest are kept only to
+	// decode cookies signed with older keys. Rotating keys is a matter of
+	// prepending a fresh pair.
+	//
+	// When the AURORA_SESSION_KEYS environment variable is set, it takes
+	// precedence over this value.
+	SessionKeys []*SessionKey `json:"session_keys"`
+
 	// The path to point to when login is success
 	LoginRedirect string `json:"login_redirect"`
 
@@ -62,6 +87,122 @@ type RemixConfig struct {
 
 	MessagesBucket string `json:"messages_bucket"`
 
+	// AttachmentsField is the form field holding files attached to messages. Files
+	// bigger than AttachmentMaxSize bytes, or whose type is not one of
+	// AttachmentTypes, are refused.
+	AttachmentsField  string   `json:"attachments_field"`
+	AttachmentMaxSize int      `json:"attachment_max_size"`
+	AttachmentTypes   []string `json:"attachment_types"`
+
+	// BrokerAddr is the address of the broker server which connects the nodes
+	// running the messenger, see BrokerServer. The messenger runs on its own when it
+	// is empty.
+	BrokerAddr string `json:"broker_addr"`
+
+	// BrokerSecret is the secret the broker server was started with, nodes which
+	// don't know it are refused. The AURORA_BROKER_SECRET environment variable
+	// takes precedence.
+	BrokerSecret string `json:"broker_secret"`
+
+	// PhotoSizes are the sizes photos can be served in, by name, with the length of
+	// the longest side in pixels e.g {"thumb": 150}. The resized photos are made
+	// the first time they are asked for and kept alongside the original.
+	PhotoSizes map[string]int `json:"photo_sizes"`
+
+	// GroupsDB is the database where group chats and their messages are stored, it
+	// defaults to groups in the DBDir.
+	GroupsDB string `json:"groups_database"`
+
+	// Mailer is the way emails are sent, it is one of smtp, file or memory. The
+	// memory mailer is the default and it does not send anything.
+	Mailer       string `json:"mailer"`
+	MailFrom     string `json:"mail_from"`
+	SMTPAddr     string `json:"smtp_addr"`
+	SMTPUser     string `json:"smtp_user"`
+	SMTPPassword string `json:"smtp_password"`
+
+	// MailDir is where the file mailer writes emails.
+	MailDir string `json:"mail_dir"`
+
+	// TokensBucket is the bucket in the accounts database where one time tokens
+	// are stored.
+	TokensBucket string `json:"tokens_bucket"`
+
+	// ResetTokenTTL is the number of seconds a password reset link is valid.
+	ResetTokenTTL int `json:"reset_token_ttl"`
+
+	// VerifyTokenTTL is the number of seconds an email verification link is valid.
+	VerifyTokenTTL int `json:"verify_token_ttl"`
+
+	// TOTPKey is the base64 encoded 32 bytes key used to encrypt two factor
+	// authentication secrets. Two factor authentication is not available without
+	// it. The AURORA_TOTP_KEY environment variable takes precedence.
+	TOTPKey string `json:"totp_key"`
+
+	// TOTPIssuer is the name shown in authenticator apps, defaults to AppName.
+	TOTPIssuer string `json:"totp_issuer"`
+
+	// RequireVerifiedEmail restricts accounts whose email is not verified, they
+	// can neither use the messenger nor upload photos.
+	RequireVerifiedEmail bool `json:"require_verified_email"`
+
+	// LoginMaxAttempts is the number of failed logins of an account before it is
+	// locked, and LoginMaxAttemptsIP is the same for an IP address. Every failure
+	// after that doubles the lockout, starting from LoginLockout seconds up to
+	// LoginMaxLockout seconds.
+	LoginMaxAttempts    int    `json:"login_max_attempts"`
+	LoginMaxAttemptsIP  int    `json:"login_max_attempts_ip"`
+	LoginLockout        int    `json:"login_lockout"`
+	LoginMaxLockout     int    `json:"login_max_lockout"`
+	LoginAttemptsBucket string `json:"login_attempts_bucket"`
+
+	// AuditBucket is the bucket in the accounts database where audit events are
+	// stored.
+	AuditBucket string `json:"audit_bucket"`
+
+	// Admins are the email addresses of the users who can unlock accounts.
+	Admins []string `json:"admins"`
+
+	// DeletionGracePeriod is the number of seconds between a user asking for the
+	// account to be deleted and the account being purged.
+	DeletionGracePeriod int `json:"deletion_grace_period"`
+
+	// DeliveryRetryInterval is the number of seconds between attempts to deliver a
+	// message which is not acknowledged by the recipient, zero disables retries but
+	// pending messages are still sent again when the recipient connects. Every
+	// attempt doubles the wait up to DeliveryMaxRetryInterval seconds, and after
+	// DeliveryMaxAttempts the message goes back to the drafts of the sender.
+	DeliveryRetryInterval    int `json:"delivery_retry_interval"`
+	DeliveryMaxRetryInterval int `json:"delivery_max_retry_interval"`
+	DeliveryMaxAttempts      int `json:"delivery_max_attempts"`
+
+	// UnsendWindow is the number of seconds after sending a message during which the
+	// sender can delete it for everyone.
+	UnsendWindow int `json:"unsend_window"`
+
+	// TypingRateLimit and PresenceRateLimit are the number of typing and presence
+	// events a user can send in a minute, the rest are dropped.
+	TypingRateLimit   int `json:"typing_rate_limit"`
+	PresenceRateLimit int `json:"presence_rate_limit"`
+
+	// MessageRateLimit is the number of messages a user can send in a minute, from
+	// all devices, and ConnMessageRateLimit the number a single connection can.
+	// Both allow MessageBurst messages at once before they kick in.
+	MessageRateLimit     int `json:"message_rate_limit"`
+	ConnMessageRateLimit int `json:"conn_message_rate_limit"`
+	MessageBurst         int `json:"message_burst"`
+
+	// VAPIDKey is the key push notifications are signed with, generate one with
+	// aurora keygen -vapid. Without it there are no push notifications. The
+	// AURORA_VAPID_KEY environment variable takes precedence.
+	//
+	// VAPIDSubject is a mailto: or https: url the push services can reach the
+	// admins at, and PushTTL the number of seconds they keep notifications for
+	// devices which are offline.
+	VAPIDKey     string `json:"vapid_key"`
+	VAPIDSubject string `json:"vapid_subject"`
+	PushTTL      int    `json:"push_ttl"`
+
 	TemplatesExtensions []string `json:"templates_extensions"`
 	TemplatesDir        string   `json:"templates_dir"`
 	DevMode             bool     `json:"dev_mode"`
@@ -76,9 +217,20 @@ type jsonErr struct {
 	Text string `json:"test"`
 }
 
-// NewRemix iitialize a *Remix instance using the given cfg
-func NewRemix(cfg *RemixConfig) *Remix {
-	secret := []byte("my-top-secret")
+// NewRemix iitialize a *Remix instance using the given cfg. It fails when the
+// configured session keys are not valid.
+func NewRemix(cfg *RemixConfig) (*Remix, error) {
+	secrets, err := cfg.SessionSecrets()
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		// Without configured keys cookies won't survive a restart, which is fine
+		// for development but surely not what you want in production.
+		log.Println("aurora: no session keys configured, using a random key pair")
+		k := GenerateSessionKey()
+		secrets = [][]byte{k.hash(), k.block()}
+	}
 	rOpts := render.Options{
 		Directory:     cfg.TemplatesDir,
 		Extensions:    cfg.TemplatesExtensions,
@@ -90,15 +242,52 @@ func NewRemix(cfg *RemixConfig) *Remix {
 		Path:   cfg.SessionPath,
 	}
 	db := nutz.NewStorage(cfg.SessionsDB, 0600, nil)
-	store := NewSessStore(db, cfg.SessionsBucket, 10, sOpts, secret)
+	store := NewSessStore(db, cfg.SessionsBucket, 10, sOpts, secrets...)
+	if cfg.SessCleanupInterval > 0 {
+		store.StartCleanup(time.Duration(cfg.SessCleanupInterval) * time.Second)
+	}
 	rx := &Remix{
 		db:    db,
 		sess:  store,
 		rendr: render.New(rOpts),
 		cfg:   cfg,
+		mail:  newMailer(cfg),
 	}
 	rx.msg = NewMessenger(rx)
-	return rx
+	if cfg.DeliveryRetryInterval > 0 {
+		rx.msg.StartDelivery(time.Duration(cfg.DeliveryRetryInterval) * time.Second)
+	}
+	return rx, nil
+}
+
+// Close stops the background work started by NewRemix.
+func (rx *Remix) Close() {
+	rx.sess.StopCleanup()
+	rx.msg.StopDelivery()
+	rx.msg.broker.Close()
+}
+
+// SessionSecrets returns the session keys as hash/block pairs suitable for
+// securecookie.CodecsFromPairs, newest first. Keys are read from the
+// AURORA_SESSION_KEYS environment variable if it is set, otherwise from
+// SessionKeys.
+func (c *RemixConfig) SessionSecrets() ([][]byte, error) {
+	keys := c.SessionKeys
+	if env := os.Getenv(sessionKeysEnv); env != "" {
+		k, err := ParseSessionKeys(env)
+		if err != nil {
+			return nil, err
+		}
+		keys = k
+	}
+	var rst [][]byte
+	for _, k := range keys {
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		rst = append(rst, k.hash(), k.block())
+	}
+	return rst, nil
 }
 
 // Home is where the homepage is
@@ -159,6 +348,9 @@ func (rx *Remix) Register(w http.ResponseWriter, r *http.Request) {
 			rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
 			return
 		}
+		if err = rx.sendVerification(&user); err != nil {
+			log.Println(err)
+		}
 		flash := NewFlash()
 		flash.Success("akaunti imefanikiwa kutengenezwa")
 		flash.Save(ss)
@@ -218,21 +410,48 @@ func (rx *Remix) Login(w http.ResponseWriter, r *http.Request) {
 		}
 
 		lform := form.GetModel().(loginForm)
+		ip := clientIP(r)
+		if until := rx.lockedUntil(lform.Email, ip); !until.IsZero() {
+			data.Add("error", lockedMsg(until))
+			rx.rendr.HTML(w, http.StatusTooManyRequests, loginPath, data)
+			return
+		}
 		user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, lform.Email)
-		if err != nil {
+		if err != nil || user.deleted() {
+			rx.loginFailed(lform.Email, ip)
 			data.Add("error", "email au namba ya siri sio sahihi, tafadhali jaribu tena")
 			rx.rendr.HTML(w, http.StatusOK, loginPath, data)
 			return
 		}
 		if err = verifyPass(user.Password(), lform.Password); err != nil {
+			rx.loginFailed(lform.Email, ip)
 			data.Add("error", "email au namba ya siri sio sahihi, tafadhali jaribu tena")
 			rx.rendr.HTML(w, http.StatusOK, loginPath, data)
 			return
 		}
+		if user.TOTPSecret == "" {
+			rx.loginSucceeded(user.EmailAddress)
+		}
 		ss, err = rx.sess.New(r, rx.cfg.SessionName)
 		if err != nil {
 			//log this
 		}
+		if user.TOTPSecret != "" {
+			ss.Values[pendingUserKey] = user.EmailAddress
+			ss.Values[pendingAtKey] = time.Now().Unix()
+			ss.Values[pendingTriesKey] = 0
+			err = ss.Save(r, w)
+			if err != nil {
+				rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+				return
+			}
+			http.Redirect(w, r, "/auth/2fa", http.StatusFound)
+			return
+		}
+		if rx.cancelDeletion(user) {
+			flash.Success(MsgDeletionCanceled)
+			flash.Save(ss)
+		}
 		ss.Values["user"] = user.EmailAddress
 		ss.Values["isAuthorized"] = true
 		err = ss.Save(r, w)
@@ -245,16 +464,220 @@ func (rx *Remix) Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ServeImages serves images uploaded by users
+// ForgotPassword sends a password reset link to the posted email address. The
+// response is the same whether there is such an account or not, so that the form
+// can't be used to find out who has an account.
+func (rx *Remix) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		data       = render.NewTemplateData()
+		forgotPath = "auth/forgot"
+	)
+	if r.Method == "GET" {
+		rx.rendr.HTML(w, http.StatusOK, forgotPath, data)
+		return
+	}
+	form := ComposeForgotForm()(r)
+	if !form.IsValid() {
+		data.Add("errors", form.Errors())
+		rx.rendr.HTML(w, http.StatusOK, forgotPath, data)
+		return
+	}
+	f := form.GetModel().(forgotForm)
+	user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, f.Email)
+	if err == nil {
+		ttl := secondsOr(rx.cfg.ResetTokenTTL, 3600)
+		err = rx.sendToken(resetToken, user, "/auth/reset", ttl, resetMailSubject, resetMailBody)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	data.Add("success", "kama akaunti ipo, tumekutumia email yenye maelekezo")
+	rx.rendr.HTML(w, http.StatusOK, forgotPath, data)
+}
+
+// ResetPassword sets a new password using the token sent by ForgotPassword. All the
+// sessions of the user are signed out afterwards.
+func (rx *Remix) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		data      = render.NewTemplateData()
+		resetPath = "auth/reset"
+		loginPath = "/auth/login"
+		tdb       = setDB(rx.db, rx.cfg.AccountsDB)
+	)
+	if r.Method == "GET" {
+		tok := r.URL.Query().Get("token")
+		if _, err := peekToken(tdb, rx.tokensBucket(), resetToken, tok); err != nil {
+			data.Add("error", err.Error())
+			rx.rendr.HTML(w, http.StatusBadRequest, resetPath, data)
+			return
+		}
+		data.Add("token", tok)
+		rx.rendr.HTML(w, http.StatusOK, resetPath, data)
+		return
+	}
+	form := ComposeResetForm()(r)
+	if !form.IsValid() {
+		data.Add("errors", form.Errors())
+		data.Add("token", r.FormValue("token"))
+		rx.rendr.HTML(w, http.StatusOK, resetPath, data)
+		return
+	}
+	f := form.GetModel().(resetForm)
+	t, err := consumeToken(tdb, rx.tokensBucket(), resetToken, f.Token)
+	if err != nil {
+		data.Add("error", err.Error())
+		rx.rendr.HTML(w, http.StatusBadRequest, resetPath, data)
+		return
+	}
+	user, err := GetUser(tdb, rx.cfg.AccountsBucket, t.Email)
+	if err != nil {
+		data.Add("error", errBadToken.Error())
+		rx.rendr.HTML(w, http.StatusBadRequest, resetPath, data)
+		return
+	}
+	user.Pass, err = hashPassword(f.Pass)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	user.UpdatedAt = time.Now()
+	err = UpdateUser(tdb, user, rx.cfg.AccountsBucket)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	if _, err = rx.sess.RevokeAll(user.EmailAddress, ""); err != nil {
+		log.Println(err)
+	}
+	ss := rx.freshSession(r)
+	flash := NewFlash()
+	flash.Success("namba ya siri imebadilishwa, tafadhali ingia tena")
+	flash.Save(ss)
+	ss.Save(r, w)
+	http.Redirect(w, r, loginPath, http.StatusFound)
+}
+
+// Verify confirms the email address of a user, with the token sent on registration.
+// Opening the link only shows a form to confirm, the token is used when the form is
+// posted so that mail scanners which follow links don't use it up. Posting without
+// a token sends a new verification email to the current user.
+func (rx *Remix) Verify(w http.ResponseWriter, r *http.Request) {
+	var (
+		data       = rx.setSessionData(r)
+		verifyPath = "auth/verify"
+		loginPath  = "/auth/login"
+		adb        = setDB(rx.db, rx.cfg.AccountsDB)
+	)
+	if r.Method == "GET" {
+		tok := r.URL.Query().Get("token")
+		if _, err := peekToken(adb, rx.tokensBucket(), verifyToken, tok); err != nil {
+			data.Add("error", err.Error())
+			rx.rendr.HTML(w, http.StatusBadRequest, verifyPath, data)
+			return
+		}
+		data.Add("token", tok)
+		rx.rendr.HTML(w, http.StatusOK, verifyPath, data)
+		return
+	}
+	tok := r.FormValue("token")
+	if tok == "" {
+		ss, ok := rx.isInSession(r)
+		if !ok {
+			http.Redirect(w, r, loginPath, http.StatusFound)
+			return
+		}
+		user, _, err := rx.getCurrentUserAndProfile(ss)
+		if err != nil {
+			rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+			return
+		}
+		if !user.EmailVerified {
+			if err = rx.sendVerification(user); err != nil {
+				log.Println(err)
+				rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+				return
+			}
+		}
+		data.Add("success", "tumekutumia email nyingine ya kuthibitisha")
+		rx.rendr.HTML(w, http.StatusOK, verifyPath, data)
+		return
+	}
+	t, err := consumeToken(adb, rx.tokensBucket(), verifyToken, tok)
+	if err != nil {
+		data.Add("error", err.Error())
+		rx.rendr.HTML(w, http.StatusBadRequest, verifyPath, data)
+		return
+	}
+	user, err := GetUser(adb, rx.cfg.AccountsBucket, t.Email)
+	if err != nil {
+		data.Add("error", errBadToken.Error())
+		rx.rendr.HTML(w, http.StatusBadRequest, verifyPath, data)
+		return
+	}
+	user.EmailVerified = true
+	user.VerifiedAt = time.Now()
+	err = UpdateUser(adb, user, rx.cfg.AccountsBucket)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	data.Add("success", "asante, email yako imethibitishwa")
+	rx.rendr.HTML(w, http.StatusOK, verifyPath, data)
+}
+
+// sends an email verification link to the user.
+func (rx *Remix) sendVerification(user *User) error {
+	ttl := secondsOr(rx.cfg.VerifyTokenTTL, 24*3600)
+	return rx.sendToken(verifyToken, user, "/auth/verify", ttl, verifyMailSubject, verifyMailBody)
+}
+
+// checks if the user is allowed to do things which require a verified email.
+func (rx *Remix) isVerified(user *User) bool {
+	return !rx.cfg.RequireVerifiedEmail || user.EmailVerified
+}
+
+// creates a one time token of the given kind for the user, and emails a link to
+// path with the token. The subject and body are used for the email, body is a format
+// string which takes the name of the user and the link.
+func (rx *Remix) sendToken(kind string, user *User, path string, ttl time.Duration, subject, body string) error {
+	tok, err := issueToken(setDB(rx.db, rx.cfg.AccountsDB), rx.tokensBucket(), kind, user.EmailAddress, ttl)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s%s?%s", rx.cfg.AppURL, path, url.Values{"token": {tok}}.Encode())
+	return rx.mail.Send(&Mail{
+		From:    rx.cfg.MailFrom,
+		To:      user.EmailAddress,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, user.FirstName, link),
+	})
+}
+
+func (rx *Remix) tokensBucket() string {
+	if rx.cfg.TokensBucket == "" {
+		return "tokens"
+	}
+	return rx.cfg.TokensBucket
+}
+
+// returns a brand new session, even when the request has a valid session.
+func (rx *Remix) freshSession(r *http.Request) *sessions.Session {
+	ss, _ := rx.sess.New(r, rx.cfg.SessionName)
+	ss.ID = ""
+	ss.IsNew = true
+	ss.Values = make(map[interface{}]interface{})
+	return ss
+}
+
+// ServeImages serves images uploaded by users. The size query parameter picks one
+// of the PhotoSizes, without it the original photo is served.
 func (rx *Remix) ServeImages(w http.ResponseWriter, r *http.Request) {
 	var (
-		vars        = r.URL.Query()
-		pic         = &Photo{}
-		imageID     = vars.Get("iid")
-		profileID   = vars.Get("pid")
-		photoBucket = "photos"
-		metaBucket  = "meta"
-		dataBucket  = "data"
+		vars      = r.URL.Query()
+		pic       = &Photo{}
+		imageID   = vars.Get("iid")
+		profileID = vars.Get("pid")
+		size      = vars.Get("size")
 	)
 
 	pdb := getProfileDatabase(rx.cfg.DBDir, profileID, rx.cfg.DBExtension)
@@ -265,13 +688,23 @@ func (rx *Remix) ServeImages(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	raw := db.Get(photoBucket, imageID, dataBucket)
-	if raw.Error != nil {
+	picName := fmt.Sprintf("%s.%s", pic.ID, pic.Type)
+	if size == "" || size == "original" {
+		serveUpload(w, r, db, photoBucket, imageID, picName, pic.UpdatedAt)
+		return
+	}
+	maxSide, ok := photoSize(rx.cfg, size)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	data, err := getRendition(db, photoBucket, pic, maxSide)
+	if err != nil {
+		log.Println(err)
 		http.NotFound(w, r)
 		return
 	}
-	picName := fmt.Sprintf("%s.%s", pic.ID, pic.Type)
-	http.ServeContent(w, r, picName, pic.UpdatedAt, bytes.NewReader(raw.Data))
+	http.ServeContent(w, r, picName, pic.UpdatedAt, bytes.NewReader(data))
 }
 
 // Uploads uploads files
@@ -288,12 +721,17 @@ func (rx *Remix) Uploads(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method == "POST" {
-		_, profile, err := rx.getCurrentUserAndProfile(ss)
+		user, profile, err := rx.getCurrentUserAndProfile(ss)
 		if err != nil {
 			jr := &jsonUploads{Error: err.Error()}
 			rx.rendr.JSON(w, http.StatusInternalServerError, jr)
 			return
 		}
+		if !rx.isVerified(user) {
+			jr := &jsonUploads{Error: errUnverified.Error()}
+			rx.rendr.JSON(w, http.StatusForbidden, jr)
+			return
+		}
 
 		pdbStr := getProfileDatabase(rx.cfg.DBDir, profile.ID, rx.cfg.DBExtension)
 		pdb := setDB(rx.db, pdbStr)
@@ -511,6 +949,69 @@ func (rx *Remix) Profile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Sessions lists the sessions of the current user, that is where the user is logged
+// in. Posting the id of a session signs out that session, posting all=true signs out
+// all the sessions except the current one.
+func (rx *Remix) Sessions(w http.ResponseWriter, r *http.Request) {
+	var (
+		data         = rx.setSessionData(r)
+		sessionsPath = "auth/sessions"
+		loginPath    = "/auth/login"
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	if r.Method == "POST" {
+		var (
+			flash = NewFlash()
+			owner = ss.Values["user"].(string)
+			id    = r.FormValue("id")
+			err   error
+		)
+		switch {
+		case r.FormValue("all") == "true":
+			_, err = rx.sess.RevokeAll(owner, ss.ID)
+		case id != "" && id != sessionHandle(ss.ID):
+			err = rx.sess.Revoke(owner, id)
+		default:
+			err = errBadForm
+		}
+		if err != nil {
+			flash.Error(errInternalServer.Error())
+		} else {
+			flash.Success("umefanikiwa kutoka kwenye vifaa vingine")
+		}
+		flash.Save(ss)
+		ss.Save(r, w)
+		http.Redirect(w, r, "/auth/sessions", http.StatusFound)
+		return
+	}
+	list, err := rx.userSessions(ss)
+	if err != nil {
+		data.Add("error", errInternalServer.Error())
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	data.Add("sessions", list)
+	rx.rendr.HTML(w, http.StatusOK, sessionsPath, data)
+}
+
+// returns active sessions of the owner of ss, marking ss as the current session.
+func (rx *Remix) userSessions(ss *sessions.Session) ([]*SessionInfo, error) {
+	owner, _ := ss.Values["user"].(string)
+	list, err := rx.sess.UserSessions(owner)
+	if err != nil {
+		return nil, err
+	}
+	current := sessionHandle(ss.ID)
+	for _, v := range list {
+		v.Current = v.ID == current
+	}
+	return list, nil
+}
+
 func (rx *Remix) getAllProfiles() ([]*Profile, error) {
 	var rst []*Profile
 	usrs, err := GetAllUsers(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket)
@@ -540,6 +1041,16 @@ func (rx *Remix) Routes() *mux.Router {
 		registerPath  = "/auth/register"
 		loginPath     = "/auth/login"
 		logoutPath    = "/auth/logout"
+		forgotPath    = "/auth/forgot"
+		resetPath     = "/auth/reset"
+		verifyPath    = "/auth/verify"
+		tfaPath       = "/auth/2fa"
+		tfaSetupPath  = "/auth/2fa/setup"
+		sessionsPath  = "/auth/sessions"
+		passwordPath  = "/auth/password"
+		emailPath     = "/auth/email"
+		deletePath    = "/account/delete"
+		exportPath    = "/account/export"
 		imagesPath    = "/imgs"
 		uploadsPath   = "/uploads"
 		profilePath   = "/profile"
@@ -550,10 +1061,22 @@ func (rx *Remix) Routes() *mux.Router {
 	h.HandleFunc(registerPath, rx.Register).Methods("GET", "POST")
 	h.HandleFunc(loginPath, rx.Login).Methods("GET", "POST")
 	h.HandleFunc(logoutPath, rx.Logout)
+	h.HandleFunc(forgotPath, rx.ForgotPassword).Methods("GET", "POST")
+	h.HandleFunc(resetPath, rx.ResetPassword).Methods("GET", "POST")
+	h.HandleFunc(verifyPath, rx.Verify).Methods("GET", "POST")
+	h.HandleFunc(tfaPath, rx.TwoFactor).Methods("GET", "POST")
+	h.HandleFunc(tfaSetupPath, rx.TwoFactorSetup).Methods("GET", "POST")
+	h.HandleFunc(sessionsPath, rx.Sessions).Methods("GET", "POST")
+	h.HandleFunc(passwordPath, rx.ChangePassword).Methods("GET", "POST")
+	h.HandleFunc(emailPath, rx.ChangeEmail).Methods("GET", "POST")
+	h.HandleFunc(deletePath, rx.DeleteAccount).Methods("GET", "POST")
+	h.HandleFunc(exportPath, rx.ExportAccount).Methods("GET")
 	h.HandleFunc(imagesPath, rx.ServeImages).Methods("GET")
+	h.HandleFunc(attachmentsPath, rx.ServeAttachment).Methods("GET")
 	h.HandleFunc(uploadsPath, rx.Uploads)
 	h.HandleFunc(profilePath, rx.Profile)
 	h.HandleFunc(messengerPath, rx.msg.Handler())
+	rx.apiRoutes(h.PathPrefix(apiPrefix).Subrouter())
 	return h
 }
 
@@ -609,6 +1132,15 @@ func (rx *Remix) getCurrentUserAndProfile(ss *sessions.Session) (*User, *Profile
 	return nil, nil, errors.New("aurora: session values not set")
 }
 
+// returns the duration of the given number of seconds, or def seconds when n is not
+// positive.
+func secondsOr(n, def int) time.Duration {
+	if n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
 // switches databases
 func setDB(db nutz.Storage, dbname string) nutz.Storage {
 	d := db
@@ -2,6 +2,7 @@ package aurora
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,8 +10,12 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
 )
 
 func TestRemix_Home(t *testing.T) {
@@ -658,6 +663,310 @@ func TestRemix_Profile(t *testing.T) {
 	}
 }
 
+func TestRemix_ResetPassword(t *testing.T) {
+	var (
+		email      = "reset@aurora.com"
+		pass       = "mamamia"
+		newPass    = "mamamia2"
+		forgotPath = "/auth/forgot"
+		resetPath  = "/auth/reset"
+		loginPath  = "/auth/login"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+
+	usr := &User{UUID: getUUID(), EmailAddress: email, FirstName: "reset"}
+	ps, err := hashPassword(pass)
+	if err != nil {
+		t.Error(err)
+	}
+	usr.Pass = ps
+	err = CreateAccount(setDB(rx.db, rx.cfg.AccountsDB), usr, rx.cfg.AccountsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.PostForm(ts.URL+forgotPath, url.Values{"email": {email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	m := rx.mail.(*MemMailer).Last(email)
+	if m == nil {
+		t.Fatal("Expected a reset email")
+	}
+	tok := regexp.MustCompile(`token=([^\s]+)`).FindStringSubmatch(m.Body)
+	if len(tok) != 2 {
+		t.Fatalf("Expected %s to contain a token", m.Body)
+	}
+	token, err := url.QueryUnescape(tok[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = client.Get(ts.URL + resetPath + "?token=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusBadRequest, "reset")
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.Get(ts.URL + resetPath + "?" + url.Values{"token": {token}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "reset-form")
+	if err != nil {
+		t.Error(err)
+	}
+
+	vars := url.Values{"token": {token}, "pass": {newPass}, "confirm_pass": {newPass}}
+	res, err = client.PostForm(ts.URL+resetPath, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "login-form")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the token can't be used twice
+	res, err = client.PostForm(ts.URL+resetPath, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyPass(user.Pass, newPass); err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+loginPath, url.Values{"email": {email}, "password": {newPass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "search")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemix_Verify(t *testing.T) {
+	var (
+		email        = "verify@aurora.com"
+		pass         = "mamamia"
+		registerPath = "/auth/register"
+		uploadPath   = "/uploads"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+	rx.cfg.RequireVerifiedEmail = true
+	defer func() { rx.cfg.RequireVerifiedEmail = false }()
+
+	vars := url.Values{
+		"first_name":    {"verify"},
+		"last_name":     {"aurora"},
+		"email_address": {email},
+		"pass":          {pass},
+		"confirm_pass":  {pass},
+	}
+	res, err := client.PostForm(ts.URL+registerPath, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Error("Expected a new account not to be verified")
+	}
+
+	// unverified accounts can't upload
+	content, contentType := testUpData("me.jpg", "single", t)
+	res, err = client.Post(ts.URL+uploadPath, contentType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusForbidden, errUnverified.Error())
+	if err != nil {
+		t.Error(err)
+	}
+
+	m := rx.mail.(*MemMailer).Last(email)
+	if m == nil {
+		t.Fatal("Expected a verification email")
+	}
+	link := regexp.MustCompile(`/auth/verify\?token=\S+`).FindString(m.Body)
+	if link == "" {
+		t.Fatalf("Expected %s to contain a verification link", m.Body)
+	}
+	res, err = client.Get(ts.URL + link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "verify-form")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// following the link doesn't use up the token, posting the form does
+	user, err = GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Error("Expected the account not to be verified by opening the link")
+	}
+	tok := strings.TrimPrefix(link, "/auth/verify?token=")
+	if tok, err = url.QueryUnescape(tok); err != nil {
+		t.Fatal(err)
+	}
+	res, err = client.PostForm(ts.URL+"/auth/verify", url.Values{"token": {tok}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "verify")
+	if err != nil {
+		t.Error(err)
+	}
+	user, err = GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Error("Expected the account to be verified")
+	}
+
+	content, contentType = testUpData("me.jpg", "single", t)
+	res, err = client.Post(ts.URL+uploadPath, contentType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "jpg")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemix_TwoFactor(t *testing.T) {
+	var (
+		email     = "twofactor@aurora.com"
+		pass      = "mamamia"
+		loginPath = "/auth/login"
+		tfaPath   = "/auth/2fa"
+	)
+	ts, client, rx := testServer(t)
+	defer ts.Close()
+	key := securecookie.GenerateRandomKey(32)
+	rx.cfg.TOTPKey = base64.StdEncoding.EncodeToString(key)
+	defer func() { rx.cfg.TOTPKey = "" }()
+
+	secret := newTOTPSecret()
+	enc, err := encryptSecret(key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes := newRecoveryCodes()
+	usr := &User{UUID: getUUID(), EmailAddress: email, TOTPSecret: enc, RecoveryCodes: hashes}
+	usr.Pass, err = hashPassword(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CreateAccount(setDB(rx.db, rx.cfg.AccountsDB), usr, rx.cfg.AccountsBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdb := setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, usr.UUID, rx.cfg.DBExtension))
+	err = CreateProfile(pdb, &Profile{ID: usr.UUID}, rx.cfg.ProfilesBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := url.Values{"email": {email}, "password": {pass}}
+
+	// the password alone is not enough
+	res, err := client.PostForm(ts.URL+loginPath, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "twofactor-form")
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client.PostForm(ts.URL+tfaPath, url.Values{"code": {"bogus"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, errBadCode.Error())
+	if err != nil {
+		t.Error(err)
+	}
+	k, _ := base32NoPad.DecodeString(secret)
+	code := hotp(k, uint64(totpStep(time.Now())))
+	res, err = client.PostForm(ts.URL+tfaPath, url.Values{"code": {code}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "search")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the same code can't be used twice
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2 := &http.Client{Jar: jar}
+	res, err = client2.PostForm(ts.URL+loginPath, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "twofactor-form")
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = client2.PostForm(ts.URL+tfaPath, url.Values{"code": {code}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, errUsedCode.Error())
+	if err != nil {
+		t.Error(err)
+	}
+
+	// but a recovery code works, once
+	res, err = client2.PostForm(ts.URL+tfaPath, url.Values{"code": {codes[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkResponse(res, http.StatusOK, "search")
+	if err != nil {
+		t.Error(err)
+	}
+	user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.RecoveryCodes) != recoveryCodesCount-1 {
+		t.Errorf("Expected %d got %d", recoveryCodesCount-1, len(user.RecoveryCodes))
+	}
+}
+
 // Creates a test druve server for using the Remix handlers., it also returns a ready
 // to use client, that supports sessions.
 func testServer(t *testing.T) (*httptest.Server, *http.Client, *Remix) {
@@ -679,7 +988,10 @@ func testServer(t *testing.T) (*httptest.Server, *http.Client, *Remix) {
 		SessionPath:         "/",
 		MessagesBucket:      "messages",
 	}
-	rx := NewRemix(cfg)
+	rx, err := NewRemix(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,393 @@
+package aurora
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/gernest/nutz"
+)
+
+const (
+	// the bucket in the profile database holding the search index of the messages
+	// of the profile. It looks like this
+	//
+	//	search
+	//	     |---terms
+	//	     |       |---<term>
+	//	     |                |---<message id>
+	//	     |---docs
+	//	             |---<message id> the bucket of the message, and its terms
+	searchBucket      = "search"
+	searchTermsBucket = "terms"
+	searchDocsBucket  = "docs"
+
+	// the number of search results, unless asked otherwise.
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+var errEmptyQuery = errors.New("du! andika neno la kutafuta")
+
+// the buckets of messages which are indexed.
+var searchableBuckets = []string{inboxBucket, outboxBucket, draftBucket, readBucket}
+
+// SearchQuery is what to search for. Words in Text must all be in the message, words
+// in double quotes must be there in that order. From limits the results to the
+// messages sent by the given profile.
+type SearchQuery struct {
+	Text  string `json:"q"`
+	From  string `json:"from"`
+	Limit int    `json:"limit"`
+}
+
+// SearchResult is a message which matched the query. Highlight is the escaped text of
+// the message, with the matching words in <mark> tags.
+type SearchResult struct {
+	Message   *MSG   `json:"message"`
+	Highlight string `json:"highlight"`
+}
+
+type searchDoc struct {
+	Bucket string   `json:"bucket"`
+	Terms  []string `json:"terms"`
+}
+
+// splits text into lowercase words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// returns the distinct words of the message, which are the ones it is found by.
+func msgTerms(msg *MSG) []string {
+	words := tokenize(msg.Text)
+	for _, a := range msg.Attachments {
+		words = append(words, tokenize(a.Name)...)
+	}
+	seen := make(map[string]bool)
+	var rst []string
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			rst = append(rst, w)
+		}
+	}
+	sort.Strings(rst)
+	return rst
+}
+
+// runs fn in a single transaction on the database, with the terms and docs buckets
+// of the search index.
+func updateIndex(db nutz.Storage, fn func(terms, docs *bolt.Bucket) error) error {
+	return withTx(db, true, func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(searchBucket))
+		if err != nil {
+			return err
+		}
+		terms, err := root.CreateBucketIfNotExists([]byte(searchTermsBucket))
+		if err != nil {
+			return err
+		}
+		docs, err := root.CreateBucketIfNotExists([]byte(searchDocsBucket))
+		if err != nil {
+			return err
+		}
+		return fn(terms, docs)
+	})
+}
+
+// removes the message from the index.
+func removeDoc(terms, docs *bolt.Bucket, id []byte) error {
+	d := docs.Get(id)
+	if d == nil {
+		return nil
+	}
+	doc := &searchDoc{}
+	if err := json.Unmarshal(d, doc); err != nil {
+		return err
+	}
+	for _, t := range doc.Terms {
+		if b := terms.Bucket([]byte(t)); b != nil {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+	return docs.Delete(id)
+}
+
+// adds the message stored in bucket to the search index of the database, replacing
+// what was indexed for it before.
+func indexMsg(db nutz.Storage, bucket string, msg *MSG) error {
+	doc := &searchDoc{Bucket: bucket, Terms: msgTerms(msg)}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	id := []byte(msg.ID)
+	return updateIndex(db, func(terms, docs *bolt.Bucket) error {
+		if err := removeDoc(terms, docs, id); err != nil {
+			return err
+		}
+		for _, t := range doc.Terms {
+			b, err := terms.CreateBucketIfNotExists([]byte(t))
+			if err != nil {
+				return err
+			}
+			if err = b.Put(id, []byte{}); err != nil {
+				return err
+			}
+		}
+		return docs.Put(id, data)
+	})
+}
+
+// removes the message from the search index of the database.
+func unindexMsg(db nutz.Storage, msgID string) error {
+	return updateIndex(db, func(terms, docs *bolt.Bucket) error {
+		return removeDoc(terms, docs, []byte(msgID))
+	})
+}
+
+// records that the message was moved to another bucket.
+func moveIndexedMsg(db nutz.Storage, msgID, bucket string) error {
+	return updateIndex(db, func(terms, docs *bolt.Bucket) error {
+		d := docs.Get([]byte(msgID))
+		if d == nil {
+			return nil
+		}
+		doc := &searchDoc{}
+		if err := json.Unmarshal(d, doc); err != nil {
+			return err
+		}
+		doc.Bucket = bucket
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		return docs.Put([]byte(msgID), data)
+	})
+}
+
+// returns the ids of the messages which have all the terms, mapped to the bucket they
+// are stored in.
+func lookupIndex(db nutz.Storage, words []string) (map[string]string, error) {
+	rst := make(map[string]string)
+	err := withTx(db, false, func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(searchBucket))
+		if root == nil {
+			return nil
+		}
+		terms, docs := root.Bucket([]byte(searchTermsBucket)), root.Bucket([]byte(searchDocsBucket))
+		if terms == nil || docs == nil {
+			return nil
+		}
+		var ids map[string]bool
+		for _, w := range words {
+			b := terms.Bucket([]byte(w))
+			if b == nil {
+				return nil
+			}
+			found := make(map[string]bool)
+			b.ForEach(func(k, _ []byte) error {
+				if ids == nil || ids[string(k)] {
+					found[string(k)] = true
+				}
+				return nil
+			})
+			ids = found
+		}
+		for id := range ids {
+			doc := &searchDoc{}
+			if err := json.Unmarshal(docs.Get([]byte(id)), doc); err == nil {
+				rst[id] = doc.Bucket
+			}
+		}
+		return nil
+	})
+	return rst, err
+}
+
+// splits the query into the words to look up, and the phrases the words of which
+// should be next to each other.
+func parseQuery(q string) ([]string, [][]string) {
+	var (
+		words   []string
+		phrases [][]string
+	)
+	for i, part := range strings.Split(q, `"`) {
+		w := tokenize(part)
+		words = append(words, w...)
+
+		// every other part is in quotes
+		if i%2 == 1 && len(w) > 1 {
+			phrases = append(phrases, w)
+		}
+	}
+	return words, phrases
+}
+
+// checks if the words have the phrase in them.
+func hasPhrase(words, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		match := true
+		for j, p := range phrase {
+			if words[i+j] != p {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// escapes the text, and puts the given words in <mark> tags.
+func highlight(text string, words map[string]bool) string {
+	var buf bytes.Buffer
+	var word []rune
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		w := html.EscapeString(string(word))
+		if words[strings.ToLower(string(word))] {
+			w = "<mark>" + w + "</mark>"
+		}
+		buf.WriteString(w)
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		buf.WriteString(html.EscapeString(string(r)))
+	}
+	flush()
+	return buf.String()
+}
+
+// searches the messages of the profile, the newest come first.
+func (m *Messenger) search(profileID string, q *SearchQuery) ([]*SearchResult, error) {
+	words, phrases := parseQuery(q.Text)
+	if len(words) == 0 {
+		return nil, errEmptyQuery
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	found, err := lookupIndex(pdb, words)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*MSG
+	for id, bucket := range found {
+		msg := &MSG{}
+		if err := getAndUnmarshall(pdb, bucket, id, msg, m.rx.cfg.MessagesBucket); err != nil {
+			continue
+		}
+		if q.From != "" && msg.SenderID != q.From {
+			continue
+		}
+		text := tokenize(msg.Text)
+		match := true
+		for _, p := range phrases {
+			if !hasPhrase(text, p) {
+				match = false
+				break
+			}
+		}
+		if match {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Sort(sort.Reverse(bySentAt(msgs)))
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	marks := make(map[string]bool)
+	for _, w := range words {
+		marks[w] = true
+	}
+	rst := []*SearchResult{}
+	for _, msg := range msgs {
+		rst = append(rst, &SearchResult{Message: msg, Highlight: highlight(msg.Text, marks)})
+	}
+	return rst, nil
+}
+
+// adds the message to the search index of the profile, failing to do so doesn't stop
+// the message from being stored.
+func (m *Messenger) index(profileID, bucket string, msg *MSG) {
+	pdb := setDB(m.rx.db, getProfileDatabase(m.rx.cfg.DBDir, profileID, m.rx.cfg.DBExtension))
+	if err := indexMsg(pdb, bucket, msg); err != nil {
+		log.Println(err)
+	}
+}
+
+// RebuildSearchIndex indexes again all the messages of every user, it is for
+// databases which were around before the search index, or when it got out of sync.
+// It returns the number of messages indexed.
+func (rx *Remix) RebuildSearchIndex() (int, error) {
+	users, err := GetAllUsers(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, id := range users {
+		if !rx.profileExists(id) {
+			continue
+		}
+		c, err := rebuildIndex(setDB(rx.db, getProfileDatabase(rx.cfg.DBDir, id, rx.cfg.DBExtension)), rx.cfg.MessagesBucket)
+		n += c
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// drops the search index of the database and indexes all its messages.
+func rebuildIndex(db nutz.Storage, msgBucket string) (int, error) {
+	err := withTx(db, true, func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(searchBucket)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(searchBucket))
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, b := range searchableBuckets {
+		all := db.GetAll(b, msgBucket)
+		for _, v := range all.DataList {
+			msg := &MSG{}
+			if err := json.Unmarshal(v, msg); err != nil {
+				continue
+			}
+			if err := indexMsg(db, b, msg); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,111 @@
+package aurora
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHighlight(t *testing.T) {
+	got := highlight("Habari <b>za</b> asubuhi, HABARI!", map[string]bool{"habari": true})
+	want := "<mark>Habari</mark> &lt;b&gt;za&lt;/b&gt; asubuhi, <mark>HABARI</mark>!"
+	if got != want {
+		t.Errorf("expected %s got %s", want, got)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	words, phrases := parseQuery(`chakula "habari za asubuhi" Leo`)
+	if len(words) != 5 || words[0] != "chakula" || words[4] != "leo" {
+		t.Errorf("expected 5 words got %v", words)
+	}
+	if len(phrases) != 1 || len(phrases[0]) != 3 {
+		t.Errorf("expected one phrase of 3 words got %v", phrases)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	m, dir := testMessenger(t)
+	defer os.RemoveAll(dir)
+	var (
+		alice = "alice"
+		bob   = "bob"
+		now   = time.Now()
+	)
+	for _, id := range []string{alice, bob} {
+		pdb := setDB(m.rx.db, getProfileDatabase(dir, id, m.rx.cfg.DBExtension))
+		if err := CreateProfile(pdb, &Profile{ID: id, FirstName: id}, m.rx.cfg.ProfilesBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := []*MSG{
+		{ID: "1", SenderID: alice, RecipientID: bob, Text: "habari za asubuhi", SentAt: now.Add(-3 * time.Minute)},
+		{ID: "2", SenderID: bob, RecipientID: alice, Text: "asubuhi njema, habari yako?", SentAt: now.Add(-2 * time.Minute)},
+		{ID: "3", SenderID: alice, RecipientID: bob, Text: "tutaonana kesho", SentAt: now.Add(-time.Minute)},
+	}
+	for _, msg := range msgs {
+		msg.ConversationID = conversationID(alice, bob)
+		if err := m.saveMsg(outboxBucket, msg.SenderID, msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.saveMsg(inboxBucket, msg.RecipientID, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(q *SearchQuery, ids ...string) {
+		rst, err := m.search(bob, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rst) != len(ids) {
+			t.Fatalf("%q: expected %d results got %d", q.Text, len(ids), len(rst))
+		}
+		for i, id := range ids {
+			if rst[i].Message.ID != id {
+				t.Errorf("%q: expected message %s at %d got %s", q.Text, id, i, rst[i].Message.ID)
+			}
+		}
+	}
+	search(&SearchQuery{Text: "HABARI asubuhi"}, "2", "1")
+	search(&SearchQuery{Text: `"habari za"`}, "1")
+	search(&SearchQuery{Text: "habari", From: alice}, "1")
+	search(&SearchQuery{Text: "habari", Limit: 1}, "2")
+	search(&SearchQuery{Text: "chakula"})
+	if _, err := m.search(bob, &SearchQuery{Text: `" ,"`}); err != errEmptyQuery {
+		t.Errorf("expected %v got %v", errEmptyQuery, err)
+	}
+
+	// moved and edited messages are found where they are
+	if err := m.moveTo(readBucket, inboxBucket, bob, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.editMsg(alice, &EditRequest{ID: "3", Text: "tutaonana asubuhi"}); err != nil {
+		t.Fatal(err)
+	}
+	search(&SearchQuery{Text: "asubuhi"}, "3", "2", "1")
+	search(&SearchQuery{Text: "kesho"})
+
+	// messages deleted for bob are not found by him
+	if _, err := m.deleteMsgForMe(bob, &EditRequest{ID: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	search(&SearchQuery{Text: "asubuhi"}, "3", "1")
+
+	// rebuilding gives the same index
+	pdb := setDB(m.rx.db, getProfileDatabase(dir, bob, m.rx.cfg.DBExtension))
+	n, err := rebuildIndex(pdb, m.rx.cfg.MessagesBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 messages to be indexed got %d", n)
+	}
+	search(&SearchQuery{Text: "asubuhi"}, "3", "1")
+	rst, err := m.search(bob, &SearchQuery{Text: "tutaonana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rst) != 1 || rst[0].Highlight != "<mark>tutaonana</mark> asubuhi" {
+		t.Errorf("expected the highlighted text got %v", rst)
+	}
+}
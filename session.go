@@ -1,11 +1,19 @@
 package aurora
 
 import (
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gernest/nutz"
@@ -13,6 +21,89 @@ import (
 	"github.com/gorilla/sessions"
 )
 
+// environment variable holding session keys, see ParseSessionKeys.
+const sessionKeysEnv = "AURORA_SESSION_KEYS"
+
+// SessionKey is a pair of base64 encoded keys used to secure session cookies. Hash
+// authenticates the cookie value, and Block encrypts it. Block can be empty in which
+// case cookies are only signed.
+type SessionKey struct {
+	Hash  string `json:"hash"`
+	Block string `json:"block"`
+}
+
+// GenerateSessionKey returns a new random key pair, with a 64 bytes hash key and a
+// 32 bytes block key(AES-256).
+func GenerateSessionKey() *SessionKey {
+	return &SessionKey{
+		Hash:  base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(64)),
+		Block: base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)),
+	}
+}
+
+// ParseSessionKeys parses session keys from a string of comma separated hash:block
+// pairs, this is the format of the AURORA_SESSION_KEYS environment variable.
+func ParseSessionKeys(src string) ([]*SessionKey, error) {
+	var rst []*SessionKey
+	for _, v := range strings.Split(src, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		pair := strings.SplitN(v, ":", 2)
+		k := &SessionKey{Hash: pair[0]}
+		if len(pair) == 2 {
+			k.Block = pair[1]
+		}
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		rst = append(rst, k)
+	}
+	return rst, nil
+}
+
+// String returns the key pair in the hash:block form.
+func (k *SessionKey) String() string {
+	return k.Hash + ":" + k.Block
+}
+
+func (k *SessionKey) validate() error {
+	if k == nil {
+		return errors.New("aurora: empty session key")
+	}
+	h, err := base64.StdEncoding.DecodeString(k.Hash)
+	if err != nil {
+		return fmt.Errorf("aurora: bad session hash key %v", err)
+	}
+	if len(h) < 32 {
+		return errors.New("aurora: session hash key should be at least 32 bytes")
+	}
+	b, err := base64.StdEncoding.DecodeString(k.Block)
+	if err != nil {
+		return fmt.Errorf("aurora: bad session block key %v", err)
+	}
+	switch len(b) {
+	case 0, 16, 24, 32:
+		return nil
+	}
+	return errors.New("aurora: session block key should be 16, 24 or 32 bytes")
+}
+
+func (k *SessionKey) hash() []byte {
+	h, _ := base64.StdEncoding.DecodeString(k.Hash)
+	return h
+}
+
+// returns nil when there is no block key, so that securecookie won't encrypt.
+func (k *SessionKey) block() []byte {
+	b, _ := base64.StdEncoding.DecodeString(k.Block)
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
 // Session implemets gorilla session store interface
 type Session struct {
 	store    nutz.Storage
@@ -20,14 +111,47 @@ type Session struct {
 	options  *sessions.Options
 	codecs   []securecookie.Codec
 	duration int // Time before the session expires
+
+	// now returns the current time, it is here so that tests can travel in time.
+	now func() time.Time
+
+	mu   sync.Mutex
+	quit chan struct{}
+	done chan struct{}
 }
 
 type sessionValue struct {
 	Data    string    `json:"data"`
 	Expires time.Time `json:"expires"`
+
+	// Owner is the user the session belongs to, this is the value of the "user"
+	// session value.
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+// SessionInfo describes an active session of a user, as shown to the user.
+type SessionInfo struct {
+	// ID is not the session ID, it is derived from the session ID so that it can
+	// be safely handed to the client.
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
 }
 
-// NewSessStore creates a new session store
+// how often the last seen time of a session is updated.
+const lastSeenInterval = time.Minute
+
+// NewSessStore creates a new session store. The secrets are hash/block key pairs as
+// accepted by securecookie.CodecsFromPairs, new cookies are always encoded with the
+// first pair while all the pairs are tried when decoding.
 func NewSessStore(db nutz.Storage, bucket string, duration int, opts *sessions.Options, secrets ...[]byte) *Session {
 	return &Session{
 		store:    db,
@@ -35,6 +159,7 @@ func NewSessStore(db nutz.Storage, bucket string, duration int, opts *sessions.O
 		options:  opts,
 		codecs:   securecookie.CodecsFromPairs(secrets...),
 		duration: duration,
+		now:      time.Now,
 	}
 }
 
@@ -57,12 +182,20 @@ func (s *Session) New(r *http.Request, name string) (*sessions.Session, error) {
 	if err != nil {
 		return session, err
 	}
-	err = s.load(session)
+	v, err := s.load(session)
 	if err != nil {
 		return session, err
 	}
 	session.IsNew = false
-	return session, err
+	if s.now().Sub(v.LastSeen) > lastSeenInterval {
+		v.LastSeen = s.now()
+		v.UserAgent = r.UserAgent()
+		v.IP = clientIP(r)
+		if err = s.put(session.ID, v); err != nil {
+			// log this?
+		}
+	}
+	return session, nil
 }
 
 // Save persist a session
@@ -71,7 +204,7 @@ func (s *Session) Save(r *http.Request, w http.ResponseWriter, session *sessions
 	if session.ID == "" {
 		session.ID = strings.TrimRight(sessID, "=")
 	}
-	if err := s.save(session); err != nil {
+	if err := s.save(r, session); err != nil {
 		return err
 	}
 	e, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
@@ -90,43 +223,248 @@ func (s *Session) Delete(r *http.Request, w http.ResponseWriter, session *sessio
 	for k := range session.Values {
 		delete(session.Values, k)
 	}
-	ss := s.store.Delete(s.bucket, session.ID)
-	return ss.Error
+	return s.remove(session.ID)
+}
+
+// UserSessions returns all the active sessions of the given owner, the most
+// recently used first.
+func (s *Session) UserSessions(owner string) ([]*SessionInfo, error) {
+	var rst []*SessionInfo
+	all := s.store.GetAll(s.indexBucket(), owner)
+	if all.Error != nil {
+		return nil, all.Error
+	}
+	for id := range all.DataList {
+		v, err := s.get(id)
+		if err != nil || v.Expires.Before(s.now()) || v.Owner != owner {
+			s.store.Delete(s.indexBucket(), id, owner)
+			continue
+		}
+		rst = append(rst, &SessionInfo{
+			ID:        sessionHandle(id),
+			CreatedAt: v.CreatedAt,
+			LastSeen:  v.LastSeen,
+			Expires:   v.Expires,
+			UserAgent: v.UserAgent,
+			IP:        v.IP,
+		})
+	}
+	sort.Sort(byLastSeen(rst))
+	return rst, nil
 }
 
-func (s *Session) save(session *sessions.Session) error {
+// Revoke deletes the session of owner identified by handle, the handle is the ID of
+// the SessionInfo.
+func (s *Session) Revoke(owner, handle string) error {
+	all := s.store.GetAll(s.indexBucket(), owner)
+	if all.Error != nil {
+		return all.Error
+	}
+	for id := range all.DataList {
+		if sessionHandle(id) == handle {
+			return s.remove(id)
+		}
+	}
+	return errors.New("aurora: session not found")
+}
+
+// RevokeAll deletes all sessions of owner except the session with the ID keep, it
+// returns the number of deleted sessions. Pass an empty keep to sign out
+// everywhere.
+func (s *Session) RevokeAll(owner, keep string) (int, error) {
+	var n int
+	all := s.store.GetAll(s.indexBucket(), owner)
+	if all.Error != nil {
+		return 0, all.Error
+	}
+	for id := range all.DataList {
+		if id == keep {
+			continue
+		}
+		if err := s.remove(id); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *Session) save(r *http.Request, session *sessions.Session) error {
 	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
 	if err != nil {
 		return err
 	}
-	v, err := json.Marshal(sessionValue{
-		Data:    encoded,
-		Expires: s.getExpires(session.Options.MaxAge),
-	})
-	ss := s.store.Create(s.bucket, session.ID, v)
-	return ss.Error
+	v, err := s.get(session.ID)
+	if err != nil {
+		v = &sessionValue{CreatedAt: s.now()}
+	}
+	owner, _ := session.Values["user"].(string)
+	if v.Owner != "" && v.Owner != owner {
+		s.store.Delete(s.indexBucket(), session.ID, v.Owner)
+	}
+	v.Data = encoded
+	v.Expires = s.getExpires(session.Options.MaxAge)
+	v.Owner = owner
+	v.LastSeen = s.now()
+	v.UserAgent = r.UserAgent()
+	v.IP = clientIP(r)
+	if err = s.put(session.ID, v); err != nil {
+		return err
+	}
+	if owner != "" {
+		return s.store.Create(s.indexBucket(), session.ID, []byte(v.CreatedAt.Format(time.RFC3339)), owner).Error
+	}
+	return nil
 }
 
-func (s *Session) load(session *sessions.Session) error {
-	v := &sessionValue{}
-	ss := s.store.Get(s.bucket, session.ID)
-	err := json.Unmarshal(ss.Data, v)
+func (s *Session) load(session *sessions.Session) (*sessionValue, error) {
+	v, err := s.get(session.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if v.Expires.Sub(time.Now()) < 0 {
-		return errors.New("aurora: session expired")
+	if v.Expires.Sub(s.now()) < 0 {
+		return nil, errors.New("aurora: session expired")
 	}
 	err = securecookie.DecodeMulti(session.Name(), v.Data, &session.Values, s.codecs...)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *Session) get(id string) (*sessionValue, error) {
+	v := &sessionValue{}
+	ss := s.store.Get(s.bucket, id)
+	if ss.Error != nil {
+		return nil, ss.Error
+	}
+	err := json.Unmarshal(ss.Data, v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *Session) put(id string, v *sessionValue) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return nil
+	return s.store.Create(s.bucket, id, data).Error
+}
+
+// removes the session and its index entry.
+func (s *Session) remove(id string) error {
+	if v, err := s.get(id); err == nil && v.Owner != "" {
+		s.store.Delete(s.indexBucket(), id, v.Owner)
+	}
+	return s.store.Delete(s.bucket, id).Error
+}
+
+// The index bucket maps owners to their sessions. Every owner has a bucket nested
+// inside the index bucket, with session IDs as keys.
+func (s *Session) indexBucket() string {
+	return s.bucket + "_index"
 }
 
 func (s *Session) getExpires(maxAge int) time.Time {
 	if maxAge <= 0 {
-		return time.Now().Add(time.Second * time.Duration(s.duration))
+		return s.now().Add(time.Second * time.Duration(s.duration))
+	}
+	return s.now().Add(time.Second * time.Duration(maxAge))
+}
+
+// Cleanup removes all expired sessions from the database, and returns the number of
+// sessions which were removed.
+func (s *Session) Cleanup() (int, error) {
+	var purged int
+	all := s.store.GetAll(s.bucket)
+	if all.Error != nil {
+		return 0, all.Error
+	}
+	now := s.now()
+	for k, data := range all.DataList {
+		v := &sessionValue{}
+		err := json.Unmarshal(data, v)
+		if err == nil && v.Expires.Sub(now) >= 0 {
+			continue
+		}
+
+		// whatever we can't decode is as good as expired.
+		if v.Owner != "" {
+			s.store.Delete(s.indexBucket(), k, v.Owner)
+		}
+		if d := s.store.Delete(s.bucket, k); d.Error != nil {
+			return purged, d.Error
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartCleanup starts a goroutine which calls Cleanup after every interval. Calling
+// it when the cleanup is already running does nothing.
+func (s *Session) StartCleanup(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quit != nil {
+		return
+	}
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.cleanup(interval, s.quit, s.done)
+}
+
+// StopCleanup stops the goroutine started by StartCleanup, and waits for it to exit.
+func (s *Session) StopCleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quit == nil {
+		return
 	}
-	return time.Now().Add(time.Second * time.Duration(maxAge))
+	close(s.quit)
+	<-s.done
+	s.quit = nil
+	s.done = nil
 }
+
+func (s *Session) cleanup(interval time.Duration, quit, done chan struct{}) {
+	defer close(done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-tick.C:
+			n, err := s.Cleanup()
+			if err != nil {
+				log.Printf("aurora: cleaning sessions %v", err)
+			}
+			if n > 0 {
+				log.Printf("aurora: purged %d expired sessions", n)
+			}
+		}
+	}
+}
+
+// derives a public identifier of a session from the session ID.
+func sessionHandle(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:8])
+}
+
+// returns the IP address of the client which made the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type byLastSeen []*SessionInfo
+
+func (b byLastSeen) Len() int           { return len(b) }
+func (b byLastSeen) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastSeen) Less(i, j int) bool { return b[i].LastSeen.After(b[j].LastSeen) }
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
@@ -65,6 +66,212 @@ func TestSess_Delete(t *testing.T) {
 	}
 }
 
+func TestSession_KeyRotation(t *testing.T) {
+	var (
+		cName  = "youngWarlock"
+		oldKey = GenerateSessionKey()
+		newKey = GenerateSessionKey()
+		opts   = &sessions.Options{MaxAge: 30, Path: "/"}
+	)
+	oldStore := NewSessStore(db, "rotation", 10, opts, oldKey.hash(), oldKey.block())
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := oldStore.New(req, cName)
+	s.Values["user"] = "gernest"
+	w := httptest.NewRecorder()
+	err = s.Save(req, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated store should still decode cookies signed with the old key.
+	store := NewSessStore(db, "rotation", 10, opts, newKey.hash(), newKey.block(), oldKey.hash(), oldKey.block())
+	req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	s, err = store.New(req, cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Values["user"] != "gernest" {
+		t.Errorf("Expected gernest, actual %v", s.Values["user"])
+	}
+
+	// New cookies are signed with the newest key only.
+	w = httptest.NewRecorder()
+	err = s.Save(req, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := w.Result().Cookies()[0]
+	var id string
+	err = securecookie.DecodeMulti(cName, c.Value, &id, securecookie.CodecsFromPairs(oldKey.hash(), oldKey.block())...)
+	if err == nil {
+		t.Error("Expected an error decoding with the old key")
+	}
+	err = securecookie.DecodeMulti(cName, c.Value, &id, securecookie.CodecsFromPairs(newKey.hash(), newKey.block())...)
+	if err != nil {
+		t.Error(err)
+	}
+	if id != s.ID {
+		t.Errorf("Expected %s got %s", s.ID, id)
+	}
+}
+
+func TestParseSessionKeys(t *testing.T) {
+	a, b := GenerateSessionKey(), GenerateSessionKey()
+	keys, err := ParseSessionKeys(a.String() + "," + b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 got %d", len(keys))
+	}
+	if keys[0].Hash != a.Hash || keys[1].Block != b.Block {
+		t.Errorf("Expected keys to keep their order")
+	}
+	_, err = ParseSessionKeys("bogus:key")
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	_, err = ParseSessionKeys(a.Hash + ":c2hvcnQ=")
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	cfg := &RemixConfig{SessionKeys: []*SessionKey{a, nil}}
+	if _, err = cfg.SessionSecrets(); err == nil {
+		t.Error("Expected an error for the null key")
+	}
+}
+
+func TestSession_Cleanup(t *testing.T) {
+	var (
+		cName  = "youngWarlock"
+		bucket = "cleanup"
+		now    = time.Now()
+		opts   = &sessions.Options{MaxAge: 30, Path: "/"}
+	)
+	store := NewSessStore(db, bucket, 10, opts, []byte("my-secret"))
+	store.now = func() time.Time { return now }
+	for _, v := range []string{"a", "b", "c"} {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := store.New(req, cName)
+		s.Values["user"] = v
+		if err = s.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing has expired yet
+	n, err := store.Cleanup()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected 0 got %d", n)
+	}
+
+	// a minute later all the sessions should be gone.
+	store.now = func() time.Time { return now.Add(time.Minute) }
+	n, err = store.Cleanup()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 got %d", n)
+	}
+	all := db.GetAll(bucket)
+	if len(all.DataList) != 0 {
+		t.Errorf("Expected an empty bucket got %d sessions", len(all.DataList))
+	}
+
+	// the background cleanup should start and stop cleanly
+	store.StartCleanup(time.Millisecond)
+	store.StartCleanup(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	store.StopCleanup()
+	store.StopCleanup()
+}
+
+func TestSession_UserSessions(t *testing.T) {
+	var (
+		cName  = "youngWarlock"
+		owner  = "gernest@aurora.com"
+		bucket = "user_sessions"
+		opts   = &sessions.Options{MaxAge: 30, Path: "/"}
+		saved  []*sessions.Session
+	)
+	store := NewSessStore(db, bucket, 10, opts, []byte("my-secret"))
+	for _, agent := range []string{"firefox", "chrome", "curl"} {
+		req, err := http.NewRequest("GET", "http://www.example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", agent)
+		req.RemoteAddr = "127.0.0.1:8080"
+		s, _ := store.New(req, cName)
+		s.Values["user"] = owner
+		if err = s.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, s)
+	}
+	list, err := store.UserSessions(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("Expected 3 got %d", len(list))
+	}
+	for _, v := range list {
+		if v.IP != "127.0.0.1" {
+			t.Errorf("Expected 127.0.0.1 got %s", v.IP)
+		}
+		if v.ID == saved[0].ID {
+			t.Error("Expected the session id not to be exposed")
+		}
+	}
+
+	err = store.Revoke(owner, sessionHandle(saved[1].ID))
+	if err != nil {
+		t.Error(err)
+	}
+	err = store.Revoke("bogus@aurora.com", sessionHandle(saved[2].ID))
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	list, _ = store.UserSessions(owner)
+	if len(list) != 2 {
+		t.Errorf("Expected 2 got %d", len(list))
+	}
+
+	n, err := store.RevokeAll(owner, saved[0].ID)
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 got %d", n)
+	}
+	list, _ = store.UserSessions(owner)
+	if len(list) != 1 || list[0].ID != sessionHandle(saved[0].ID) {
+		t.Errorf("Expected only the kept session got %v", list)
+	}
+	req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+	err = store.Delete(req, httptest.NewRecorder(), saved[0])
+	if err != nil {
+		t.Error(err)
+	}
+	list, _ = store.UserSessions(owner)
+	if len(list) != 0 {
+		t.Errorf("Expected 0 got %d", len(list))
+	}
+}
 
 func sessSetup(t *testing.T) (*Session, *http.Request) {
 	var (
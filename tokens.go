@@ -0,0 +1,106 @@
+package aurora
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gernest/nutz"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// kinds of tokens
+	resetToken  = "reset"
+	verifyToken = "verify"
+)
+
+var errBadToken = errors.New("du! kiungo hiki sio sahihi au muda wake umekwisha")
+
+// Token is a single use token sent to the user, for things like resetting the
+// password. Only a hash of the token is stored, so the token itself is known only
+// to whoever received it.
+type Token struct {
+	Kind      string    `json:"kind"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	Expires   time.Time `json:"expires"`
+}
+
+// creates a new token of the given kind for the given email. The returned string is
+// the token to be sent to the user. Tokens of every kind are stored in a bucket of
+// their own, nested inside the given bucket.
+func issueToken(db nutz.Storage, bucket, kind, email string, ttl time.Duration) (string, error) {
+	tok := base64.URLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	now := time.Now()
+	t := &Token{
+		Kind:      kind,
+		Email:     email,
+		CreatedAt: now,
+		Expires:   now.Add(ttl),
+	}
+	err := marshalAndCreate(db, t, bucket, tokenKey(tok), kind)
+	if err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+// retrieves a valid token without using it.
+func peekToken(db nutz.Storage, bucket, kind, tok string) (*Token, error) {
+	t := &Token{}
+	err := getAndUnmarshall(db, bucket, tokenKey(tok), t, kind)
+	if err != nil {
+		return nil, errBadToken
+	}
+	if t.Expires.Before(time.Now()) {
+		db.Delete(bucket, tokenKey(tok), kind)
+		return nil, errBadToken
+	}
+	return t, nil
+}
+
+// retrieves a valid token and deletes it, so that it can't be used again. Both
+// happen in a single transaction, so a token can't be used twice at once.
+func consumeToken(db nutz.Storage, bucket, kind, tok string) (*Token, error) {
+	var (
+		t     *Token
+		key   = []byte(tokenKey(tok))
+		found bool
+	)
+	err := withTx(db, true, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b != nil {
+			b = b.Bucket([]byte(kind))
+		}
+		if b == nil {
+			return nil
+		}
+		data := b.Get(key)
+		if data == nil {
+			return nil
+		}
+		rst := &Token{}
+		if err := json.Unmarshal(data, rst); err == nil && rst.Expires.After(time.Now()) {
+			t, found = rst, true
+		}
+		// expired and broken tokens go too.
+		return b.Delete(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errBadToken
+	}
+	return t, nil
+}
+
+func tokenKey(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(h[:])
+}
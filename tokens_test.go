@@ -0,0 +1,81 @@
+package aurora
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	var (
+		bucket = "test_tokens"
+		email  = "gernest@aurora.com"
+	)
+	tok, err := issueToken(db, bucket, resetToken, email, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the hash of the token should be stored
+	if g := db.Get(bucket, tok, resetToken); g.Error == nil {
+		t.Error("Expected the token not to be stored as is")
+	}
+	tk, err := peekToken(db, bucket, resetToken, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Email != email {
+		t.Errorf("Expected %s got %s", email, tk.Email)
+	}
+
+	// tokens of a different kind don't mix
+	_, err = peekToken(db, bucket, "verify", tok)
+	if err == nil {
+		t.Error("Expected an error")
+	}
+
+	// a token is used only once
+	_, err = consumeToken(db, bucket, resetToken, tok)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = consumeToken(db, bucket, resetToken, tok)
+	if err != errBadToken {
+		t.Errorf("Expected %v got %v", errBadToken, err)
+	}
+
+	// expired tokens are not valid
+	tok, err = issueToken(db, bucket, resetToken, email, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = consumeToken(db, bucket, resetToken, tok)
+	if err != errBadToken {
+		t.Errorf("Expected %v got %v", errBadToken, err)
+	}
+
+	// two requests racing for the same token, only one wins
+	if tok, err = issueToken(db, bucket, verifyToken, email, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := consumeToken(db, bucket, verifyToken, tok); err == nil {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if ok != 1 {
+		t.Errorf("Expected the token to be used once got %d", ok)
+	}
+}
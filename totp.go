@@ -0,0 +1,180 @@
+package aurora
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// This is an implementation of time based one time passwords as described in RFC 6238,
+// using the defaults which authenticator apps expect i.e HMAC-SHA1, six digits and a
+// thirty seconds period.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+
+	// number of periods before and after the current one in which a code is still
+	// accepted, this is to allow for clock drift between the server and the phone.
+	totpSkew = 1
+
+	// number of recovery codes given to the user when enabling two factor auth.
+	recoveryCodesCount = 10
+)
+
+var (
+	errBadCode  = errors.New("du! namba ya uthibitisho sio sahihi")
+	errUsedCode = errors.New("du! namba hii ya uthibitisho imeshatumika")
+	errNoTOTP   = errors.New("aurora: two factor authentication is not configured")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// returns a new random secret, encoded in base32 as authenticator apps like it.
+func newTOTPSecret() string {
+	return base32NoPad.EncodeToString(securecookie.GenerateRandomKey(20))
+}
+
+// computes the HOTP value(RFC 4226) of the given counter.
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// returns the time step of t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// validates the code against the secret at the time now. The code should not belong
+// to a step less than or equal to lastStep, which is the step of the last code that
+// was accepted. This way a code can't be replayed.
+//
+// The step of the matching code is returned, it should be saved as the new lastStep.
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, error) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, err
+	}
+	code = strings.TrimSpace(code)
+	step := totpStep(now)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		s := step + int64(i)
+		if s < 0 {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(s))), []byte(code)) {
+			if s <= lastStep {
+				return 0, errUsedCode
+			}
+			return s, nil
+		}
+	}
+	return 0, errBadCode
+}
+
+// returns the otpauth uri used to provision authenticator apps, usually it is shown
+// as a QR code.
+func totpURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	v := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+// encrypts the secret with AES-GCM. The result is the base64 encoded nonce followed
+// by the cipher text.
+func encryptSecret(key []byte, secret string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := securecookie.GenerateRandomKey(gcm.NonceSize())
+	if nonce == nil {
+		return "", errors.New("aurora: failed to generate a nonce")
+	}
+	out := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// decrypts a secret encrypted by encryptSecret.
+func decryptSecret(key []byte, enc string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("aurora: bad encrypted secret")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// returns new recovery codes, and their hashes which are the ones to be stored. The
+// codes are random enough that a plain sha256 hash is all we need.
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodesCount; i++ {
+		c := strings.ToLower(base32NoPad.EncodeToString(securecookie.GenerateRandomKey(5)))
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+	return
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// checks the code against the hashes, when the code matches its hash is removed from
+// the returned hashes so that the code can not be used again.
+func useRecoveryCode(hashes []string, code string) ([]string, bool) {
+	h := hashRecoveryCode(code)
+	for i, v := range hashes {
+		if hmac.Equal([]byte(v), []byte(h)) {
+			rst := append([]string{}, hashes[:i]...)
+			return append(rst, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
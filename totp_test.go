@@ -0,0 +1,125 @@
+package aurora
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestHOTP(t *testing.T) {
+	// test vectors from RFC 6238, truncated to six digits.
+	key := []byte("12345678901234567890")
+	sample := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, v := range sample {
+		c := hotp(key, uint64(totpStep(time.Unix(v.unix, 0))))
+		if c != v.code {
+			t.Errorf("at %d expected %s got %s", v.unix, v.code, c)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := newTOTPSecret()
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	code := hotp(key, uint64(totpStep(now)))
+
+	step, err := validateTOTP(secret, code, now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != totpStep(now) {
+		t.Errorf("Expected %d got %d", totpStep(now), step)
+	}
+
+	// clock skew, one period either way is fine
+	for _, d := range []time.Duration{-totpPeriod * time.Second, totpPeriod * time.Second} {
+		if _, err = validateTOTP(secret, code, now.Add(d), 0); err != nil {
+			t.Errorf("skew %v: %v", d, err)
+		}
+	}
+	for _, d := range []time.Duration{-3 * totpPeriod * time.Second, 3 * totpPeriod * time.Second} {
+		if _, err = validateTOTP(secret, code, now.Add(d), 0); err != errBadCode {
+			t.Errorf("skew %v: expected %v got %v", d, errBadCode, err)
+		}
+	}
+
+	// replaying a code, or using an older one is rejected
+	if _, err = validateTOTP(secret, code, now, step); err != errUsedCode {
+		t.Errorf("Expected %v got %v", errUsedCode, err)
+	}
+	old := hotp(key, uint64(step-1))
+	if _, err = validateTOTP(secret, old, now, step); err != errUsedCode {
+		t.Errorf("Expected %v got %v", errUsedCode, err)
+	}
+	next := hotp(key, uint64(step+1))
+	if _, err = validateTOTP(secret, next, now.Add(totpPeriod*time.Second), step); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	key := securecookie.GenerateRandomKey(32)
+	secret := newTOTPSecret()
+	enc, err := encryptSecret(key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(enc, secret) {
+		t.Error("Expected the secret to be encrypted")
+	}
+	dec, err := decryptSecret(key, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != secret {
+		t.Errorf("Expected %s got %s", secret, dec)
+	}
+	if _, err = decryptSecret(securecookie.GenerateRandomKey(32), enc); err == nil {
+		t.Error("Expected an error decrypting with a different key")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodesCount || len(hashes) != recoveryCodesCount {
+		t.Fatalf("Expected %d codes", recoveryCodesCount)
+	}
+	left, ok := useRecoveryCode(hashes, codes[3])
+	if !ok {
+		t.Fatal("Expected the code to be accepted")
+	}
+	if len(left) != recoveryCodesCount-1 {
+		t.Errorf("Expected %d got %d", recoveryCodesCount-1, len(left))
+	}
+	if _, ok = useRecoveryCode(left, codes[3]); ok {
+		t.Error("Expected the code to be used only once")
+	}
+	if _, ok = useRecoveryCode(left, "bogus"); ok {
+		t.Error("Expected bogus code to be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	uri := totpURI("aurora", "gernest@aurora.com", secret)
+	for _, v := range []string{"otpauth://totp/aurora:gernest@aurora.com?", "secret=" + secret, "issuer=aurora"} {
+		if !contains(uri, v) {
+			t.Errorf("Expected %s to contain %s", uri, v)
+		}
+	}
+}
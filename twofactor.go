@@ -0,0 +1,257 @@
+package aurora
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gernest/render"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// environment variable holding the key used to encrypt two factor secrets, it
+	// takes precedence over RemixConfig.TOTPKey
+	totpKeyEnv = "AURORA_TOTP_KEY"
+
+	// session values used while the user is half way through logging in, that
+	// is the password is right but the second step is not done yet.
+	pendingUserKey  = "pendingUser"
+	pendingAtKey    = "pendingAt"
+	pendingTriesKey = "pendingTries"
+
+	// session value holding the secret while the user is enabling two factor auth.
+	setupSecretKey = "totpSetup"
+
+	// the time a user has to complete the second step of the login.
+	pendingTTL = 5 * time.Minute
+
+	// the number of wrong codes before the user has to start over.
+	maxCodeTries = 5
+)
+
+// TwoFactor is the second step of the login, for users with two factor authentication
+// enabled. It accepts either a code from the authenticator app or a recovery code.
+func (rx *Remix) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var (
+		data      = render.NewTemplateData()
+		flash     = NewFlash()
+		tfaPath   = "auth/2fa"
+		loginPath = "/auth/login"
+	)
+	ss, _ := rx.sess.Get(r, rx.cfg.SessionName)
+	email, ok := ss.Values[pendingUserKey].(string)
+	at, _ := ss.Values[pendingAtKey].(int64)
+	if !ok || time.Since(time.Unix(at, 0)) > pendingTTL {
+		clearPending(ss)
+		ss.Save(r, w)
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	if r.Method == "GET" {
+		rx.rendr.HTML(w, http.StatusOK, tfaPath, data)
+		return
+	}
+	ip := clientIP(r)
+	if until := rx.lockedUntil(email, ip); !until.IsZero() {
+		clearPending(ss)
+		flash.Error(lockedMsg(until))
+		flash.Save(ss)
+		ss.Save(r, w)
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	user, err := GetUser(setDB(rx.db, rx.cfg.AccountsDB), rx.cfg.AccountsBucket, email)
+	if err != nil || user.deleted() {
+		clearPending(ss)
+		ss.Save(r, w)
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	err = rx.checkSecondFactor(user, r.FormValue("code"))
+	if err != nil {
+		rx.loginFailed(email, ip)
+		tries, _ := ss.Values[pendingTriesKey].(int)
+		tries++
+		if tries >= maxCodeTries {
+			clearPending(ss)
+			flash.Error(errBadCode.Error())
+			flash.Save(ss)
+			ss.Save(r, w)
+			http.Redirect(w, r, loginPath, http.StatusFound)
+			return
+		}
+		ss.Values[pendingTriesKey] = tries
+		ss.Save(r, w)
+		data.Add("error", err.Error())
+		rx.rendr.HTML(w, http.StatusOK, tfaPath, data)
+		return
+	}
+	rx.loginSucceeded(email)
+	clearPending(ss)
+	if rx.cancelDeletion(user) {
+		flash.Success(MsgDeletionCanceled)
+		flash.Save(ss)
+	}
+	ss.Values["user"] = user.EmailAddress
+	ss.Values["isAuthorized"] = true
+	err = ss.Save(r, w)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	http.Redirect(w, r, rx.cfg.LoginRedirect, http.StatusFound)
+}
+
+// TwoFactorSetup enables and disables two factor authentication for the current user.
+//
+// A GET request generates a new secret, which is kept in the session until the user
+// proves to have set up the authenticator app by posting a valid code with
+// action=enable. The recovery codes are shown only once, right after enabling.
+//
+// Posting action=disable with the user's password disables two factor authentication.
+func (rx *Remix) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	var (
+		data      = rx.setSessionData(r)
+		setupPath = "auth/2fa_setup"
+		loginPath = "/auth/login"
+		adb       = setDB(rx.db, rx.cfg.AccountsDB)
+	)
+	ss, ok := rx.isInSession(r)
+	if !ok {
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	user, _, err := rx.getCurrentUserAndProfile(ss)
+	if err != nil {
+		rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+		return
+	}
+	key, err := rx.totpKey()
+	if err != nil {
+		data.Add("error", err.Error())
+		rx.rendr.HTML(w, http.StatusNotImplemented, setupPath, data)
+		return
+	}
+	data.Add("enabled", user.TOTPSecret != "")
+	if r.Method == "GET" {
+		if user.TOTPSecret == "" {
+			secret := newTOTPSecret()
+			ss.Values[setupSecretKey] = secret
+			ss.Save(r, w)
+			data.Add("secret", secret)
+			data.Add("uri", totpURI(rx.totpIssuer(), user.EmailAddress, secret))
+		}
+		rx.rendr.HTML(w, http.StatusOK, setupPath, data)
+		return
+	}
+	switch r.FormValue("action") {
+	case "enable":
+		secret, ok := ss.Values[setupSecretKey].(string)
+		if !ok || user.TOTPSecret != "" {
+			http.Redirect(w, r, "/auth/2fa/setup", http.StatusFound)
+			return
+		}
+		step, err := validateTOTP(secret, r.FormValue("code"), time.Now(), 0)
+		if err != nil {
+			data.Add("error", err.Error())
+			data.Add("secret", secret)
+			data.Add("uri", totpURI(rx.totpIssuer(), user.EmailAddress, secret))
+			rx.rendr.HTML(w, http.StatusOK, setupPath, data)
+			return
+		}
+		enc, err := encryptSecret(key, secret)
+		if err != nil {
+			rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+			return
+		}
+		codes, hashes := newRecoveryCodes()
+		user.TOTPSecret = enc
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		if err = UpdateUser(adb, user, rx.cfg.AccountsBucket); err != nil {
+			rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+			return
+		}
+		delete(ss.Values, setupSecretKey)
+		ss.Save(r, w)
+		data.Add("enabled", true)
+		data.Add("codes", codes)
+		rx.rendr.HTML(w, http.StatusOK, setupPath, data)
+	case "disable":
+		if err = verifyPass(user.Pass, r.FormValue("password")); err != nil {
+			data.Add("error", "namba ya siri sio sahihi")
+			rx.rendr.HTML(w, http.StatusOK, setupPath, data)
+			return
+		}
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		if err = UpdateUser(adb, user, rx.cfg.AccountsBucket); err != nil {
+			rx.rendr.HTML(w, http.StatusInternalServerError, "500", data)
+			return
+		}
+		flash := NewFlash()
+		flash.Success("uthibitisho wa hatua mbili umezimwa")
+		flash.Save(ss)
+		ss.Save(r, w)
+		http.Redirect(w, r, "/auth/2fa/setup", http.StatusFound)
+	default:
+		data.Add("error", errBadForm.Error())
+		rx.rendr.HTML(w, http.StatusBadRequest, setupPath, data)
+	}
+}
+
+// checks the code posted in the second step of the login. The code is either from the
+// authenticator app, or one of the recovery codes. Either way it is marked as used.
+func (rx *Remix) checkSecondFactor(user *User, code string) error {
+	key, err := rx.totpKey()
+	if err != nil {
+		return err
+	}
+	secret, err := decryptSecret(key, user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	adb := setDB(rx.db, rx.cfg.AccountsDB)
+	step, err := validateTOTP(secret, code, time.Now(), user.TOTPLastStep)
+	if err == nil {
+		user.TOTPLastStep = step
+		return UpdateUser(adb, user, rx.cfg.AccountsBucket)
+	}
+	if hashes, ok := useRecoveryCode(user.RecoveryCodes, code); ok {
+		user.RecoveryCodes = hashes
+		return UpdateUser(adb, user, rx.cfg.AccountsBucket)
+	}
+	return err
+}
+
+// returns the key for encrypting two factor secrets.
+func (rx *Remix) totpKey() ([]byte, error) {
+	k := rx.cfg.TOTPKey
+	if env := os.Getenv(totpKeyEnv); env != "" {
+		k = env
+	}
+	key, err := base64.StdEncoding.DecodeString(k)
+	if err != nil || len(key) != 32 {
+		return nil, errNoTOTP
+	}
+	return key, nil
+}
+
+func (rx *Remix) totpIssuer() string {
+	if rx.cfg.TOTPIssuer != "" {
+		return rx.cfg.TOTPIssuer
+	}
+	if rx.cfg.AppName != "" {
+		return rx.cfg.AppName
+	}
+	return "aurora"
+}
+
+func clearPending(ss *sessions.Session) {
+	delete(ss.Values, pendingUserKey)
+	delete(ss.Values, pendingAtKey)
+	delete(ss.Values, pendingTriesKey)
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"time"
@@ -13,6 +16,42 @@ import (
 	"github.com/gernest/nutz"
 )
 
+const (
+	// The bucket in which all photos will reside.
+	photoBucket = "photos"
+
+	// The bucket which stores metadata about the uploaded files. This bucket is
+	// created inside the photoBucket, or any other bucket holding uploads.
+	metaBucket = "meta"
+
+	// The bucket in which actual data that is in []byte is stored. its also created
+	// inside the photoBucket
+	dataBucket = "data"
+
+	// The bucket in which the resized versions of the photos are cached, keyed by
+	// the photo id and the size. Its also created inside the photoBucket.
+	renditionBucket = "renditions"
+
+	// NOTE: To keep the structure of recording data sane, I have used nested buckets.
+	// So, the structure of the photo storage buckets is roughly like this.
+	//
+	// photoBucket
+	//			 |---metaBucket
+	//			 |---daaBucket
+	//			 |---renditionBucket
+)
+
+// the sizes photos are served in when PhotoSizes is not set, it is the length of
+// the longest side in pixels.
+var defaultPhotoSizes = map[string]int{
+	"thumb":  150,
+	"medium": 640,
+	"large":  1280,
+}
+
+// the quality of the resized jpeg photos, they are meant to be small.
+const renditionQuality = 85
+
 // FileUpload represents the uploaded file
 type FileUpload struct {
 	Body *multipart.File
@@ -29,6 +68,15 @@ type Photo struct {
 	//Size is the size of the photo.
 	Size int `json:"size"`
 
+	// Width and Height are the dimensions of the photo in pixels, after it was
+	// turned the right way up.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// TakenAt is the time the photo was taken, when the camera recorded it. The
+	// rest of the metadata of the uploaded photo is not kept.
+	TakenAt *time.Time `json:"taken_at,omitempty"`
+
 	//UploadedBy is the ID of the user who uploaded the photo
 	UploadedBy string `json:"uploaded_by"`
 
@@ -111,25 +159,11 @@ func GetMultipleFileUpload(r *http.Request, fieldName string) ([]*FileUpload, er
 //
 // The data part is the actual encoded file, its stored in the dataBucket.
 func SaveUploadFile(db nutz.Storage, file *FileUpload, p *Profile) (*Photo, error) {
-	var (
-		// The bucket in which all photos will reside.
-		photoBucket = "photos"
-
-		// The bucket which stores metadata about the photos. This bucket iscreated
-		// inside the photoBucket.
-		metaBucket = "meta"
-
-		// The bucket in which actual data that is in []byte is stored. its also created
-		// inside the photoBucket
-		dataBucket = "data"
-
-		// NOTE: To keep the structure of recording data sane, I have used nested buckets.
-		// So, the structure of the photo storage buckets is roughly like this.
-		//
-		// photoBucket
-		//			 |---metaBucket
-		//			 |---daaBucket
-	)
+	return saveUploadFile(db, photoBucket, file, p)
+}
+
+// saves the uploaded photo in the given bucket, see SaveUploadFile.
+func saveUploadFile(db nutz.Storage, bucket string, file *FileUpload, p *Profile) (*Photo, error) {
 	pic := &Photo{
 		ID:         getUUID(),
 		Type:       file.Ext,
@@ -137,22 +171,39 @@ func SaveUploadFile(db nutz.Storage, file *FileUpload, p *Profile) (*Photo, erro
 		UploadedAt: time.Now(),
 		UpdatedAt:  time.Now(),
 	}
-	data, err := encodePhoto(file)
+	data, info, err := encodePhoto(file)
 	if err != nil {
 		return nil, err
 	}
 	pic.Size = len(data)
-	err = marshalAndCreate(db, pic, photoBucket, pic.ID, metaBucket)
-	if err != nil {
-		return nil, err
+	pic.Width, pic.Height = info.Width, info.Height
+	if !info.TakenAt.IsZero() {
+		pic.TakenAt = &info.TakenAt
 	}
-	s := db.Create(photoBucket, pic.ID, data, dataBucket)
-	if s.Error != nil {
-		return nil, s.Error
+	if err = saveUpload(db, bucket, pic.ID, pic, data); err != nil {
+		return nil, err
 	}
 	return pic, nil
 }
 
+// stores the metadata and the data of an uploaded file in the given bucket.
+func saveUpload(db nutz.Storage, bucket, id string, meta interface{}, data []byte) error {
+	if err := marshalAndCreate(db, meta, bucket, id, metaBucket); err != nil {
+		return err
+	}
+	return db.Create(bucket, id, data, dataBucket).Error
+}
+
+// serves the data of an uploaded file stored in the given bucket.
+func serveUpload(w http.ResponseWriter, r *http.Request, db nutz.Storage, bucket, id, name string, modtime time.Time) {
+	raw := db.Get(bucket, id, dataBucket)
+	if raw.Error != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, modtime, bytes.NewReader(raw.Data))
+}
+
 // extracts file extension.
 func getFileExt(file multipart.File) (string, error) {
 	buf := make([]byte, 512)
@@ -182,33 +233,159 @@ func getUploadFile(file multipart.File) (*FileUpload, error) {
 	return &FileUpload{&file, ext}, nil
 }
 
+// what is known about an encoded photo.
+type photoInfo struct {
+	Width, Height int
+	TakenAt       time.Time
+}
+
 // encodes a given photo, and returns a []byte of the photo. It currently supports
 // png, and jpeg formats. The encoded data is the one which will be stored in the database.
-func encodePhoto(file *FileUpload) ([]byte, error) {
-	ext := file.Ext
-	switch ext {
+//
+// Encoding again drops all the metadata of the uploaded photo, like the location
+// and the camera it was taken with. Only the size, and the time jpeg photos were
+// taken are kept in the returned photoInfo. Jpeg photos are turned the way their
+// exif orientation says first, so they don't show up sideways.
+func encodePhoto(file *FileUpload) ([]byte, *photoInfo, error) {
+	var (
+		img  image.Image
+		info = &photoInfo{}
+		buf  = new(bytes.Buffer)
+	)
+	switch file.Ext {
 	case "jpg", "jpeg":
-		img, err := jpeg.Decode(*file.Body)
+		raw, err := ioutil.ReadAll(*file.Body)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if img, err = jpeg.Decode(bytes.NewReader(raw)); err != nil {
+			return nil, nil, err
+		}
+		if x := readExif(raw); x != nil {
+			img = orientImage(img, x.Orientation)
+			info.TakenAt = x.TakenAt
 		}
 
 		// this is supposed to increase the quality of the image. But I'm not sure
 		// yet if it is necessary or we should just put nil, which will result into
 		// using default values.
 		opts := jpeg.Options{Quality: 98}
+		if err = jpeg.Encode(buf, img, &opts); err != nil {
+			return nil, nil, err
+		}
+	case "png", "PNG":
+		var err error
+		if img, err = png.Decode(*file.Body); err != nil {
+			return nil, nil, err
+		}
+		if err = png.Encode(buf, img); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, errors.New("aurora: file not supported")
+	}
+	b := img.Bounds()
+	info.Width, info.Height = b.Dx(), b.Dy()
+	return buf.Bytes(), info, nil
+}
+
+// returns the length of the longest side of the photos of the given size, the
+// sizes are the ones in PhotoSizes.
+func photoSize(cfg *RemixConfig, size string) (int, bool) {
+	sizes := cfg.PhotoSizes
+	if len(sizes) == 0 {
+		sizes = defaultPhotoSizes
+	}
+	n, ok := sizes[size]
+	return n, ok && n > 0
+}
 
-		buf := new(bytes.Buffer)
-		jpeg.Encode(buf, img, &opts)
-		return buf.Bytes(), nil
+// returns the photo resized so that its longest side is maxSide pixels. The
+// rendition is made the first time it is asked for and cached in the
+// renditionBucket, photos which are already small enough are returned as they are.
+func getRendition(db nutz.Storage, bucket string, pic *Photo, maxSide int) ([]byte, error) {
+	key := fmt.Sprintf("%s_%d", pic.ID, maxSide)
+	if cached := db.Get(bucket, key, renditionBucket); cached.Error == nil && len(cached.Data) > 0 {
+		return cached.Data, nil
+	}
+	raw := db.Get(bucket, pic.ID, dataBucket)
+	if raw.Error != nil {
+		return nil, raw.Error
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw.Data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Dx() <= maxSide && b.Dy() <= maxSide {
+		return raw.Data, nil
+	}
+	buf := new(bytes.Buffer)
+	small := resizeImage(img, maxSide)
+	switch pic.Type {
 	case "png", "PNG":
-		img, err := png.Decode(*file.Body)
-		if err != nil {
-			return nil, err
+		err = png.Encode(buf, small)
+	default:
+		err = jpeg.Encode(buf, small, &jpeg.Options{Quality: renditionQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Create(bucket, key, buf.Bytes(), renditionBucket).Error; err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scales down the image so that its longest side is maxSide pixels, keeping the
+// aspect ratio. Every pixel is the average of the pixels of the original it
+// covers, which is good enough for making photos smaller.
+func resizeImage(img image.Image, maxSide int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw >= sh && sw > maxSide {
+		dw, dh = maxSide, sh*maxSide/sw
+	} else if sh > sw && sh > maxSide {
+		dw, dh = sw*maxSide/sh, maxSide
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					bl += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(bl / n)
+			dst.Pix[j+3] = uint8(a / n)
 		}
-		buf := new(bytes.Buffer)
-		png.Encode(buf, img)
-		return buf.Bytes(), nil
 	}
-	return nil, errors.New("aurora: file not supported")
+	return dst
 }
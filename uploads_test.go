@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
@@ -147,6 +150,75 @@ func TestSaveUploadFile(t *testing.T) {
 
 }
 
+func TestRenditions(t *testing.T) {
+	pdb := nutz.NewStorage("fixture/renditions.bdb", 0600, nil)
+	defer pdb.DeleteDatabase()
+
+	req, err := requestWithFile("me.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := GetFileUpload(req, "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pic, err := SaveUploadFile(pdb, f, &Profile{ID: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &RemixConfig{}
+	if _, ok := photoSize(cfg, "huge"); ok {
+		t.Error("expected huge not to be a photo size")
+	}
+	thumb, ok := photoSize(cfg, "thumb")
+	if !ok {
+		t.Fatal("expected thumb to be a photo size")
+	}
+	data, err := getRendition(pdb, photoBucket, pic, thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() > thumb || b.Dy() > thumb || (b.Dx() != thumb && b.Dy() != thumb) {
+		t.Errorf("expected the longest side to be %d got %v", thumb, b)
+	}
+	if cached := pdb.Get(photoBucket, fmt.Sprintf("%s_%d", pic.ID, thumb), renditionBucket); !bytes.Equal(cached.Data, data) {
+		t.Error("expected the rendition to be cached")
+	}
+
+	// photos are never made bigger
+	orig := pdb.Get(photoBucket, pic.ID, dataBucket)
+	if data, err = getRendition(pdb, photoBucket, pic, 1<<15); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, orig.Data) {
+		t.Error("expected the original photo")
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 10))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 10; y++ {
+			if x%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	small := resizeImage(img, 20)
+	if b := small.Bounds(); b.Dx() != 20 || b.Dy() != 5 {
+		t.Fatalf("expected 20x5 got %v", b)
+	}
+	if c := small.RGBAAt(3, 2); c.R != 127 || c.A != 255 {
+		t.Errorf("expected the pixels to be averaged got %v", c)
+	}
+}
+
 func checkExtension(f *FileUpload, ext string, t *testing.T) {
 	rext, err := getFileExt(*f.Body)
 	if err != nil {
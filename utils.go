@@ -10,10 +10,27 @@ import (
 	"github.com/nu7hatch/gouuid"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/boltdb/bolt"
 	"github.com/gernest/nutz"
 	"github.com/gorilla/sessions"
 )
 
+// runs fn in a single transaction on the database of db, a read only one unless
+// writable is true. This is for the few things which need more than one nutz call
+// to happen at once, it is the only place where the database files are opened
+// outside of nutz.
+func withTx(db nutz.Storage, writable bool, fn func(*bolt.Tx) error) error {
+	bdb, err := bolt.Open(db.DBName, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+	if writable {
+		return bdb.Update(fn)
+	}
+	return bdb.View(fn)
+}
+
 // serialize the given object obj into json format and saves it into the dtabase
 func marshalAndCreate(db nutz.Storage, obj interface{}, buck, key string, nest ...string) error {
 	data, err := json.Marshal(obj)